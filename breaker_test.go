@@ -0,0 +1,65 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	m := newMockServer(t)
+	var failing atomic.Bool
+	var hits atomic.Int32
+	m.mux.HandleFunc("/system_stats", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	c, err := NewDefaultClientStr(m.URL, WithCircuitBreaker(2, 50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	request := func() error {
+		resp, err := c.getJson(context.Background(), "/system_stats", nil, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	failing.Store(true)
+	for i := 0; i < 2; i++ {
+		if err := request(); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if err := request(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("request after the failures = %v, want %v", err, ErrCircuitOpen)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("server hits = %d, want 2, the open breaker must not call the server", got)
+	}
+
+	// a request which returns before it is sent must not take the trial
+	time.Sleep(60 * time.Millisecond)
+	if _, err := c.makeRequest(context.Background(), http.MethodPost, "/system_stats", nil, "x", nil, "text/plain"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("request with an unsupported content type = %v, want a content type error", err)
+	}
+
+	failing.Store(false)
+	if err := request(); err != nil {
+		t.Fatalf("trial request after the cooldown: %v", err)
+	}
+	if err := request(); err != nil {
+		t.Errorf("request after a successful trial: %v", err)
+	}
+	if got := hits.Load(); got != 4 {
+		t.Errorf("server hits = %d, want 4", got)
+	}
+}
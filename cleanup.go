@@ -0,0 +1,140 @@
+package comfyUIclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CancelAndCleanup aborts the prompt and forgets it
+// A running prompt is interrupted and a pending one deleted from the queue, then the history of the prompt,
+// which lists the outputs and temp outputs it produced, is deleted and the client stops tracking it
+// ComfyUI has no endpoint to delete output files, temp files stay until the server cleans its temp folder
+// An interrupted prompt is added to history once it stops, CancelAndCleanup waits for that, bound it with ctx
+func (c *Client) CancelAndCleanup(ctx context.Context, promptID string) error {
+	running, pending, err := c.cancelPrompt(ctx, promptID)
+	if err != nil {
+		return fmt.Errorf("c.cancelPrompt: error: %w", err)
+	}
+	if running {
+		if err := c.waitForHistory(ctx, promptID); err != nil {
+			return fmt.Errorf("c.waitForHistory: error: %w", err)
+		}
+	}
+
+	// a pending prompt has no history, a finished one is cleaned up as well
+	if !pending {
+		if err := c.deleteHistory(ctx, []string{promptID}); err != nil {
+			return fmt.Errorf("c.deleteHistory: error: %w", err)
+		}
+	}
+	c.forgetPrompt(promptID)
+	return nil
+}
+
+// cancelPrompt interrupts the prompt when it runs and deletes it from the queue when it is pending
+// It reports which of both it was, a prompt which is neither has already finished
+func (c *Client) cancelPrompt(ctx context.Context, promptID string) (running, pending bool, err error) {
+	queueInfo, err := c.getQueueInfo(ctx)
+	if err != nil {
+		return false, false, fmt.Errorf("c.getQueueInfo: error: %w", err)
+	}
+	for _, item := range queueInfo.QueuePending {
+		if item.PromptID == promptID {
+			pending = true
+		}
+	}
+	for _, item := range queueInfo.QueueRunning {
+		if item.PromptID == promptID {
+			running = true
+		}
+	}
+
+	switch {
+	case running:
+		if err := c.interruptPrompt(ctx, promptID); err != nil {
+			return running, pending, fmt.Errorf("c.interruptPrompt: error: %w", err)
+		}
+	case pending:
+		if err := c.deleteQueues(ctx, []string{promptID}); err != nil {
+			return running, pending, fmt.Errorf("c.deleteQueues: error: %w", err)
+		}
+	}
+	return running, pending, nil
+}
+
+// waitForHistory polls history until the prompt is in it
+func (c *Client) waitForHistory(ctx context.Context, promptID string) error {
+	ticker := time.NewTicker(historyLagInterval)
+	defer ticker.Stop()
+	for {
+		history, err := c.getHistoryByPromptID(ctx, promptID)
+		if err != nil {
+			return fmt.Errorf("c.getHistoryByPromptID: error: %w", err)
+		}
+		if history != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// forgetPrompt drops everything the client tracks about the prompt
+func (c *Client) forgetPrompt(promptID string) {
+	if c.timingTracker != nil {
+		c.timingTracker.Forget(promptID)
+	}
+	if c.executionTrace != nil {
+		c.executionTrace.Forget(promptID)
+	}
+	if c.progressTracker != nil {
+		c.progressTracker.Forget(promptID)
+	}
+
+	c.recentMu.Lock()
+	recent := c.recentPrompts[:0]
+	for _, id := range c.recentPrompts {
+		if id != promptID {
+			recent = append(recent, id)
+		}
+	}
+	c.recentPrompts = recent
+	c.recentMu.Unlock()
+
+	c.subMu.Lock()
+	delete(c.ownedPrompts, promptID)
+	c.subMu.Unlock()
+}
+
+// schedulePrune prunes the state of the finished prompt once the subscription ttl passed, see WithSubscriptionTTL
+func (c *Client) schedulePrune(promptID string) {
+	if promptID == "" {
+		return
+	}
+	time.AfterFunc(c.subscriptionTTL, func() {
+		c.prunePrompt(promptID)
+	})
+}
+
+// prunePrompt drops the state the client keeps per prompt after it finished
+// Unlike forgetPrompt the prompt stays in the recent prompts, which are bounded anyway
+func (c *Client) prunePrompt(promptID string) {
+	if c.timingTracker != nil {
+		c.timingTracker.Forget(promptID)
+	}
+	if c.executionTrace != nil {
+		c.executionTrace.Forget(promptID)
+	}
+	if c.progressTracker != nil {
+		c.progressTracker.Forget(promptID)
+	}
+
+	c.subMu.Lock()
+	// a failed or interrupted prompt never sends the executing message which releases it
+	delete(c.ownedPrompts, promptID)
+	c.subMu.Unlock()
+}
@@ -0,0 +1,139 @@
+package comfyUIclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCancelAndCleanup(t *testing.T) {
+	m := newMockServer(t)
+	var mu sync.Mutex
+	var deleted []string
+	m.mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		deleted = append(deleted, strings.TrimSpace(string(body)))
+		mu.Unlock()
+	})
+	m.mux.HandleFunc("/history/p1", func(w http.ResponseWriter, r *http.Request) {
+		// the interrupted prompt is added to history once it stops
+		if len(m.recordedCalls()) == 0 {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		fmt.Fprint(w, `{"p1":{"prompt":[1,"p1",{}],"outputs":{
+			"7":{"images":[{"filename":"ComfyUI_temp_00001_.png","subfolder":"","type":"temp"}]}},
+			"status":{"status_str":"error","completed":false,"messages":[]}}}`)
+	})
+	m.setQueue([]string{"p1"}, []string{"p2"})
+
+	timings, trace := NewTimingTracker(), NewExecutionTrace()
+	c, err := NewDefaultClientStr(m.URL, WithTaskStatusBufferSize(4), WithTimingTracker(timings), WithExecutionTrace(trace))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	c.rememberPrompt("p1")
+	for _, msg := range []string{`{"type":"execution_start","data":{"prompt_id":"p1"}}`, executingMessage("p1", "7")} {
+		if err := c.Handle(msg); err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+	}
+	if err := c.CancelAndCleanup(context.Background(), "p1"); err != nil {
+		t.Fatalf("CancelAndCleanup: %v", err)
+	}
+	if calls := m.recordedCalls(); len(calls) != 1 || calls[0] != `/interrupt {"prompt_id":"p1"}` {
+		t.Errorf("calls = %v, want the interrupt of p1", calls)
+	}
+	mu.Lock()
+	if len(deleted) != 1 || deleted[0] != `{"delete":["p1"]}` {
+		t.Errorf("history deletes = %v, want p1 with its temp outputs", deleted)
+	}
+	mu.Unlock()
+	if _, ok := timings.Timings("p1"); ok {
+		t.Error("timings of p1 are still tracked")
+	}
+	if nodes, _ := trace.Trace("p1"); len(nodes) != 0 {
+		t.Errorf("trace of p1 = %v, want it forgotten", nodes)
+	}
+	if c.queuedRecently("p1") {
+		t.Error("p1 is still remembered as queued")
+	}
+}
+
+func TestCancelAndCleanupPending(t *testing.T) {
+	m := newMockServer(t)
+	m.setQueue([]string{"p1"}, []string{"p2"})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	if err := c.CancelAndCleanup(context.Background(), "p2"); err != nil {
+		t.Fatalf("CancelAndCleanup: %v", err)
+	}
+	if calls := m.recordedCalls(); len(calls) != 1 || calls[0] != `/queue {"delete":["p2"]}` {
+		t.Errorf("calls = %v, want p2 deleted from the queue and nothing interrupted", calls)
+	}
+}
+
+func TestWithSubscriptionTTL(t *testing.T) {
+	m := newMockServer(t)
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		m.send(t, fmt.Sprintf(`{"type":"execution_start","data":{"prompt_id":%q}}`, promptID))
+		m.send(t, executingMessage(promptID, "9"))
+		m.send(t, executedMessage(promptID, "9", promptID+".png"))
+		var number int
+		fmt.Sscanf(promptID, "prompt-%d", &number)
+		if number%2 == 0 {
+			// a failed prompt never sends the executing message without node
+			m.send(t, fmt.Sprintf(`{"type":"execution_error","data":{"prompt_id":%q,"node_id":"9","node_type":"SaveImage","exception_message":"boom"}}`, promptID))
+			return
+		}
+		m.send(t, fmt.Sprintf(`{"type":"execution_success","data":{"prompt_id":%q}}`, promptID))
+		m.send(t, executingMessage(promptID, ""))
+	}
+	tracker, trace := NewTimingTracker(), NewExecutionTrace()
+	ttl := 300 * time.Millisecond
+	c := newConnectedClient(t, m, WithSubscriptionTTL(ttl), WithTimingTracker(tracker), WithExecutionTrace(trace))
+
+	var promptIDs []string
+	for i := 0; i < 20; i++ {
+		result, _ := c.RunWorkflow(context.Background(), map[string]interface{}{"9": map[string]interface{}{}})
+		if result == nil {
+			t.Fatalf("RunWorkflow %d: prompt was not queued", i)
+		}
+		promptIDs = append(promptIDs, result.PromptID)
+	}
+	last := promptIDs[len(promptIDs)-1]
+	if _, ok := tracker.Timings(last); !ok {
+		t.Fatalf("timings of %s are pruned before the ttl", last)
+	}
+
+	size := func() (timings, traces, owned int) {
+		tracker.mu.Lock()
+		timings = len(tracker.prompts)
+		tracker.mu.Unlock()
+		trace.mu.Lock()
+		traces = len(trace.prompts)
+		trace.mu.Unlock()
+		c.subMu.Lock()
+		owned = len(c.ownedPrompts)
+		c.subMu.Unlock()
+		return timings, traces, owned
+	}
+	waitFor(t, "pruned state", func() bool {
+		timings, traces, owned := size()
+		return timings == 0 && traces == 0 && owned == 0
+	})
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	if len(c.subscriptions) != 0 {
+		t.Errorf("subscriptions = %d, want 0", len(c.subscriptions))
+	}
+}
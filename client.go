@@ -2,6 +2,8 @@ package comfyUIclient
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,12 +11,24 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrSessionNotReady is returned when the websocket session has not received its sid in time
+	ErrSessionNotReady = errors.New("websocket session is not ready")
+	// ErrUserDataNotFound is returned when a user data file or directory does not exist
+	ErrUserDataNotFound = errors.New("user data not found")
+	// ErrPromptNotFound is returned when a prompt can not be found on the server
+	ErrPromptNotFound = errors.New("prompt not found")
+)
+
 type Client struct {
 	ID          string
 	baseURL     string
@@ -24,8 +38,98 @@ type Client struct {
 	httpClient  *http.Client
 	Token       string
 	BearerToken string
+	apiPrefix   bool
+	// runConcurrency bounds the workflows RunWorkflows runs at once, 0 means unbounded
+	runConcurrency int
+	// strictSessionFilter drops status messages which belong to other sessions
+	strictSessionFilter bool
+	chSize              int
+	overflowPolicy      OverflowPolicy
+	droppedMessages     atomic.Uint64
+	promptInterceptor   PromptInterceptor
+	binaryPreviews      bool
+	droppedBinary       atomic.Uint64
+	userID              string
+	// clientIDLoader and clientIDSaver keep the client id across restarts, see WithPersistentClientID
+	clientIDLoader func() string
+	clientIDSaver  func(string)
+	// clientLabel tells operators which client submitted a prompt, see WithClientLabel
+	clientLabel string
+	breaker     *circuitBreaker
+	// interruptOnDisconnect interrupts the running prompt when the websocket drops
+	interruptOnDisconnect bool
+	timingTracker         *TimingTracker
+	executionTrace        *ExecutionTrace
+	// progressCoalescer limits how often progress messages are forwarded, see WithProgressCoalesce
+	progressCoalescer *progressCoalescer
+	// oomRetries is how often RunWorkflow resubmits a prompt which ran out of memory
+	oomRetries int
+	// downloadRetries is how often DownloadOutput resumes a download which broke off
+	downloadRetries int
+	// progressTracker computes the weighted progress of the prompts, see WithProgressTracker
+	progressTracker *ProgressTracker
+	// stats are published with expvar, see WithExpvar
+	stats *connectionStats
+	// subscriptionTTL is how long the state of a finished prompt is kept, see WithSubscriptionTTL
+	subscriptionTTL time.Duration
+	// spans are the tracing spans of the submitted prompts, see WithTracer
+	spans *promptSpans
+	// onQueueUpdated is called with the queue the server pushes, see WithOnQueueUpdated
+	onQueueUpdated func(*WSMessageDataQueueUpdated)
+	// versionCheck checks the version of the server once connected, versionWarning is called when it is
+	// untested, see WithVersionCheck
+	versionCheck   bool
+	versionWarning func(*UntestedVersionError)
+	// onReconnect is called after every reconnect, disconnectedAt is the unix nanoseconds the websocket
+	// dropped, see WithOnReconnect
+	onReconnect    func(ReconnectEvent)
+	disconnectedAt atomic.Int64
+	// errCh receives the errors of handling the frames, see Errors
+	errCh chan error
+	// wsOpts are applied to the websocket connection once it is created
+	wsOpts []func(*WebSocketConnection)
+	// tokenMu guards BearerToken, which a TokenProvider may refresh while requests are made
+	tokenMu sync.RWMutex
+	// recentPrompts are the ids of the prompts queued last, see GetPromptStatus
+	recentMu      sync.Mutex
+	recentPrompts []string
+
+	// connMu guards the listen loop the high-level helpers share, see acquireConnection
+	connMu        sync.Mutex
+	listenStarted bool
+	waiters       int
+	closing       bool
+
+	// sessionReady is closed when the first status message with our sid arrives
+	sessionReady   chan struct{}
+	sessionOnce    sync.Once
+	sessionMu      sync.Mutex
+	sessionID      string
+	sessionTimeout time.Duration
+
+	// While prompts are being submitted, messages nobody has claimed are held back, they may belong to
+	// a submitted prompt whose id is not known yet, see submitAndSubscribe
+	subMu           sync.Mutex
+	subscriptions   map[string]map[*subscription]struct{}
+	ownedPrompts    map[string]struct{}
+	runningPromptID string
+	submitting      int
+	held            []heldMessage
+	releasingHeld   bool
 }
 
+// OverflowPolicy decides what happens when the task status channel is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the listen loop until the consumer reads, it is the default policy
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the incoming message
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest buffered message to make room for the incoming one
+	OverflowDropOldest
+)
+
 func (c *Client) GetBaseURL() string {
 	return c.baseURL
 }
@@ -51,61 +155,270 @@ func (e *EndPoint) String() string {
 	return e.Protocol + "://" + e.Address + ":" + e.Port
 }
 
-func NewDefaultClient(endPoint *EndPoint) *Client {
-	return NewClient(endPoint, &http.Client{Timeout: 10 * time.Second})
+func NewDefaultClient(endPoint *EndPoint, opts ...ClientOption) *Client {
+	return NewClient(endPoint, &http.Client{Timeout: 10 * time.Second}, opts...)
 }
 
-func NewDefaultClientStr(baseURL string) (*Client, error) {
+func NewDefaultClientStr(baseURL string, opts ...ClientOption) (*Client, error) {
 	baseURLParsed, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, fmt.Errorf("url.Parse: error: %w", err)
 	}
 	endPoint := NewEndPoint(baseURLParsed.Scheme, baseURLParsed.Hostname(), baseURLParsed.Port())
-	return NewDefaultClient(endPoint), nil
+	return NewDefaultClient(endPoint, opts...), nil
 }
 
-func NewClient(endPoint *EndPoint, httpClient *http.Client) *Client {
+// NewClient creates a client which sends HTTP requests with httpClient
+// Responses are gzip compressed when the transport asks for it, which http.Transport does by default,
+// a transport with DisableCompression set receives uncompressed responses
+func NewClient(endPoint *EndPoint, httpClient *http.Client, opts ...ClientOption) *Client {
 	c := &Client{
-		ID:         uuid.New().String(),
 		baseURL:    endPoint.String(),
 		httpClient: httpClient,
-		ch:         make(chan *WSMessage),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.ID == "" && c.clientIDLoader != nil {
+		c.ID = c.clientIDLoader()
+	}
+	if c.ID == "" {
+		c.ID = uuid.New().String()
+		if c.clientIDSaver != nil {
+			c.clientIDSaver(c.ID)
+		}
+	}
+	c.ch = make(chan *WSMessage, c.chSize)
+	c.errCh = make(chan error, errorChannelSize)
+	c.sessionReady = make(chan struct{})
 
 	if strings.HasPrefix(c.baseURL, "https") {
 		endPoint.Protocol = "wss"
 	} else {
 		endPoint.Protocol = "ws"
 	}
-	c.webSocket = NewDefaultWebSocketConnection(endPoint.String()+"/ws?clientId="+c.ID, c, c.BearerToken)
+	c.webSocket = NewDefaultWebSocketConnection(endPoint.String()+c.routerPath(string(WebSocketRouter))+"?clientId="+url.QueryEscape(c.ID), c, c.BearerToken)
+	for _, opt := range c.wsOpts {
+		opt(c.webSocket)
+	}
+	if c.stats != nil {
+		c.publishExpvar()
+	}
 	return c
 }
 
+// routerPath returns the router with the api prefix applied when it is enabled
+func (c *Client) routerPath(router string) string {
+	if c.apiPrefix {
+		return APIPrefix + router
+	}
+	return router
+}
+
+// ClientID returns the client id which ties prompts to the websocket session
+func (c *Client) ClientID() string {
+	return c.ID
+}
+
 func (c *Client) SetEASToken(token string) {
 	c.Token = token
 }
 
+// SetBearerToken sets the bearer token of both the HTTP requests and the websocket handshake
 func (c *Client) SetBearerToken(token string) {
-	c.BearerToken = token
+	c.setHTTPBearerToken(token)
 	if c.webSocket != nil {
-		c.webSocket.BearerToken = token
+		c.webSocket.SetBearerToken(token)
 	}
 }
 
+func (c *Client) setHTTPBearerToken(token string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.BearerToken = token
+}
+
+func (c *Client) bearerToken() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.BearerToken
+}
+
 func (c *Client) IsInitialized() bool {
 	return c.webSocket.GetIsConnected()
 }
 
 func (c *Client) ConnectAndListen() {
-	go c.webSocket.ConnectAndListen()
+	c.ConnectAndListenContext(context.Background())
+}
+
+// Use wraps the handling of text frames in middleware, see WebSocketConnection.Use
+func (c *Client) Use(middleware Middleware) {
+	c.webSocket.Use(middleware)
+}
+
+// Connect connects the websocket without the listen loop, read it with ReadMessage
+// RunWorkflow, WaitForPrompt and the task status channel rely on the listen loop and do not work without it
+func (c *Client) Connect() error {
+	return c.webSocket.Connect()
+}
+
+// ReadMessage reads the next message of a websocket connected with Connect
+// The message is returned as is, the client does not track it
+func (c *Client) ReadMessage(ctx context.Context) (WSMessage, error) {
+	return c.webSocket.ReadMessage(ctx)
+}
+
+// ConnectAndListenContext connects and listens in the background until ctx is done
+// Once ctx is done the connection shuts down and pending waiters such as RunWorkflow return ErrConnectionClosed
+func (c *Client) ConnectAndListenContext(ctx context.Context) {
+	c.connMu.Lock()
+	c.listenStarted = true
+	c.connMu.Unlock()
+	go c.webSocket.ConnectAndListenContext(ctx)
+}
+
+// ConnectAndWaitReady connects and listens in the background like ConnectAndListen, and returns once the
+// first status message with the sid of the session arrives, so prompts queued after it are routed to this client
+// When ctx is done first its error is returned and the listen loop keeps running, stop it with Close
+func (c *Client) ConnectAndWaitReady(ctx context.Context) error {
+	c.connMu.Lock()
+	if c.closing {
+		c.connMu.Unlock()
+		return ErrConnectionClosed
+	}
+	if !c.listenStarted {
+		c.listenStarted = true
+		go c.webSocket.ConnectAndListen()
+	}
+	c.connMu.Unlock()
+
+	select {
+	case <-c.sessionReady:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.Context().Done():
+		return ErrConnectionClosed
+	}
+}
+
+// connectPollInterval is how often acquireConnection checks whether the shared connection is up
+const connectPollInterval = 10 * time.Millisecond
+
+// acquireConnection makes sure the shared websocket is listening and counts the caller as a waiter
+// The connection is started on first use and kept open for later calls until Close, release it with
+// releaseConnection
+func (c *Client) acquireConnection(ctx context.Context) error {
+	c.connMu.Lock()
+	if c.closing {
+		c.connMu.Unlock()
+		return ErrConnectionClosed
+	}
+	if !c.listenStarted {
+		c.listenStarted = true
+		go c.webSocket.ConnectAndListen()
+	}
+	c.waiters++
+	c.connMu.Unlock()
+
+	ticker := time.NewTicker(connectPollInterval)
+	defer ticker.Stop()
+	for !c.IsInitialized() {
+		select {
+		case <-ctx.Done():
+			c.releaseConnection()
+			return ctx.Err()
+		case <-c.Context().Done():
+			c.releaseConnection()
+			return ErrConnectionClosed
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// releaseConnection ends a waiter of acquireConnection, the last one shuts the connection down if Close was called
+func (c *Client) releaseConnection() {
+	c.connMu.Lock()
+	c.waiters--
+	shutdown := c.closing && c.waiters == 0
+	c.connMu.Unlock()
+	if shutdown {
+		c.webSocket.Shutdown()
+	}
+}
+
+// Close shuts the shared websocket down once the running waiters such as RunWorkflow return
+// Helpers called after Close fail with ErrConnectionClosed
+func (c *Client) Close() error {
+	c.connMu.Lock()
+	c.closing = true
+	waiting := c.waiters > 0
+	c.connMu.Unlock()
+	if waiting {
+		return nil
+	}
+	return c.webSocket.Shutdown()
+}
+
+// Flush dispatches the messages which are already on their way, then shuts the websocket down
+func (c *Client) Flush(ctx context.Context) error {
+	return c.webSocket.Flush(ctx)
 }
 
+// Context returns the context of the websocket connection, it is cancelled when the connection shuts down
+func (c *Client) Context() context.Context {
+	return c.webSocket.Context()
+}
+
+// SendTaskStatus sends the message to the task status channel according to the overflow policy
+// With a drop policy it never blocks, dropped messages are counted by DroppedMessages
 func (c *Client) SendTaskStatus(w *WSMessage) error {
-	if c.ch != nil {
+	if c.ch == nil {
+		return errors.New("client not initialized, ch is nil")
+	}
+
+	policy := c.overflowPolicy
+	if policy == OverflowDropOldest && cap(c.ch) == 0 {
+		// an unbuffered channel has nothing old to drop
+		policy = OverflowDropNewest
+	}
+
+	switch policy {
+	case OverflowDropNewest:
+		select {
+		case c.ch <- w:
+		default:
+			c.droppedMessages.Add(1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case c.ch <- w:
+				return nil
+			default:
+			}
+			select {
+			case <-c.ch:
+				c.droppedMessages.Add(1)
+			default:
+			}
+		}
+	default:
 		c.ch <- w
-		return nil
 	}
-	return errors.New("client not initialized, ch is nil")
+	return nil
+}
+
+// DroppedMessages returns the number of messages dropped because the task status channel was full
+func (c *Client) DroppedMessages() uint64 {
+	return c.droppedMessages.Load()
+}
+
+// DroppedBinaryFrames returns the number of binary frames dropped because binary previews are not enabled
+func (c *Client) DroppedBinaryFrames() uint64 {
+	return c.droppedBinary.Load()
 }
 
 func (c *Client) GetTaskStatus() chan *WSMessage {
@@ -119,24 +432,217 @@ func (c *Client) GetQueueCount() int {
 func (c *Client) Handle(msg string) error {
 	message := &WSMessage{}
 	if err := json.Unmarshal([]byte(msg), message); err != nil {
+		// a frame which is not even JSON fails before WSMessage.UnmarshalJSON is called
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			err = newParseError("", []byte(msg), err)
+		}
 		return fmt.Errorf("json.Unmarshal: error: %w", err)
 	}
+	c.countMessage(message.Type)
+
+	if c.strictSessionFilter && !c.IsOwnMessage(message) {
+		return nil
+	}
 
 	switch message.Type {
 	case Status:
 		s := message.Data.(*WSMessageDataStatus)
-		c.queueCount = s.Status.ExecInfo.QueueRemaining
+		if s.SID != "" && c.IsOwnMessage(message) {
+			c.setSessionID(s.SID)
+		}
+		if s.Status.ExecInfo != nil {
+			c.queueCount = s.Status.ExecInfo.QueueRemaining
+		}
+	case QueueUpdated, QueueEvent:
+		if c.onQueueUpdated != nil {
+			c.onQueueUpdated(message.Data.(*WSMessageDataQueueUpdated))
+		}
 	case ExecutionStart, ExecutionCached, Executing,
 		Progress, Executed, ExecutionInterrupted, ExecutionError, ExecutionSuccess:
-		if err := c.SendTaskStatus(message); err != nil {
-			return fmt.Errorf("SendTaskStatus: error: %w", err)
+		if c.timingTracker != nil {
+			c.timingTracker.Observe(message)
 		}
+		if c.executionTrace != nil {
+			c.executionTrace.Observe(message)
+		}
+		if c.progressTracker != nil {
+			c.progressTracker.Observe(message)
+		}
+		if c.spans != nil {
+			c.spans.observe(c.promptIDOf(message), message)
+		}
+		if c.subscriptionTTL > 0 {
+			if finished, _ := promptEnd(message); finished {
+				c.schedulePrune(c.promptIDOf(message))
+			}
+		}
+		if c.progressCoalescer != nil {
+			return c.coalesce(message)
+		}
+		return c.dispatch(message)
 	default:
+		if isRegisteredMessageType(message.Type) {
+			return c.sendUnclaimed(message)
+		}
 		return fmt.Errorf("unknown message type: %s, message: %v", message.Type, message)
 	}
 	return nil
 }
 
+// HandleBinary decodes a binary frame and sends it as a BinaryPreview message
+// Binary frames are dropped unless WithBinaryPreviews is set, they are counted by DroppedBinaryFrames
+func (c *Client) HandleBinary(b []byte) error {
+	if !c.binaryPreviews {
+		c.droppedBinary.Add(1)
+		return nil
+	}
+
+	c.countMessage(BinaryPreview)
+	preview, err := DecodeBinaryPreview(b)
+	if err != nil {
+		return fmt.Errorf("DecodeBinaryPreview: error: %w", err)
+	}
+
+	message := &WSMessage{Type: BinaryPreview, Data: preview}
+	if c.dispatchToSubscriptions(message) {
+		return nil
+	}
+	return c.sendUnclaimed(message)
+}
+
+// dispatch delivers the message to the subscriptions of its prompt or sends it to the task status channel
+func (c *Client) dispatch(message *WSMessage) error {
+	if c.dispatchToSubscriptions(message) {
+		return nil
+	}
+	return c.sendUnclaimed(message)
+}
+
+// coalesce passes progress messages to the progress coalescer
+// Other messages first flush the progress kept back for their prompt, so the order is kept
+func (c *Client) coalesce(message *WSMessage) error {
+	promptID := c.promptIDOf(message)
+	if message.Type == Progress {
+		return c.progressCoalescer.add(promptID, message)
+	}
+	if err := c.progressCoalescer.flush(promptID, isPromptFinished(message)); err != nil {
+		return fmt.Errorf("flush progress: error: %w", err)
+	}
+	return c.dispatch(message)
+}
+
+// promptIDOf returns the prompt id of the message, messages without one belong to the running prompt
+func (c *Client) promptIDOf(message *WSMessage) string {
+	if promptID := messagePromptID(message); promptID != "" {
+		return promptID
+	}
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	return c.runningPromptID
+}
+
+// errorChannelSize is how many errors Errors buffers, later ones are dropped until it is read
+const errorChannelSize = 16
+
+// Errors returns the channel which receives the errors of handling the frames of the websocket, e.g. a
+// ParseError with the raw frame which could not be decoded
+// The listen loop goes on after an error, errors are dropped while the channel is full
+func (c *Client) Errors() <-chan error {
+	return c.errCh
+}
+
+// HandleError sends the error of a frame to the error channel without blocking the listen loop
+func (c *Client) HandleError(err error) {
+	if c.stats != nil {
+		c.stats.errors.Add(1)
+	}
+	select {
+	case c.errCh <- err:
+	default:
+	}
+}
+
+// sendUnclaimed sends a message no subscription has claimed to the task status channel
+func (c *Client) sendUnclaimed(message *WSMessage) error {
+	if err := c.SendTaskStatus(message); err != nil {
+		return fmt.Errorf("SendTaskStatus: error: %w", err)
+	}
+	return nil
+}
+
+// HandleDisconnect is called when the websocket drops unexpectedly
+// With WithInterruptOnDisconnect it interrupts the prompt of this client which was running
+func (c *Client) HandleDisconnect(err error) {
+	c.disconnectedAt.CompareAndSwap(0, time.Now().UnixNano())
+	if !c.interruptOnDisconnect {
+		return
+	}
+
+	c.subMu.Lock()
+	promptID := c.runningPromptID
+	c.subMu.Unlock()
+	if promptID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.InterruptIfRunning(ctx, promptID); err != nil {
+		fmt.Printf("[%s] interrupt prompt %s on disconnect error %v\n", c.baseURL, promptID, err)
+	}
+}
+
+// SessionID returns the sid the server assigned to the websocket session, it is empty until the first status message
+func (c *Client) SessionID() string {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	return c.sessionID
+}
+
+func (c *Client) setSessionID(sid string) {
+	c.sessionMu.Lock()
+	c.sessionID = sid
+	c.sessionMu.Unlock()
+	c.sessionOnce.Do(func() {
+		close(c.sessionReady)
+		if c.versionCheck {
+			go c.checkVersionOnConnect()
+		}
+	})
+}
+
+// waitForSession returns the client id prompts are queued with
+// With the session gate enabled it waits for the sid of the websocket session first
+func (c *Client) waitForSession(ctx context.Context) (string, error) {
+	if c.sessionTimeout <= 0 {
+		return c.ID, nil
+	}
+
+	timer := time.NewTimer(c.sessionTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.sessionReady:
+		return c.SessionID(), nil
+	case <-timer.C:
+		return "", ErrSessionNotReady
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.Context().Done():
+		return "", ErrConnectionClosed
+	}
+}
+
+// IsOwnMessage reports whether the message belongs to this client's session
+// Only status messages carry a sid, a status without sid is a broadcast and belongs to every session
+func (c *Client) IsOwnMessage(message *WSMessage) bool {
+	s, ok := message.Data.(*WSMessageDataStatus)
+	if !ok || s.SID == "" {
+		return true
+	}
+	return s.SID == c.ID
+}
+
 // QueuePromptByString queues a prompt and starts execution by workflow which type is string
 // workflow must be a json string
 // extraDataString must be a json string
@@ -153,19 +659,24 @@ func (c *Client) QueuePromptByString(workflow string, extraDataString string) (*
 		extraDataString = "{}"
 	}
 
+	prompt, err := c.interceptPrompt(json.RawMessage(workflow))
+	if err != nil {
+		return nil, err
+	}
+
 	temp := struct {
-		ClientID  string          `json:"client_id"`
-		Prompt    json.RawMessage `json:"prompt"`
-		ExtraData *extraData      `json:"extra_data"`
+		ClientID  string      `json:"client_id"`
+		Prompt    interface{} `json:"prompt"`
+		ExtraData *extraData  `json:"extra_data"`
 	}{
-		Prompt:   []byte(workflow),
+		Prompt:   prompt,
 		ClientID: c.ID,
 		ExtraData: &extraData{
 			ExtraPngInfo: []byte(extraDataString),
 		},
 	}
 
-	resp, err := c.postJSONUsesRouter(PromptRouter, temp, nil)
+	resp, err := c.postJSONUsesRouter(context.Background(), PromptRouter, temp, nil)
 	if err != nil {
 		return nil, fmt.Errorf("httpClient.Post: error: %w", err)
 	}
@@ -190,22 +701,141 @@ func (c *Client) QueuePromptByNodes(nodes map[string]PromptNode, extraDataString
 		return nil, errors.New("nodes is empty")
 	}
 
+	if extraDataString == "" {
+		extraDataString = "{}"
+	}
+
+	prompt, err := c.interceptPrompt(nodes)
+	if err != nil {
+		return nil, err
+	}
+
 	temp := struct {
-		ClientID  string                `json:"client_id"`
-		Prompt    map[string]PromptNode `json:"prompt"`
-		ExtraData *extraData            `json:"extra_data"`
+		ClientID  string      `json:"client_id"`
+		Prompt    interface{} `json:"prompt"`
+		ExtraData *extraData  `json:"extra_data"`
 	}{
-		Prompt:   nodes,
+		Prompt:   prompt,
 		ClientID: c.ID,
 		ExtraData: &extraData{
 			ExtraPngInfo: []byte(extraDataString),
 		},
 	}
-	return c.queuePrompt(temp)
+	return c.queuePrompt(context.Background(), temp)
 }
 
-func (c *Client) queuePrompt(temp interface{}) (*QueuePromptResp, error) {
-	resp, err := c.postJSONUsesRouter(PromptRouter, temp, nil)
+// PromptInterceptor inspects or rewrites a workflow before it is queued, returning an error aborts the submission
+type PromptInterceptor func(workflow map[string]interface{}) (map[string]interface{}, error)
+
+// QueuePrompt queues a prompt and starts execution by workflow which type is map[string]interface{}
+// The workflow passes through the prompt interceptor before it is sent, so do the ones of
+// QueuePromptByString and QueuePromptByNodes
+func (c *Client) QueuePrompt(ctx context.Context, workflow map[string]interface{}) (*QueuePromptResp, error) {
+	return c.QueuePromptWithExtra(ctx, workflow, nil)
+}
+
+// QueuePromptWithExtra queues a prompt like QueuePrompt with extra_data in the body
+// extra_data carries e.g. extra_pnginfo which is embedded into saved PNGs, or auth_token_comfy_org
+func (c *Client) QueuePromptWithExtra(ctx context.Context, workflow map[string]interface{}, extraData map[string]interface{}) (*QueuePromptResp, error) {
+	return c.queuePromptRequest(ctx, &promptRequest{
+		Prompt:    workflow,
+		ExtraData: extraData,
+	})
+}
+
+// QueuePromptFront queues a prompt like QueuePrompt at the front of the queue, ahead of the pending prompts
+// It suits interactive jobs which share a server with batch jobs
+func (c *Client) QueuePromptFront(ctx context.Context, workflow map[string]interface{}) (*QueuePromptResp, error) {
+	return c.queuePromptRequest(ctx, &promptRequest{
+		Prompt: workflow,
+		Front:  true,
+	})
+}
+
+// queuePromptRequest queues the request, with a span of WithTracer and the nodes told to WithProgressTracker
+func (c *Client) queuePromptRequest(ctx context.Context, req *promptRequest) (*QueuePromptResp, error) {
+	var span Span
+	if c.spans != nil {
+		ctx, span = c.spans.start(ctx)
+	}
+	resp, err := c.submitPromptRequest(ctx, req)
+	if err != nil {
+		if span != nil {
+			span.SetStatus(err)
+			span.End()
+		}
+		return nil, err
+	}
+	if resp.PromptID == "" {
+		// the server rejected the workflow, the response only carries the node errors
+		if span != nil {
+			span.SetStatus(fmt.Errorf("prompt is not queued, node errors: %v", resp.NodeErrors))
+			span.End()
+		}
+		return resp, nil
+	}
+	if span != nil {
+		c.spans.register(resp.PromptID, span)
+	}
+	if c.progressTracker != nil {
+		c.progressTracker.Expect(resp.PromptID, req.Prompt)
+	}
+	return resp, nil
+}
+
+// submitPromptRequest fills the client id, applies the prompt interceptor and queues the request
+func (c *Client) submitPromptRequest(ctx context.Context, req *promptRequest) (*QueuePromptResp, error) {
+	if len(req.Prompt) == 0 {
+		return nil, errors.New("workflow is empty")
+	}
+
+	clientID, err := c.waitForSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("c.waitForSession: error: %w", err)
+	}
+	req.ClientID = clientID
+	req.ExtraData = withPromptMetadata(ctx, req.ExtraData)
+	if c.clientLabel != "" {
+		req.ExtraData = withExtra(req.ExtraData, clientLabelExtraKey, c.clientLabel)
+	}
+
+	if c.promptInterceptor != nil {
+		if req.Prompt, err = c.promptInterceptor(req.Prompt); err != nil {
+			return nil, fmt.Errorf("promptInterceptor: error: %w", err)
+		}
+	}
+	return c.queuePrompt(ctx, req)
+}
+
+// interceptPrompt passes a prompt of QueuePromptByString or QueuePromptByNodes through the prompt interceptor
+// Without an interceptor the prompt is returned as is
+func (c *Client) interceptPrompt(prompt interface{}) (interface{}, error) {
+	if c.promptInterceptor == nil {
+		return prompt, nil
+	}
+
+	b, err := json.Marshal(prompt)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: error: %w", err)
+	}
+	var workflow map[string]interface{}
+	if err := json.Unmarshal(b, &workflow); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: error: %w", err)
+	}
+	intercepted, err := c.promptInterceptor(workflow)
+	if err != nil {
+		return nil, fmt.Errorf("promptInterceptor: error: %w", err)
+	}
+	return intercepted, nil
+}
+
+// QueuePromptAs queues a prompt like QueuePrompt with the bearer token of the call instead of the client's
+func (c *Client) QueuePromptAs(ctx context.Context, token string, workflow map[string]interface{}) (*QueuePromptResp, error) {
+	return c.QueuePrompt(ContextWithBearerToken(ctx, token), workflow)
+}
+
+func (c *Client) queuePrompt(ctx context.Context, temp interface{}) (*QueuePromptResp, error) {
+	resp, err := c.postJSONUsesRouter(ctx, PromptRouter, temp, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.postJSONUsesRouter: error: %w", err)
 	}
@@ -220,13 +850,15 @@ func (c *Client) queuePrompt(temp interface{}) (*QueuePromptResp, error) {
 	if err := json.Unmarshal(body, &q); err != nil {
 		return nil, fmt.Errorf("json.Unmarshal: error: %w, resp.Body: %v", err, string(body))
 	}
-
+	if q.PromptID != "" {
+		c.rememberPrompt(q.PromptID)
+	}
 	return q, nil
 }
 
 // GetQueueRemaining returns queue remaining
 func (c *Client) GetQueueRemaining() (uint64, error) {
-	resp, err := c.getJsonUsesRouter(PromptRouter, nil, nil)
+	resp, err := c.getJsonUsesRouter(context.Background(), PromptRouter, nil, nil)
 	if err != nil {
 		return 0, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
@@ -244,7 +876,7 @@ func (c *Client) GetQueueRemaining() (uint64, error) {
 
 // GetEmbeddings returns embeddings
 func (c *Client) GetEmbeddings() ([]string, error) {
-	resp, err := c.getJsonUsesRouter(EmbeddingsRouter, nil, nil)
+	resp, err := c.getJsonUsesRouter(context.Background(), EmbeddingsRouter, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
@@ -262,7 +894,7 @@ func (c *Client) GetEmbeddings() ([]string, error) {
 
 // GetExtensions returns extensions for frontend
 func (c *Client) GetExtensions() ([]string, error) {
-	resp, err := c.getJsonUsesRouter(ExtensionsRouter, nil, nil)
+	resp, err := c.getJsonUsesRouter(context.Background(), ExtensionsRouter, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
@@ -280,16 +912,66 @@ func (c *Client) GetExtensions() ([]string, error) {
 
 // GetAllHistories returns all histories
 func (c *Client) GetAllHistories() ([]*PromptHistoryItem, error) {
-	resp, err := c.getJsonUsesRouter(HistoryRouter, nil, nil)
+	resp, err := c.getJsonUsesRouter(context.Background(), HistoryRouter, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
 	return getHistorySlices(resp)
 }
 
+// StreamHistory decodes the history entry by entry and calls fn with each of them
+// Unlike GetAllHistories it never holds the whole history in memory
+// It stops when fn returns an error, which is returned as is, or when ctx is done
+func (c *Client) StreamHistory(ctx context.Context, fn func(*PromptHistoryItem) error) error {
+	resp, err := c.getJsonUsesRouter(ctx, HistoryRouter, nil, nil)
+	if err != nil {
+		return fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stream history: unexpected status code: %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	if token, err := decoder.Token(); err != nil {
+		return fmt.Errorf("decoder.Token: error: %w", err)
+	} else if token != json.Delim('{') {
+		return fmt.Errorf("unexpected history token: %v", token)
+	}
+
+	for decoder.More() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("decoder.Token: error: %w", err)
+		}
+		promptID, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("unexpected history key: %v", token)
+		}
+
+		item := &PromptHistoryItem{PromptID: promptID}
+		if err := decoder.Decode(&item.PromptHistoryMember); err != nil {
+			return fmt.Errorf("decoder.Decode: prompt %s error: %w", promptID, err)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetHistoryByPromptID returns history info by promptID
 func (c *Client) GetHistoryByPromptID(promptID string) (*PromptHistoryItem, error) {
-	resp, err := c.getJson(string(HistoryRouter)+"/"+promptID, nil, nil)
+	return c.getHistoryByPromptID(context.Background(), promptID)
+}
+
+func (c *Client) getHistoryByPromptID(ctx context.Context, promptID string) (*PromptHistoryItem, error) {
+	resp, err := c.getJson(ctx, string(HistoryRouter)+"/"+promptID, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
@@ -303,6 +985,23 @@ func (c *Client) GetHistoryByPromptID(promptID string) (*PromptHistoryItem, erro
 	return history[0], nil
 }
 
+// GetPromptWorkflow returns the workflow which was run for the prompt, recovered from its history
+func (c *Client) GetPromptWorkflow(ctx context.Context, promptID string) (map[string]interface{}, error) {
+	history, err := c.getHistoryByPromptID(ctx, promptID)
+	if err != nil {
+		return nil, fmt.Errorf("c.getHistoryByPromptID: error: %w", err)
+	}
+	if history == nil {
+		return nil, fmt.Errorf("prompt %s is not in history: %w", promptID, ErrPromptNotFound)
+	}
+
+	workflow := history.Workflow()
+	if workflow == nil {
+		return nil, fmt.Errorf("history of prompt %s has no workflow", promptID)
+	}
+	return workflow, nil
+}
+
 func getHistorySlices(resp *http.Response) ([]*PromptHistoryItem, error) {
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
@@ -326,7 +1025,7 @@ func getHistorySlices(resp *http.Response) ([]*PromptHistoryItem, error) {
 // DeleteAllHistories deletes all histories
 func (c *Client) DeleteAllHistories() error {
 	data := map[string]string{"clear": "clear"}
-	_, err := c.postJSONUsesRouter(HistoryRouter, data, nil)
+	_, err := c.postJSONUsesRouter(context.Background(), HistoryRouter, data, nil)
 	if err != nil {
 		return fmt.Errorf("http.Post: error: %w", err)
 	}
@@ -335,12 +1034,16 @@ func (c *Client) DeleteAllHistories() error {
 
 // DeleteHistoryByPromptID deletes history by promptID
 func (c *Client) DeleteHistoryByPromptID(promptID string) error {
-	data := map[string][]string{"delete": {promptID}}
-	_, err := c.postJSONUsesRouter(HistoryRouter, data, nil)
+	return c.deleteHistory(context.Background(), []string{promptID})
+}
+
+func (c *Client) deleteHistory(ctx context.Context, promptIDs []string) error {
+	data := map[string][]string{"delete": promptIDs}
+	resp, err := c.postJSONUsesRouter(ctx, HistoryRouter, data, nil)
 	if err != nil {
 		return fmt.Errorf("http.Post: error: %w", err)
 	}
-
+	resp.Body.Close()
 	return nil
 }
 
@@ -350,7 +1053,7 @@ func (c *Client) GetFile(image *DataOutputFile) (*[]byte, error) {
 	params.Add("filename", image.Filename)
 	params.Add("subfolder", image.SubFolder)
 	params.Add("type", image.Type)
-	resp, err := c.getJsonUsesRouter(ViewRouter, params, nil)
+	resp, err := c.getJsonUsesRouter(context.Background(), ViewRouter, params, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -362,6 +1065,170 @@ func (c *Client) GetFile(image *DataOutputFile) (*[]byte, error) {
 	return &body, nil
 }
 
+// DownloadOutput streams the output file to w
+// The returned DownloadedFile carries the file name and the content type inferred from its extension,
+// so callers serving the file over HTTP can set Content-Type
+// A file the server sent inline is written without a /view request
+// With WithDownloadRetries a download which breaks off is resumed with a Range request when the server accepts
+// ranges, otherwise the file is downloaded again and the part already written is skipped
+func (c *Client) DownloadOutput(ctx context.Context, file *DataOutputFile, w io.Writer) (*DownloadedFile, error) {
+	if data, ok := file.InlineData(); ok {
+		size, err := w.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("w.Write: error: %w", err)
+		}
+		return &DownloadedFile{
+			Filename:    path.Base(file.Filename),
+			ContentType: file.ContentType(),
+			Size:        int64(size),
+		}, nil
+	}
+
+	params := url.Values{}
+	params.Add("filename", file.Filename)
+	params.Add("subfolder", file.SubFolder)
+	params.Add("type", file.Type)
+	cw := &countingWriter{w: w}
+	acceptRanges := false
+	for attempt := 0; ; attempt++ {
+		retry, err := c.downloadView(ctx, file, params, cw, &acceptRanges)
+		if err == nil {
+			break
+		}
+		if !retry || attempt >= c.downloadRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		fmt.Printf("[%s] download %s broke off after %d bytes, retry %d: %v\n", c.baseURL, file.Filename, cw.n, attempt+1, err)
+	}
+	return &DownloadedFile{
+		Filename:    path.Base(file.Filename),
+		ContentType: file.ContentType(),
+		Size:        cw.n,
+	}, nil
+}
+
+// downloadView writes the /view response to w from the bytes w has written on
+// The rest is requested with a Range header when acceptRanges is set, a server which sends the whole file
+// instead has the written part skipped
+// retry reports whether the error is one of the connection, which a new request may not hit
+func (c *Client) downloadView(ctx context.Context, file *DataOutputFile, params url.Values, w *countingWriter, acceptRanges *bool) (retry bool, err error) {
+	var headers map[string]string
+	if w.n > 0 && *acceptRanges {
+		headers = map[string]string{"Range": fmt.Sprintf("bytes=%d-", w.n)}
+	}
+	resp, err := c.getJsonUsesRouter(ctx, ViewRouter, params, headers)
+	if err != nil {
+		return true, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	skip := w.n
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != w.n {
+			return false, fmt.Errorf("download %s: unexpected content range %q from %d", file.Filename, resp.Header.Get("Content-Range"), w.n)
+		}
+		skip = 0
+	default:
+		return false, fmt.Errorf("download %s: unexpected status code: %d", file.Filename, resp.StatusCode)
+	}
+	*acceptRanges = resp.Header.Get("Accept-Ranges") == "bytes"
+
+	if skip > 0 {
+		if _, err := io.CopyN(io.Discard, resp.Body, skip); err != nil {
+			return true, fmt.Errorf("io.CopyN: error: %w", err)
+		}
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		// a failing writer fails again
+		return w.err == nil, fmt.Errorf("io.Copy: error: %w", err)
+	}
+	return false, nil
+}
+
+// countingWriter counts the bytes written to w and keeps its error
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// GetUserData returns the content of the user data file
+// It returns ErrUserDataNotFound if the file does not exist
+func (c *Client) GetUserData(ctx context.Context, file string) ([]byte, error) {
+	resp, err := c.getJson(ctx, string(UserDataRouter)+"/"+url.PathEscape(file), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("c.getJson: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", file, ErrUserDataNotFound)
+	default:
+		return nil, fmt.Errorf("get user data %s: unexpected status code: %d", file, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll: error: %w", err)
+	}
+	return body, nil
+}
+
+// SetUserData writes the user data file, an existing file is overwritten
+func (c *Client) SetUserData(ctx context.Context, file string, data []byte) error {
+	resp, err := c.makeRequest(ctx, http.MethodPost, string(UserDataRouter)+"/"+url.PathEscape(file), nil, data, nil, "application/octet-stream")
+	if err != nil {
+		return fmt.Errorf("c.makeRequest: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("set user data %s: unexpected status code: %d", file, resp.StatusCode)
+	}
+	return nil
+}
+
+// ListUserData returns the files under the user data directory, paths are relative to dir
+// It returns ErrUserDataNotFound if the directory does not exist
+func (c *Client) ListUserData(ctx context.Context, dir string) ([]string, error) {
+	params := url.Values{}
+	params.Add("dir", dir)
+	params.Add("recurse", "true")
+	resp, err := c.getJsonUsesRouter(ctx, UserDataRouter, params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", dir, ErrUserDataNotFound)
+	default:
+		return nil, fmt.Errorf("list user data %s: unexpected status code: %d", dir, resp.StatusCode)
+	}
+
+	var files []string
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("json.Decode: error: %w", err)
+	}
+	return files, nil
+}
+
 // GetViewMetadata returns view metadata
 func (c *Client) GetViewMetadata(folderName string, fileName string) ([]byte, error) {
 	if folderName == "" {
@@ -372,7 +1239,7 @@ func (c *Client) GetViewMetadata(folderName string, fileName string) ([]byte, er
 		folderName = "/" + folderName
 	}
 
-	resp, err := c.getJson(string(ViewMetadataRouter)+folderName, url.Values{"filename": {fileName}}, nil)
+	resp, err := c.getJson(context.Background(), string(ViewMetadataRouter)+folderName, url.Values{"filename": {fileName}}, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
@@ -386,7 +1253,7 @@ func (c *Client) GetViewMetadata(folderName string, fileName string) ([]byte, er
 
 // GetSystemStats returns system stats
 func (c *Client) GetSystemStats() (*SystemStats, error) {
-	resp, err := c.getJsonUsesRouter(SystemStatsRouter, nil, nil)
+	resp, err := c.getJsonUsesRouter(context.Background(), SystemStatsRouter, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
@@ -402,12 +1269,69 @@ func (c *Client) GetSystemStats() (*SystemStats, error) {
 	return &stats, nil
 }
 
+// WaitForReady polls system stats every interval until the server answers with 200 or ctx is done
+// Refused connections and error responses are retried, the server may listen before its models are loaded
+// ErrUnauthorized and ErrCircuitOpen are returned right away, an interval <= 0 polls every second
+func (c *Client) WaitForReady(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := c.checkReady(ctx)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrCircuitOpen) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("server is not ready: %w, last error: %v", ctx.Err(), err)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) checkReady(ctx context.Context) error {
+	resp, err := c.getJsonUsesRouter(ctx, SystemStatsRouter, nil, nil)
+	if err != nil {
+		return fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
 // InterruptExecution interrupts execution
 func (c *Client) InterruptExecution() error {
-	_, err := c.postJSONUsesRouter(InterruptRouter, nil, nil)
+	return c.interruptExecution(context.Background())
+}
+
+func (c *Client) interruptExecution(ctx context.Context) error {
+	resp, err := c.postJSONUsesRouter(ctx, InterruptRouter, nil, nil)
 	if err != nil {
 		return fmt.Errorf("c.postJSONUsesRouter: error: %w", err)
 	}
+	resp.Body.Close()
+	return nil
+}
+
+// FreeMemory asks the server to free cached memory, unloadModels also unloads the loaded models
+func (c *Client) FreeMemory(ctx context.Context, unloadModels bool) error {
+	data := map[string]bool{"unload_models": unloadModels, "free_memory": true}
+	resp, err := c.postJSONUsesRouter(ctx, FreeRouter, data, nil)
+	if err != nil {
+		return fmt.Errorf("c.postJSONUsesRouter: error: %w", err)
+	}
+	resp.Body.Close()
 	return nil
 }
 
@@ -415,7 +1339,7 @@ func (c *Client) InterruptExecution() error {
 // Delete all prompts in queue with this client sent, or it will not work
 func (c *Client) DeleteAllQueues() error {
 	data := map[string]string{"clear": "clear"}
-	_, err := c.postJSONUsesRouter(QueueRouter, data, nil)
+	_, err := c.postJSONUsesRouter(context.Background(), QueueRouter, data, nil)
 	if err != nil {
 		return fmt.Errorf("c.postJSONUsesRouter: error: %w", err)
 	}
@@ -425,17 +1349,96 @@ func (c *Client) DeleteAllQueues() error {
 // DeleteQueueByPromptID deletes prompt in queue by promptID
 // You must input promptID with this client sent, or it will not work
 func (c *Client) DeleteQueueByPromptID(promptID string) error {
-	data := map[string]string{"delete": promptID}
-	_, err := c.postJSONUsesRouter(QueueRouter, data, nil)
+	return c.deleteQueues(context.Background(), []string{promptID})
+}
+
+func (c *Client) deleteQueues(ctx context.Context, promptIDs []string) error {
+	data := map[string][]string{"delete": promptIDs}
+	resp, err := c.postJSONUsesRouter(ctx, QueueRouter, data, nil)
 	if err != nil {
 		return fmt.Errorf("c.postJSONUsesRouter: error: %w", err)
 	}
+	resp.Body.Close()
+	return nil
+}
+
+// CancelMyQueue deletes the pending prompts queued with the client id of this client
+// The prompts of other clients on a shared server are kept, unlike ClearQueue, and the running prompt is not interrupted
+func (c *Client) CancelMyQueue(ctx context.Context) error {
+	queueInfo, err := c.getQueueInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("c.getQueueInfo: error: %w", err)
+	}
+
+	var promptIDs []string
+	for _, item := range queueInfo.QueuePending {
+		if item.ClientID() == c.ID {
+			promptIDs = append(promptIDs, item.PromptID)
+		}
+	}
+	if len(promptIDs) == 0 {
+		return nil
+	}
+	return c.deleteQueues(ctx, promptIDs)
+}
+
+// CancelPrompt cancels the prompt whatever its queue state is
+// A running prompt is interrupted like InterruptIfRunning does and a pending prompt is deleted from the queue
+func (c *Client) CancelPrompt(ctx context.Context, promptID string) error {
+	queueInfo, err := c.getQueueInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("c.getQueueInfo: error: %w", err)
+	}
+
+	for _, item := range queueInfo.QueueRunning {
+		if item.PromptID == promptID {
+			return c.interruptPrompt(ctx, promptID)
+		}
+	}
+	for _, item := range queueInfo.QueuePending {
+		if item.PromptID == promptID {
+			return c.deleteQueues(ctx, []string{promptID})
+		}
+	}
+	return fmt.Errorf("prompt %s is not in queue: %w", promptID, ErrPromptNotFound)
+}
+
+// InterruptIfRunning interrupts the execution only when the running prompt is promptID
+// It reports whether the prompt was running, so a job of another user on a shared server is never interrupted
+// The prompt id is sent with the interrupt as well, servers which support it refuse to interrupt another prompt
+// when the running one changes between the check and the interrupt
+func (c *Client) InterruptIfRunning(ctx context.Context, promptID string) (bool, error) {
+	queueInfo, err := c.getQueueInfo(ctx)
+	if err != nil {
+		return false, fmt.Errorf("c.getQueueInfo: error: %w", err)
+	}
+
+	for _, item := range queueInfo.QueueRunning {
+		if item.PromptID == promptID {
+			return true, c.interruptPrompt(ctx, promptID)
+		}
+	}
+	return false, nil
+}
+
+// interruptPrompt interrupts the execution with the prompt id in the body
+// Servers which support it refuse to interrupt another prompt, older ones ignore the body
+func (c *Client) interruptPrompt(ctx context.Context, promptID string) error {
+	resp, err := c.postJSONUsesRouter(ctx, InterruptRouter, map[string]string{"prompt_id": promptID}, nil)
+	if err != nil {
+		return fmt.Errorf("c.postJSONUsesRouter: error: %w", err)
+	}
+	resp.Body.Close()
 	return nil
 }
 
 // GetObjectInfos returns node infos in workflow
 func (c *Client) GetObjectInfos() (map[string]*NodeObject, error) {
-	resp, err := c.getJsonUsesRouter(ObjectInfoRouter, nil, nil)
+	return c.getObjectInfos(context.Background())
+}
+
+func (c *Client) getObjectInfos(ctx context.Context) (map[string]*NodeObject, error) {
+	resp, err := c.getJsonUsesRouter(ctx, ObjectInfoRouter, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
@@ -451,9 +1454,59 @@ func (c *Client) GetObjectInfos() (map[string]*NodeObject, error) {
 	return objectInfos, nil
 }
 
+// StreamObjectInfo decodes object_info node class by node class and calls fn with each of them
+// Unlike GetObjectInfos it never holds all node classes in memory, which suits callers who only need a few
+// It stops when fn returns an error, which is returned as is, or when ctx is done
+func (c *Client) StreamObjectInfo(ctx context.Context, fn func(nodeClass string, info *NodeObject) error) error {
+	resp, err := c.getJsonUsesRouter(ctx, ObjectInfoRouter, nil, nil)
+	if err != nil {
+		return fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stream object info: unexpected status code: %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	if token, err := decoder.Token(); err != nil {
+		return fmt.Errorf("decoder.Token: error: %w", err)
+	} else if token != json.Delim('{') {
+		return fmt.Errorf("unexpected object info token: %v", token)
+	}
+
+	for decoder.More() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("decoder.Token: error: %w", err)
+		}
+		nodeClass, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("unexpected object info key: %v", token)
+		}
+
+		var info *NodeObject
+		if err := decoder.Decode(&info); err != nil {
+			return fmt.Errorf("decoder.Decode: node class %s error: %w", nodeClass, err)
+		}
+		if err := fn(nodeClass, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetObjectInfoByNodeName returns node info by nodeName
 func (c *Client) GetObjectInfoByNodeName(name string) (*NodeObject, error) {
-	resp, err := c.getJson(string(ObjectInfoRouter)+"/"+name, nil, nil)
+	return c.getObjectInfoByNodeName(context.Background(), name)
+}
+
+func (c *Client) getObjectInfoByNodeName(ctx context.Context, name string) (*NodeObject, error) {
+	resp, err := c.getJson(ctx, string(ObjectInfoRouter)+"/"+name, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJson: error: %w", err)
 	}
@@ -471,7 +1524,11 @@ func (c *Client) GetObjectInfoByNodeName(name string) (*NodeObject, error) {
 
 // GetQueueInfo returns queue info
 func (c *Client) GetQueueInfo() (*QueueInfo, error) {
-	resp, err := c.getJsonUsesRouter(QueueRouter, nil, nil)
+	return c.getQueueInfo(context.Background())
+}
+
+func (c *Client) getQueueInfo(ctx context.Context) (*QueueInfo, error) {
+	resp, err := c.getJsonUsesRouter(ctx, QueueRouter, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
 	}
@@ -493,7 +1550,7 @@ func (c *Client) uploadFile(router Router, reader io.Reader, fileName string, ov
 		return nil, fmt.Errorf("createUploadRequest: error: %w", err)
 	}
 
-	resp, err := c.postMultiPartUsesRouter(router, requestBody, headers)
+	resp, err := c.postMultiPartUsesRouter(context.Background(), router, requestBody, headers)
 	if err != nil {
 		return nil, fmt.Errorf("c.postJSONUsesRouter: error: %w", err)
 	}
@@ -555,11 +1612,24 @@ func createUploadRequest(reader io.Reader, fileName string, overwrite bool, file
 	return &requestBody, headers, nil
 }
 
-func (c *Client) makeRequest(method, router string, values url.Values, data interface{}, headers map[string]string, contentType string) (*http.Response, error) {
+type bearerTokenKey struct{}
+
+// ContextWithBearerToken returns a context whose bearer token overrides the client's on HTTP requests made with it
+// It lets a multi-tenant service share one client between users
+func ContextWithBearerToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, bearerTokenKey{}, token)
+}
+
+func bearerTokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(bearerTokenKey{}).(string)
+	return token, ok && token != ""
+}
+
+func (c *Client) makeRequest(ctx context.Context, method, router string, values url.Values, data interface{}, headers map[string]string, contentType string) (*http.Response, error) {
 	var req *http.Request
 	var err error
 
-	rawURL := c.baseURL + router
+	rawURL := c.baseURL + c.routerPath(router)
 	if len(values) != 0 {
 		rawURL += "?" + values.Encode()
 	}
@@ -571,13 +1641,22 @@ func (c *Client) makeRequest(method, router string, values url.Values, data inte
 			if err != nil {
 				return nil, fmt.Errorf("json.Marshal: %w", err)
 			}
-			req, err = http.NewRequest(method, rawURL, io.NopCloser(bytes.NewReader(jsonData)))
+			req, err = http.NewRequestWithContext(ctx, method, rawURL, io.NopCloser(bytes.NewReader(jsonData)))
+			if err != nil {
+				return nil, fmt.Errorf("http.NewRequest: %w", err)
+			}
+		case "application/octet-stream":
+			req, err = http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(data.([]byte)))
 			if err != nil {
 				return nil, fmt.Errorf("http.NewRequest: %w", err)
 			}
 		case "multipart/form-data":
-			buf := data.(*bytes.Buffer)
-			req, err = http.NewRequest(method, rawURL, io.NopCloser(buf))
+			// a reader other than a buffer is streamed, see UploadImageFile
+			body := data.(io.Reader)
+			if buf, ok := data.(*bytes.Buffer); ok {
+				body = io.NopCloser(buf)
+			}
+			req, err = http.NewRequestWithContext(ctx, method, rawURL, body)
 			if err != nil {
 				return nil, fmt.Errorf("http.NewRequest: %w", err)
 			}
@@ -585,7 +1664,7 @@ func (c *Client) makeRequest(method, router string, values url.Values, data inte
 			return nil, fmt.Errorf("unsupported content type: %s", contentType)
 		}
 	} else {
-		req, err = http.NewRequest(method, rawURL, nil)
+		req, err = http.NewRequestWithContext(ctx, method, rawURL, nil)
 		if err != nil {
 			return nil, fmt.Errorf("http.NewRequest: %w", err)
 		}
@@ -593,46 +1672,117 @@ func (c *Client) makeRequest(method, router string, values url.Values, data inte
 
 	// Don't change the order
 	req.Header.Set("Content-Type", contentType)
-	if c.BearerToken != "" {
-		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	if token, ok := bearerTokenFromContext(ctx); ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if token := c.bearerToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
 	} else if c.Token != "" {
 		req.Header.Set("Authorization", c.Token)
 	}
+	if c.userID != "" {
+		req.Header.Set(UserHeader, c.userID)
+	}
+	if c.clientLabel != "" {
+		req.Header.Set(ClientLabelHeader, c.clientLabel)
+	}
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
 
+	// ask the breaker last, so an early return can not leave its trial request open
+	if c.breaker != nil {
+		if err := c.breaker.allow(); err != nil {
+			return nil, err
+		}
+	}
 	resp, err := c.httpClient.Do(req)
+	c.recordBreaker(ctx, resp, err)
 	if err != nil {
 		return nil, fmt.Errorf("c.httpClient.Do: %w", err)
 	}
+	if isUnauthorized(resp.StatusCode) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: status code %d: %w", method, router, resp.StatusCode, ErrUnauthorized)
+	}
+
+	if err := decompressBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("decompressBody: %w", err)
+	}
 	return resp, nil
 }
 
-func (c *Client) requestJson(method, router string, values url.Values, data interface{}, headers map[string]string) (*http.Response, error) {
-	return c.makeRequest(method, router, values, data, headers, "application/json")
+// decompressBody decompresses a gzip encoded body the transport left compressed
+// http.Transport requests and decompresses gzip transparently, unless the request sets Accept-Encoding itself
+// or the transport disables compression
+func decompressBody(resp *http.Response) error {
+	if resp.Uncompressed || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("gzip.NewReader: %w", err)
+	}
+	resp.Body = &gzipReadCloser{Reader: reader, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// recordBreaker reports the result of a request to the circuit breaker
+// Transport errors and 5xx responses are failures
+func (c *Client) recordBreaker(ctx context.Context, resp *http.Response, err error) {
+	if c.breaker == nil {
+		return
+	}
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		c.breaker.release()
+	case err != nil || resp.StatusCode >= http.StatusInternalServerError:
+		c.breaker.failure()
+	default:
+		c.breaker.success()
+	}
+}
+
+func (c *Client) requestJson(ctx context.Context, method, router string, values url.Values, data interface{}, headers map[string]string) (*http.Response, error) {
+	return c.makeRequest(ctx, method, router, values, data, headers, "application/json")
 }
 
-func (c *Client) requestMultiPart(method, router string, values url.Values, data *bytes.Buffer, headers map[string]string) (*http.Response, error) {
-	return c.makeRequest(method, router, values, data, headers, "multipart/form-data")
+func (c *Client) requestMultiPart(ctx context.Context, method, router string, values url.Values, data *bytes.Buffer, headers map[string]string) (*http.Response, error) {
+	return c.makeRequest(ctx, method, router, values, data, headers, "multipart/form-data")
 }
 
-func (c *Client) postMultiPartUsesRouter(router Router, data *bytes.Buffer, headers map[string]string) (*http.Response, error) {
-	return c.requestMultiPart(http.MethodPost, string(router), nil, data, headers)
+func (c *Client) postMultiPartUsesRouter(ctx context.Context, router Router, data *bytes.Buffer, headers map[string]string) (*http.Response, error) {
+	return c.requestMultiPart(ctx, http.MethodPost, string(router), nil, data, headers)
 }
 
-func (c *Client) postJSONUsesRouter(router Router, data interface{}, headers map[string]string) (*http.Response, error) {
-	return c.postJson(string(router), data, headers)
+func (c *Client) postJSONUsesRouter(ctx context.Context, router Router, data interface{}, headers map[string]string) (*http.Response, error) {
+	return c.postJson(ctx, string(router), data, headers)
 }
 
-func (c *Client) postJson(router string, data interface{}, headers map[string]string) (*http.Response, error) {
-	return c.requestJson(http.MethodPost, router, nil, data, headers)
+func (c *Client) postJson(ctx context.Context, router string, data interface{}, headers map[string]string) (*http.Response, error) {
+	return c.requestJson(ctx, http.MethodPost, router, nil, data, headers)
 }
 
-func (c *Client) getJsonUsesRouter(router Router, values url.Values, headers map[string]string) (*http.Response, error) {
-	return c.getJson(string(router), values, headers)
+func (c *Client) getJsonUsesRouter(ctx context.Context, router Router, values url.Values, headers map[string]string) (*http.Response, error) {
+	return c.getJson(ctx, string(router), values, headers)
 }
 
-func (c *Client) getJson(router string, values url.Values, headers map[string]string) (*http.Response, error) {
-	return c.requestJson(http.MethodGet, router, values, nil, headers)
+func (c *Client) getJson(ctx context.Context, router string, values url.Values, headers map[string]string) (*http.Response, error) {
+	return c.requestJson(ctx, http.MethodGet, router, values, nil, headers)
 }
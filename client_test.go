@@ -0,0 +1,1065 @@
+package comfyUIclient
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAPIPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		wantPrefix string
+	}{
+		{name: "unprefixed", enabled: false, wantPrefix: ""},
+		{name: "prefixed", enabled: true, wantPrefix: "/api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			m.mux.HandleFunc("/api/ws", m.serveWS)
+			var paths []string
+			m.mux.HandleFunc("/api/prompt", func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				m.servePrompt(w, r)
+			})
+
+			c := newConnectedClient(t, m, WithAPIPrefix(tt.enabled))
+
+			wantWS := tt.wantPrefix + "/ws?clientId=" + c.ClientID()
+			if !strings.HasSuffix(c.webSocket.URL, wantWS) {
+				t.Errorf("websocket url = %s, want suffix %s", c.webSocket.URL, wantWS)
+			}
+			if got := m.wsRequestURL(0); got != wantWS {
+				t.Errorf("websocket request = %s, want %s", got, wantWS)
+			}
+
+			if got, want := c.routerPath(string(PromptRouter)), tt.wantPrefix+"/prompt"; got != want {
+				t.Errorf("routerPath = %s, want %s", got, want)
+			}
+			if _, err := c.GetQueueRemaining(); err != nil {
+				t.Fatalf("GetQueueRemaining: %v", err)
+			}
+			if tt.enabled && len(paths) != 1 {
+				t.Errorf("prefixed requests = %v, want one request to /api/prompt", paths)
+			}
+			if !tt.enabled && len(paths) != 0 {
+				t.Errorf("prefixed requests = %v, want none", paths)
+			}
+		})
+	}
+}
+
+func TestStrictSessionFilter(t *testing.T) {
+	status := func(sid string, remaining int) string {
+		return fmt.Sprintf(`{"type":"status","data":{"status":{"exec_info":{"queue_remaining":%d}},"sid":%q}}`, remaining, sid)
+	}
+
+	tests := []struct {
+		name          string
+		opts          []ClientOption
+		wantQueue     int
+		wantSessionID string
+	}{
+		{name: "strict", opts: []ClientOption{WithClientID("mine"), WithStrictSessionFilter()}, wantQueue: 3, wantSessionID: "mine"},
+		{name: "not strict", opts: []ClientOption{WithClientID("mine")}, wantQueue: 5, wantSessionID: "mine"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewDefaultClientStr("http://127.0.0.1:8188", tt.opts...)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+
+			for _, msg := range []string{status("mine", 3), status("other", 5)} {
+				if err := c.Handle(msg); err != nil {
+					t.Fatalf("Handle: %v", err)
+				}
+			}
+			if got := c.GetQueueCount(); got != tt.wantQueue {
+				t.Errorf("queue count = %d, want %d", got, tt.wantQueue)
+			}
+			if got := c.SessionID(); got != tt.wantSessionID {
+				t.Errorf("session id = %s, want %s", got, tt.wantSessionID)
+			}
+		})
+	}
+}
+
+func TestChannelOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    OverflowPolicy
+		wantValue int
+	}{
+		{name: "drop newest", policy: OverflowDropNewest, wantValue: 0},
+		{name: "drop oldest", policy: OverflowDropOldest, wantValue: 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			c := newConnectedClient(t, m, WithTaskStatusBufferSize(1), WithChannelOverflowPolicy(tt.policy))
+
+			for i := 0; i < 10; i++ {
+				m.send(t, fmt.Sprintf(`{"type":"progress","data":{"value":%d,"max":10}}`, i))
+			}
+			waitFor(t, "dropped messages", func() bool { return c.DroppedMessages() == 9 })
+
+			message := receive(t, c)
+			if got := message.Data.(*WSMessageDataProgress).Value; got != tt.wantValue {
+				t.Errorf("buffered progress value = %d, want %d", got, tt.wantValue)
+			}
+
+			// the listen loop is still alive
+			m.send(t, `{"type":"progress","data":{"value":10,"max":10}}`)
+			if got := receive(t, c).Data.(*WSMessageDataProgress).Value; got != 10 {
+				t.Errorf("progress value after drops = %d, want 10", got)
+			}
+			if !c.IsInitialized() {
+				t.Error("websocket is disconnected")
+			}
+		})
+	}
+}
+
+func TestPromptInterceptor(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithPromptInterceptor(func(workflow map[string]interface{}) (map[string]interface{}, error) {
+		workflow["99"] = map[string]interface{}{"class_type": "Audit", "inputs": map[string]interface{}{}}
+		return workflow, nil
+	}))
+
+	workflow := map[string]interface{}{"1": map[string]interface{}{"class_type": "SaveImage"}}
+	if _, err := c.QueuePrompt(context.Background(), workflow); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	if _, err := c.QueuePromptByString(`{"1":{"class_type":"SaveImage"}}`, ""); err != nil {
+		t.Fatalf("QueuePromptByString: %v", err)
+	}
+	if _, err := c.QueuePromptByNodes(map[string]PromptNode{"1": {ClassType: "SaveImage"}}, ""); err != nil {
+		t.Fatalf("QueuePromptByNodes: %v", err)
+	}
+
+	bodies := m.promptBodies()
+	if len(bodies) != 3 {
+		t.Fatalf("got %d prompts, want 3", len(bodies))
+	}
+	for i, body := range bodies {
+		prompt := body["prompt"].(map[string]interface{})
+		node, ok := prompt["99"].(map[string]interface{})
+		if !ok || node["class_type"] != "Audit" {
+			t.Errorf("prompt %d = %v, want the injected node 99", i, prompt)
+		}
+		if _, ok := prompt["1"]; !ok {
+			t.Errorf("prompt %d lost node 1", i)
+		}
+	}
+}
+
+func TestPromptInterceptorAborts(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithPromptInterceptor(func(workflow map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("denied")
+	}))
+
+	if _, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err == nil {
+		t.Fatal("QueuePrompt succeeded, want the interceptor error")
+	}
+	if got := len(m.promptBodies()); got != 0 {
+		t.Errorf("got %d prompts, want none", got)
+	}
+}
+
+func TestGeneratedClientIDIsConsistent(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+	if c.ClientID() == "" {
+		t.Fatal("no client id is generated")
+	}
+
+	if got, want := m.wsRequestURL(0), "/ws?clientId="+c.ClientID(); got != want {
+		t.Errorf("websocket request = %s, want %s", got, want)
+	}
+	if _, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	if got := m.promptBodies()[0]["client_id"]; got != c.ClientID() {
+		t.Errorf("client_id = %v, want %s", got, c.ClientID())
+	}
+}
+
+func TestWithPersistentClientID(t *testing.T) {
+	m := newMockServer(t)
+
+	// the first start has nothing saved, the generated id is saved
+	var saved []string
+	store := ""
+	loader := func() string { return store }
+	saver := func(id string) {
+		saved = append(saved, id)
+		store = id
+	}
+	first, err := NewDefaultClientStr(m.URL, WithPersistentClientID(loader, saver))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	if first.ClientID() == "" || len(saved) != 1 || saved[0] != first.ClientID() {
+		t.Fatalf("saved ids = %v, want the generated %q", saved, first.ClientID())
+	}
+
+	// a restart reattaches with the loaded id and saves nothing
+	c := newConnectedClient(t, m, WithPersistentClientID(loader, saver))
+	if c.ClientID() != first.ClientID() {
+		t.Errorf("ClientID after restart = %q, want %q", c.ClientID(), first.ClientID())
+	}
+	if len(saved) != 1 {
+		t.Errorf("saved ids = %v, the loaded id is saved again", saved)
+	}
+	if got, want := m.wsRequestURL(0), "/ws?clientId="+first.ClientID(); got != want {
+		t.Errorf("websocket request = %s, want %s", got, want)
+	}
+
+	// an explicit client id wins over the loaded one
+	explicit, err := NewDefaultClientStr(m.URL, WithPersistentClientID(loader, saver), WithClientID("fixed"))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	if explicit.ClientID() != "fixed" {
+		t.Errorf("ClientID = %q, want fixed", explicit.ClientID())
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	m := newMockServer(t)
+	var calls atomic.Int32
+	m.mux.HandleFunc("/system_stats", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"system":{},"devices":[]}`)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx, 10*time.Millisecond); err != nil {
+		t.Fatalf("WaitForReady: %v", err)
+	}
+	if got := calls.Load(); got != 4 {
+		t.Errorf("system_stats is called %d times, want 4", got)
+	}
+}
+
+func TestWaitForReadyStops(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/system_stats", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitForReady(ctx, 0); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("WaitForReady = %v, want ErrUnauthorized", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("WaitForReady kept retrying until the context expired")
+	}
+}
+
+func TestPerCallBearerToken(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+	c.SetBearerToken("default")
+
+	workflow := map[string]interface{}{"1": map[string]interface{}{}}
+	if _, err := c.QueuePrompt(context.Background(), workflow); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	if _, err := c.QueuePromptAs(context.Background(), "tenant", workflow); err != nil {
+		t.Fatalf("QueuePromptAs: %v", err)
+	}
+	if _, err := c.QueuePrompt(ContextWithBearerToken(context.Background(), "other"), workflow); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+
+	headers := m.promptHeaders()
+	for i, want := range []string{"Bearer default", "Bearer tenant", "Bearer other"} {
+		if got := headers[i].Get("Authorization"); got != want {
+			t.Errorf("request %d Authorization = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestSessionGateWaitsForSID(t *testing.T) {
+	m := newMockServer(t)
+	m.setSilentWS()
+	c := newConnectedClient(t, m, WithSessionGate(5*time.Second))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if got := len(m.promptBodies()); got != 0 {
+		t.Fatalf("prompt is submitted before the sid is known")
+	}
+
+	m.send(t, fmt.Sprintf(`{"type":"status","data":{"status":{"exec_info":{"queue_remaining":0}},"sid":%q}}`, c.ClientID()))
+	if err := <-done; err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	if got := m.promptBodies()[0]["client_id"]; got != c.ClientID() {
+		t.Errorf("client_id = %v, want %s", got, c.ClientID())
+	}
+}
+
+func TestConnectAndWaitReady(t *testing.T) {
+	m := newMockServer(t)
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	t.Cleanup(func() { c.webSocket.Shutdown() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.ConnectAndWaitReady(ctx); err != nil {
+		t.Fatalf("ConnectAndWaitReady: %v", err)
+	}
+	if c.SessionID() != c.ClientID() {
+		t.Errorf("SessionID = %q after ConnectAndWaitReady, want %q", c.SessionID(), c.ClientID())
+	}
+	if !c.IsInitialized() {
+		t.Error("websocket is not connected after ConnectAndWaitReady")
+	}
+}
+
+func TestConnectAndWaitReadyTimeout(t *testing.T) {
+	m := newMockServer(t)
+	m.setSilentWS()
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	t.Cleanup(func() { c.webSocket.Shutdown() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.ConnectAndWaitReady(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ConnectAndWaitReady without a sid = %v, want context.DeadlineExceeded", err)
+	}
+	// the upgraded connection alone does not make the session ready
+	waitFor(t, "websocket connection", c.IsInitialized)
+}
+
+func TestSessionGateTimeout(t *testing.T) {
+	m := newMockServer(t)
+	m.setSilentWS()
+	c := newConnectedClient(t, m, WithSessionGate(50*time.Millisecond))
+
+	_, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+	if !errors.Is(err, ErrSessionNotReady) {
+		t.Errorf("QueuePrompt = %v, want ErrSessionNotReady", err)
+	}
+}
+
+func TestUserIDIsSentOnView(t *testing.T) {
+	m := newMockServer(t)
+	users := make(chan string, 2)
+	m.mux.HandleFunc("/view", func(w http.ResponseWriter, r *http.Request) {
+		users <- r.Header.Get(UserHeader)
+		w.Write([]byte("png"))
+	})
+	c, err := NewDefaultClientStr(m.URL, WithUserID("alice"))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	file := &DataOutputFile{Filename: "a.png", Type: "output"}
+	if _, err := c.GetFile(file); err != nil {
+		t.Fatalf("GetFile: %v", err)
+	}
+	if _, err := c.DownloadOutput(context.Background(), file, io.Discard); err != nil {
+		t.Fatalf("DownloadOutput: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-users; got != "alice" {
+			t.Errorf("%s header = %q, want alice", UserHeader, got)
+		}
+	}
+}
+
+func TestCancelPrompt(t *testing.T) {
+	tests := []struct {
+		name      string
+		running   []string
+		pending   []string
+		wantCalls []string
+		wantErr   error
+	}{
+		{name: "running", running: []string{"p1"}, wantCalls: []string{`/interrupt {"prompt_id":"p1"}`}},
+		{name: "pending", running: []string{"p0"}, pending: []string{"p2", "p1"}, wantCalls: []string{`/queue {"delete":["p1"]}`}},
+		{name: "not in queue", running: []string{"p0"}, wantErr: ErrPromptNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			m.setQueue(tt.running, tt.pending)
+			c, err := NewDefaultClientStr(m.URL)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+
+			err = c.CancelPrompt(context.Background(), "p1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CancelPrompt = %v, want %v", err, tt.wantErr)
+			}
+			if got := m.recordedCalls(); strings.Join(got, "|") != strings.Join(tt.wantCalls, "|") {
+				t.Errorf("calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestQueuePromptWithExtra(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+
+	extraData := map[string]interface{}{
+		"extra_pnginfo":        map[string]interface{}{"workflow": map[string]interface{}{"version": 0.4}},
+		"auth_token_comfy_org": "token",
+	}
+	if _, err := c.QueuePromptWithExtra(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}, extraData); err != nil {
+		t.Fatalf("QueuePromptWithExtra: %v", err)
+	}
+	if _, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+
+	bodies := m.promptBodies()
+	got, ok := bodies[0]["extra_data"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("body = %v, want extra_data", bodies[0])
+	}
+	if got["auth_token_comfy_org"] != "token" || got["extra_pnginfo"] == nil {
+		t.Errorf("extra_data = %v, want %v", got, extraData)
+	}
+	if _, ok := bodies[1]["extra_data"]; ok {
+		t.Errorf("QueuePrompt body = %v, want no extra_data", bodies[1])
+	}
+}
+
+func TestGetPromptWorkflow(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/history/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/p1") {
+			fmt.Fprint(w, sampleHistory)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	workflow, err := c.GetPromptWorkflow(context.Background(), "p1")
+	if err != nil {
+		t.Fatalf("GetPromptWorkflow: %v", err)
+	}
+	if node, ok := workflow["12"].(map[string]interface{}); !ok || node["class_type"] != "SaveImage" {
+		t.Errorf("node 12 = %v, want the SaveImage node", workflow["12"])
+	}
+	if _, err := c.GetPromptWorkflow(context.Background(), "p2"); !errors.Is(err, ErrPromptNotFound) {
+		t.Errorf("GetPromptWorkflow of an unknown prompt = %v, want %v", err, ErrPromptNotFound)
+	}
+}
+
+func TestGzipObjectInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport *http.Transport
+	}{
+		{name: "transport decompresses", transport: &http.Transport{}},
+		{name: "compression disabled", transport: &http.Transport{DisableCompression: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			m.mux.HandleFunc("/object_info", func(w http.ResponseWriter, r *http.Request) {
+				// the response is compressed whether or not the request asked for it
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				fmt.Fprint(gz, `{"KSampler":{"input":{"required":{"seed":["INT",{"default":0}]}},"output":["LATENT"],"name":"KSampler"}}`)
+				gz.Close()
+			})
+			defer tt.transport.CloseIdleConnections()
+			c := NewClient(NewEndPoint("http", strings.TrimPrefix(m.URL, "http://"), ""), &http.Client{Transport: tt.transport})
+
+			infos, err := c.GetObjectInfos()
+			if err != nil {
+				t.Fatalf("GetObjectInfos: %v", err)
+			}
+			info, ok := infos["KSampler"]
+			if !ok || info.Input == nil || info.Input.Required["seed"] == nil {
+				t.Errorf("object infos = %v, want KSampler with a seed input", infos)
+			}
+		})
+	}
+}
+
+func TestDownloadOutput(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/view", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("subfolder") != "videos" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("mp4 data"))
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	var buf strings.Builder
+	file := &DataOutputFile{Filename: "clip_00001_.mp4", SubFolder: "videos", Type: "output"}
+	downloaded, err := c.DownloadOutput(context.Background(), file, &buf)
+	if err != nil {
+		t.Fatalf("DownloadOutput: %v", err)
+	}
+	want := &DownloadedFile{Filename: "clip_00001_.mp4", ContentType: "video/mp4", Size: int64(len("mp4 data"))}
+	if *downloaded != *want || buf.String() != "mp4 data" {
+		t.Errorf("DownloadOutput = %+v with %q, want %+v", downloaded, buf.String(), want)
+	}
+
+	if _, err := c.DownloadOutput(context.Background(), &DataOutputFile{Filename: "missing.png"}, io.Discard); err == nil {
+		t.Error("DownloadOutput of a missing file returns no error")
+	}
+}
+
+func TestDownloadOutputResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	tests := []struct {
+		name         string
+		acceptRanges bool
+		wantRanges   []string
+	}{
+		{name: "ranged resume", acceptRanges: true, wantRanges: []string{"", "bytes=4000-"}},
+		{name: "full download again", wantRanges: []string{"", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			var mu sync.Mutex
+			var ranges []string
+			m.mux.HandleFunc("/view", func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				first := len(ranges) == 1
+				mu.Unlock()
+				if tt.acceptRanges {
+					w.Header().Set("Accept-Ranges", "bytes")
+				}
+				if first {
+					// the connection drops after 4000 bytes
+					w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+					w.Write([]byte(content[:4000]))
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				if tt.acceptRanges {
+					http.ServeContent(w, r, "big.png", time.Time{}, strings.NewReader(content))
+					return
+				}
+				w.Write([]byte(content))
+			})
+			c, err := NewDefaultClientStr(m.URL, WithDownloadRetries(2))
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+
+			var buf strings.Builder
+			downloaded, err := c.DownloadOutput(context.Background(), &DataOutputFile{Filename: "big.png", Type: "output"}, &buf)
+			if err != nil {
+				t.Fatalf("DownloadOutput: %v", err)
+			}
+			if buf.String() != content || downloaded.Size != int64(len(content)) {
+				t.Errorf("DownloadOutput wrote %d bytes, size %d, want the %d bytes of the file", buf.Len(), downloaded.Size, len(content))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(ranges) != fmt.Sprint(tt.wantRanges) {
+				t.Errorf("Range headers = %q, want %q", ranges, tt.wantRanges)
+			}
+		})
+	}
+}
+
+func TestDownloadOutputWithoutRetries(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/view", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	if _, err := c.DownloadOutput(context.Background(), &DataOutputFile{Filename: "big.png"}, io.Discard); err == nil {
+		t.Error("DownloadOutput of a broken off download returns no error")
+	}
+}
+
+func TestWithOnQueueUpdated(t *testing.T) {
+	for _, messageType := range []WsMessageType{QueueUpdated, QueueEvent} {
+		t.Run(string(messageType), func(t *testing.T) {
+			m := newMockServer(t)
+			queues := make(chan *WSMessageDataQueueUpdated, 1)
+			c := newConnectedClient(t, m, WithOnQueueUpdated(func(queue *WSMessageDataQueueUpdated) {
+				queues <- queue
+			}))
+
+			m.send(t, `{"type":"`+string(messageType)+`","data":{
+				"queue_running":[[3,"p1",{"9":{"class_type":"SaveImage","inputs":{}}},{"client_id":"`+c.ClientID()+`"},["9"]]],
+				"queue_pending":[[4,"p2",{},{}],[5,"p3",{}]]}}`)
+			select {
+			case queue := <-queues:
+				if len(queue.QueueRunning) != 1 || queue.QueueRunning[0].PromptID != "p1" || queue.QueueRunning[0].ClientID() != c.ClientID() {
+					t.Errorf("running = %+v, want p1 of this client", queue.QueueRunning)
+				}
+				if len(queue.QueuePending) != 2 || queue.QueuePending[0].PromptID != "p2" || queue.QueuePending[1].Num != 5 {
+					t.Errorf("pending = %+v, want p2 and p3", queue.QueuePending)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnQueueUpdated is not called")
+			}
+		})
+	}
+}
+
+func TestUserData(t *testing.T) {
+	m := newMockServer(t)
+	var mu sync.Mutex
+	files := make(map[string][]byte)
+	m.mux.HandleFunc("/userdata", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("dir") != "workflows" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		names := []string{}
+		for name := range files {
+			if strings.HasPrefix(name, "workflows/") {
+				names = append(names, strings.TrimPrefix(name, "workflows/"))
+			}
+		}
+		json.NewEncoder(w).Encode(names)
+	})
+	m.mux.HandleFunc("/userdata/", func(w http.ResponseWriter, r *http.Request) {
+		// the file is one escaped path segment, as ComfyUI expects
+		name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/userdata/"))
+		if err != nil || strings.Contains(strings.TrimPrefix(r.URL.EscapedPath(), "/userdata/"), "/") {
+			http.Error(w, "bad file", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPost {
+			files[name], _ = io.ReadAll(r.Body)
+			return
+		}
+		data, exist := files[name]
+		if !exist {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := c.GetUserData(ctx, "workflows/a.json"); !errors.Is(err, ErrUserDataNotFound) {
+		t.Errorf("GetUserData of a missing file = %v, want %v", err, ErrUserDataNotFound)
+	}
+	if err := c.SetUserData(ctx, "workflows/a.json", []byte(`{"nodes":[]}`)); err != nil {
+		t.Fatalf("SetUserData: %v", err)
+	}
+	data, err := c.GetUserData(ctx, "workflows/a.json")
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if string(data) != `{"nodes":[]}` {
+		t.Errorf("GetUserData = %s, want the data which was set", data)
+	}
+
+	names, err := c.ListUserData(ctx, "workflows")
+	if err != nil {
+		t.Fatalf("ListUserData: %v", err)
+	}
+	if strings.Join(names, ",") != "a.json" {
+		t.Errorf("ListUserData = %v, want a.json", names)
+	}
+	if _, err := c.ListUserData(ctx, "missing"); !errors.Is(err, ErrUserDataNotFound) {
+		t.Errorf("ListUserData of a missing directory = %v, want %v", err, ErrUserDataNotFound)
+	}
+}
+
+func TestInterruptIfRunning(t *testing.T) {
+	tests := []struct {
+		name        string
+		running     []string
+		pending     []string
+		wantRunning bool
+		wantCalls   []string
+	}{
+		{name: "running", running: []string{"p1"}, wantRunning: true, wantCalls: []string{`/interrupt {"prompt_id":"p1"}`}},
+		{name: "another prompt running", running: []string{"p0"}, pending: []string{"p1"}},
+		{name: "idle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			m.setQueue(tt.running, tt.pending)
+			c, err := NewDefaultClientStr(m.URL)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+
+			running, err := c.InterruptIfRunning(context.Background(), "p1")
+			if err != nil {
+				t.Fatalf("InterruptIfRunning: %v", err)
+			}
+			if running != tt.wantRunning {
+				t.Errorf("InterruptIfRunning = %t, want %t", running, tt.wantRunning)
+			}
+			if got := m.recordedCalls(); strings.Join(got, "|") != strings.Join(tt.wantCalls, "|") {
+				t.Errorf("calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestStreamHistory(t *testing.T) {
+	m := newMockServer(t)
+	second := make(chan struct{})
+	m.mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"p1":{"prompt":[1,"p1",{}],"outputs":{}},`)
+		w.(http.Flusher).Flush()
+		// the second entry is only written once the first is delivered
+		<-second
+		fmt.Fprint(w, `"p2":{"prompt":[2,"p2",{}],"outputs":{}}}`)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	var promptIDs []string
+	err = c.StreamHistory(context.Background(), func(item *PromptHistoryItem) error {
+		promptIDs = append(promptIDs, item.PromptID)
+		if item.PromptID == "p1" {
+			close(second)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamHistory: %v", err)
+	}
+	if strings.Join(promptIDs, ",") != "p1,p2" {
+		t.Errorf("streamed prompts = %v, want p1 p2", promptIDs)
+	}
+}
+
+func TestStreamHistoryStatus(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"internal"}`, http.StatusInternalServerError)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	err = c.StreamHistory(context.Background(), func(item *PromptHistoryItem) error {
+		t.Errorf("an error response is streamed as prompt %s", item.PromptID)
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("StreamHistory = %v, want the status code error", err)
+	}
+}
+
+func TestStatusExecInfo(t *testing.T) {
+	c, err := NewDefaultClientStr("http://127.0.0.1:8188")
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	if err := c.Handle(`{"type":"status","data":{"status":{"exec_info":{"queue_remaining":3}}}}`); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if got := c.GetQueueCount(); got != 3 {
+		t.Errorf("queue count = %d, want 3", got)
+	}
+
+	// a status which only carries the sid leaves the queue count alone
+	message := `{"type":"status","data":{"status":{},"sid":"` + c.ClientID() + `"}}`
+	var parsed WSMessage
+	if err := json.Unmarshal([]byte(message), &parsed); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if info := parsed.Data.(*WSMessageDataStatus).Status.ExecInfo; info != nil {
+		t.Errorf("exec info of a sid only status = %+v, want nil", info)
+	}
+	if err := c.Handle(message); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if got := c.GetQueueCount(); got != 3 {
+		t.Errorf("queue count after a sid only status = %d, want 3", got)
+	}
+	if got := c.SessionID(); got != c.ClientID() {
+		t.Errorf("session id = %s, want %s", got, c.ClientID())
+	}
+
+	if err := c.Handle(`{"type":"status","data":{"status":{"exec_info":{"queue_remaining":0}}}}`); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if got := c.GetQueueCount(); got != 0 {
+		t.Errorf("queue count after an empty queue = %d, want 0", got)
+	}
+}
+
+func TestUnauthorizedHTTPResponse(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			m := newMockServer(t)
+			m.mux.HandleFunc("/system_stats", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			})
+			c, err := NewDefaultClientStr(m.URL)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+
+			if _, err := c.GetSystemStats(); !errors.Is(err, ErrUnauthorized) {
+				t.Errorf("GetSystemStats = %v, want %v", err, ErrUnauthorized)
+			}
+		})
+	}
+}
+
+func TestInterruptOnDisconnect(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []ClientOption
+		wantCalls []string
+	}{
+		{name: "enabled", opts: []ClientOption{WithInterruptOnDisconnect()}, wantCalls: []string{`/interrupt {"prompt_id":"prompt-1"}`}},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			c := newConnectedClient(t, m, tt.opts...)
+			started := make(chan struct{})
+			m.onPrompt = func(promptID string, body map[string]interface{}) {
+				m.setQueue([]string{promptID}, nil)
+				go func() {
+					m.send(t, fmt.Sprintf(`{"type":"execution_start","data":{"prompt_id":%q}}`, promptID))
+					close(started)
+				}()
+			}
+
+			go c.RunWorkflow(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+			<-started
+			waitFor(t, "running prompt", func() bool {
+				c.subMu.Lock()
+				defer c.subMu.Unlock()
+				return c.runningPromptID == "prompt-1"
+			})
+
+			m.closeConns()
+			if len(tt.wantCalls) > 0 {
+				waitFor(t, "interrupt", func() bool { return len(m.recordedCalls()) > 0 })
+			} else {
+				waitFor(t, "disconnect", func() bool { return !c.IsInitialized() })
+				time.Sleep(50 * time.Millisecond)
+			}
+			if got := m.recordedCalls(); strings.Join(got, "|") != strings.Join(tt.wantCalls, "|") {
+				t.Errorf("calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestQueuePromptFront(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+
+	workflow := map[string]interface{}{"1": map[string]interface{}{}}
+	if _, err := c.QueuePromptFront(context.Background(), workflow); err != nil {
+		t.Fatalf("QueuePromptFront: %v", err)
+	}
+	if _, err := c.QueuePrompt(context.Background(), workflow); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+
+	bodies := m.promptBodies()
+	if bodies[0]["front"] != true {
+		t.Errorf("QueuePromptFront body = %v, want front set", bodies[0])
+	}
+	if _, ok := bodies[1]["front"]; ok {
+		t.Errorf("QueuePrompt body = %v, want no front", bodies[1])
+	}
+}
+
+func TestCancelMyQueue(t *testing.T) {
+	m := newMockServer(t)
+	c, err := NewDefaultClientStr(m.URL, WithClientID("me"))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	m.setQueue([]string{"running-mine"}, []string{"p1", "other", "p2", "unknown"})
+	for promptID, owner := range map[string]string{"running-mine": "me", "p1": "me", "other": "someone", "p2": "me"} {
+		m.setQueueOwner(promptID, owner)
+	}
+
+	if err := c.CancelMyQueue(context.Background()); err != nil {
+		t.Fatalf("CancelMyQueue: %v", err)
+	}
+	want := []string{`/queue {"delete":["p1","p2"]}`}
+	if got := m.recordedCalls(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+
+	m.setQueue(nil, []string{"other"})
+	if err := c.CancelMyQueue(context.Background()); err != nil {
+		t.Fatalf("CancelMyQueue: %v", err)
+	}
+	if got := m.recordedCalls(); len(got) != 1 {
+		t.Errorf("calls = %v, want no delete without prompts of the client", got)
+	}
+}
+
+func TestDownloadInlineOutput(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/view", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("an inline file is requested from /view")
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	var buf strings.Builder
+	file := &DataOutputFile{Filename: "inline.png", Type: "output", Data: "data:image/png;base64,cG5n"}
+	downloaded, err := c.DownloadOutput(context.Background(), file, &buf)
+	if err != nil {
+		t.Fatalf("DownloadOutput: %v", err)
+	}
+	if buf.String() != "png" || downloaded.Size != 3 || downloaded.ContentType != "image/png" {
+		t.Errorf("DownloadOutput = %+v with %q, want the inline png", downloaded, buf.String())
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	m := newMockServer(t)
+	server := httptest.NewTLSServer(m.mux)
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		opts    []ClientOption
+		wantErr bool
+	}{
+		{name: "verified", wantErr: true},
+		{name: "insecure", opts: []ClientOption{WithInsecureSkipVerify()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewDefaultClientStr(server.URL, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+			defer c.webSocket.Shutdown()
+
+			if _, err := c.GetQueueRemaining(); (err != nil) != tt.wantErr {
+				t.Errorf("GetQueueRemaining = %v, want error %t", err, tt.wantErr)
+			}
+			if err := c.webSocket.ConnectOnce(); (err != nil) != tt.wantErr {
+				t.Errorf("ConnectOnce = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the transport handed to NewClient keeps verifying
+	transport := &http.Transport{}
+	c := NewClient(NewEndPoint("https", strings.TrimPrefix(server.URL, "https://"), ""), &http.Client{Transport: transport}, WithInsecureSkipVerify())
+	defer c.webSocket.Shutdown()
+	if transport.TLSClientConfig != nil && transport.TLSClientConfig.InsecureSkipVerify {
+		t.Error("WithInsecureSkipVerify changed the transport passed to NewClient")
+	}
+	if _, err := c.GetQueueRemaining(); err != nil {
+		t.Errorf("GetQueueRemaining with a copied transport: %v", err)
+	}
+}
+
+func TestClientLabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []ClientOption
+		label string
+	}{
+		{name: "default"},
+		{name: "labeled", opts: []ClientOption{WithClientLabel("render-box-3")}, label: "render-box-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			c := newConnectedClient(t, m, tt.opts...)
+			if _, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err != nil {
+				t.Fatalf("QueuePrompt: %v", err)
+			}
+
+			if got := m.wsHeader(0).Get(ClientLabelHeader); got != tt.label {
+				t.Errorf("handshake label = %q, want %q", got, tt.label)
+			}
+			if got := m.promptHeaders()[0].Get(ClientLabelHeader); got != tt.label {
+				t.Errorf("request label = %q, want %q", got, tt.label)
+			}
+			extraData, _ := m.promptBodies()[0]["extra_data"].(map[string]interface{})
+			if got, _ := extraData[clientLabelExtraKey].(string); got != tt.label {
+				t.Errorf("extra_data = %v, want label %q", extraData, tt.label)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package comfyUIclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// progressCoalescer forwards the progress messages of a prompt at most once per interval
+// Progress messages arriving in between replace each other, only the latest is forwarded when the interval is over
+// The final progress of a node, value equal to max, is always forwarded at once
+type progressCoalescer struct {
+	interval time.Duration
+	forward  func(*WSMessage) error
+
+	// mu is held while forwarding, so messages keep their order
+	mu      sync.Mutex
+	prompts map[string]*coalescedProgress
+}
+
+// coalescedProgress is the state of one prompt
+type coalescedProgress struct {
+	last    time.Time
+	pending *WSMessage
+	timer   *time.Timer
+}
+
+func newProgressCoalescer(interval time.Duration, forward func(*WSMessage) error) *progressCoalescer {
+	return &progressCoalescer{
+		interval: interval,
+		forward:  forward,
+		prompts:  make(map[string]*coalescedProgress),
+	}
+}
+
+// add forwards the progress message of the prompt or keeps it until the interval is over
+func (p *progressCoalescer) add(promptID string, message *WSMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.prompts[promptID]
+	if !ok {
+		state = &coalescedProgress{}
+		p.prompts[promptID] = state
+	}
+
+	d, _ := message.Data.(*WSMessageDataProgress)
+	final := d != nil && d.Value >= d.Max
+	wait := p.interval - time.Since(state.last)
+	if final || wait <= 0 {
+		state.pending = nil
+		state.stopTimer()
+		state.last = time.Now()
+		return p.forward(message)
+	}
+
+	state.pending = message
+	if state.timer == nil {
+		var timer *time.Timer
+		timer = time.AfterFunc(wait, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			// a flush stopped the timer too late
+			if state.timer != timer {
+				return
+			}
+			state.timer = nil
+			if err := p.forwardPending(state); err != nil {
+				fmt.Printf("forward coalesced progress of prompt %s error %v\n", promptID, err)
+			}
+		})
+		state.timer = timer
+	}
+	return nil
+}
+
+// flush forwards the progress which is kept back, it is called before any other message is forwarded
+// When finished is set the state of the prompt is dropped
+func (p *progressCoalescer) flush(promptID string, finished bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.prompts[promptID]
+	if !ok {
+		return nil
+	}
+	state.stopTimer()
+	if finished {
+		delete(p.prompts, promptID)
+	}
+	return p.forwardPending(state)
+}
+
+// forwardPending forwards the kept progress, the caller must hold mu
+func (p *progressCoalescer) forwardPending(state *coalescedProgress) error {
+	message := state.pending
+	if message == nil {
+		return nil
+	}
+	state.pending = nil
+	state.last = time.Now()
+	return p.forward(message)
+}
+
+func (s *coalescedProgress) stopTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
@@ -0,0 +1,80 @@
+package comfyUIclient
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func progressMessage(value, max int) string {
+	return fmt.Sprintf(`{"type":"progress","data":{"value":%d,"max":%d}}`, value, max)
+}
+
+func TestWithProgressCoalesce(t *testing.T) {
+	c, err := NewDefaultClientStr("http://127.0.0.1:8188", WithTaskStatusBufferSize(256), WithProgressCoalesce(time.Hour))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	messages := []string{`{"type":"execution_start","data":{"prompt_id":"p1"}}`}
+	for i := 1; i < 100; i++ {
+		messages = append(messages, progressMessage(i, 100))
+	}
+	messages = append(messages, progressMessage(100, 100), executingMessage("p1", ""))
+	for _, msg := range messages {
+		if err := c.Handle(msg); err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+	}
+
+	var got []string
+	for len(c.ch) > 0 {
+		message := <-c.ch
+		switch d := message.Data.(type) {
+		case *WSMessageDataProgress:
+			got = append(got, fmt.Sprintf("progress %d", d.Value))
+		default:
+			got = append(got, string(message.Type))
+		}
+	}
+	// the first progress passes, the rest is replaced until the final one, the end comes last
+	want := []string{"execution_start", "progress 1", "progress 100", "executing"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("messages = %v, want %v", got, want)
+	}
+}
+
+func TestProgressCoalescerForwardsLatestAfterInterval(t *testing.T) {
+	forwarded := make(chan int, 16)
+	p := newProgressCoalescer(20*time.Millisecond, func(message *WSMessage) error {
+		forwarded <- message.Data.(*WSMessageDataProgress).Value
+		return nil
+	})
+	for i := 1; i <= 5; i++ {
+		if err := p.add("p1", &WSMessage{Type: Progress, Data: &WSMessageDataProgress{Value: i, Max: 10}}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	for _, want := range []int{1, 5} {
+		select {
+		case got := <-forwarded:
+			if got != want {
+				t.Errorf("forwarded %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("progress %d is not forwarded", want)
+		}
+	}
+	select {
+	case got := <-forwarded:
+		t.Errorf("unexpected progress %d", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a flush forwards nothing more once the pending progress went out
+	if err := p.flush("p1", true); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(forwarded) != 0 {
+		t.Errorf("flush forwarded %d more", len(forwarded))
+	}
+}
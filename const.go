@@ -12,11 +12,75 @@ const (
 	ExecutionCached      WsMessageType = "execution_cached"
 	ExecutionInterrupted WsMessageType = "execution_interrupted"
 	ExecutionSuccess     WsMessageType = "execution_success"
+	// QueueUpdated and QueueEvent carry the whole queue, some ComfyUI versions push them when it changes
+	QueueUpdated WsMessageType = "queue_updated"
+	QueueEvent   WsMessageType = "queue"
+	// BinaryPreview is the type of messages decoded from binary frames
+	BinaryPreview WsMessageType = "b_preview"
+)
+
+var knownWsMessageTypes = []WsMessageType{
+	Status,
+	Progress,
+	Executed,
+	Executing,
+	ExecutionStart,
+	ExecutionError,
+	ExecutionCached,
+	ExecutionInterrupted,
+	ExecutionSuccess,
+	QueueUpdated,
+	QueueEvent,
+	BinaryPreview,
+}
+
+func (t WsMessageType) String() string {
+	return string(t)
+}
+
+// IsKnown reports whether the message type is one the client understands, including the ones added with
+// RegisterMessageType
+// It includes BinaryPreview, which the server never sends as a text message, the client decodes it from binary frames
+func (t WsMessageType) IsKnown() bool {
+	return isBuiltinMessageType(t) || isRegisteredMessageType(t)
+}
+
+func isBuiltinMessageType(t WsMessageType) bool {
+	for _, known := range knownWsMessageTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseWsMessageType returns the message type of s and whether it is known
+func ParseWsMessageType(s string) (WsMessageType, bool) {
+	t := WsMessageType(s)
+	return t, t.IsKnown()
+}
+
+// BinaryEventType is the big endian uint32 a binary websocket frame starts with
+type BinaryEventType uint32
+
+const (
+	// PreviewImageEventType is a preview image encoded as jpeg or png, DecodeBinaryPreview splits off its format
+	PreviewImageEventType BinaryEventType = 1
+	// UnencodedPreviewImageEventType is a raw preview image
+	UnencodedPreviewImageEventType BinaryEventType = 2
+	// TextEventType is text a node sends while it runs
+	TextEventType BinaryEventType = 3
+	// PreviewImageWithMetadataEventType is a preview image prefixed with JSON metadata such as the node id
+	PreviewImageWithMetadataEventType BinaryEventType = 4
 )
 
 type Router string
 
+// APIPrefix is the prefix newer ComfyUI serves all routers under
+const APIPrefix = "/api"
+
 const (
+	WebSocketRouter    Router = "/ws"
 	PromptRouter       Router = "/prompt"
 	HistoryRouter      Router = "/history"
 	ViewRouter         Router = "/view"
@@ -29,8 +93,16 @@ const (
 	ObjectInfoRouter   Router = "/object_info"
 	UploadImageRouter  Router = "/upload/image"
 	UploadMaskRouter   Router = "/upload/mask"
+	UserDataRouter     Router = "/userdata"
+	FreeRouter         Router = "/free"
 )
 
+// UserHeader is the header multi-user ComfyUI reads the user id from
+const UserHeader = "Comfy-User"
+
+// ClientLabelHeader carries the label of WithClientLabel on HTTP requests and the websocket handshake
+const ClientLabelHeader = "X-Client-Label"
+
 type TaskStatusType = WsMessageType
 
 type ImageType string
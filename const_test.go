@@ -0,0 +1,109 @@
+package comfyUIclient
+
+import "testing"
+
+func TestParseWsMessageType(t *testing.T) {
+	tests := []struct {
+		s         string
+		want      WsMessageType
+		wantKnown bool
+	}{
+		{s: "status", want: Status, wantKnown: true},
+		{s: "progress", want: Progress, wantKnown: true},
+		{s: "executed", want: Executed, wantKnown: true},
+		{s: "executing", want: Executing, wantKnown: true},
+		{s: "execution_start", want: ExecutionStart, wantKnown: true},
+		{s: "execution_error", want: ExecutionError, wantKnown: true},
+		{s: "execution_cached", want: ExecutionCached, wantKnown: true},
+		{s: "execution_interrupted", want: ExecutionInterrupted, wantKnown: true},
+		{s: "execution_success", want: ExecutionSuccess, wantKnown: true},
+		{s: "b_preview", want: BinaryPreview, wantKnown: true},
+		{s: "crystools.monitor", want: WsMessageType("crystools.monitor"), wantKnown: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, known := ParseWsMessageType(tt.s)
+			if got != tt.want || known != tt.wantKnown {
+				t.Errorf("ParseWsMessageType(%q) = %s, %v, want %s, %v", tt.s, got, known, tt.want, tt.wantKnown)
+			}
+			if got.String() != tt.s {
+				t.Errorf("String() = %s, want %s", got.String(), tt.s)
+			}
+		})
+	}
+}
+
+func TestBinaryEventTypes(t *testing.T) {
+	// the values are part of the wire format ComfyUI defines
+	tests := []struct {
+		eventType BinaryEventType
+		want      uint32
+	}{
+		{eventType: PreviewImageEventType, want: 1},
+		{eventType: UnencodedPreviewImageEventType, want: 2},
+		{eventType: TextEventType, want: 3},
+		{eventType: PreviewImageWithMetadataEventType, want: 4},
+	}
+	for _, tt := range tests {
+		if uint32(tt.eventType) != tt.want {
+			t.Errorf("event type = %d, want %d", tt.eventType, tt.want)
+		}
+	}
+}
+
+// customEvent is the data of a message type a custom node sends
+type customEvent struct {
+	Text string `json:"text"`
+}
+
+func TestRegisteredMessageTypes(t *testing.T) {
+	types := RegisteredMessageTypes()
+	for _, builtin := range knownWsMessageTypes {
+		found := false
+		for _, messageType := range types {
+			if messageType == builtin {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("RegisteredMessageTypes = %v, %s is missing", types, builtin)
+		}
+	}
+	for i := 1; i < len(types); i++ {
+		if types[i-1] >= types[i] {
+			t.Errorf("RegisteredMessageTypes = %v, want sorted without duplicates", types)
+		}
+	}
+
+	if err := RegisterMessageType(Executed, func() interface{} { return &customEvent{} }); err == nil {
+		t.Error("a built-in message type is replaced")
+	}
+	custom := WsMessageType("test_custom_event")
+	if err := RegisterMessageType(custom, func() interface{} { return &customEvent{} }); err != nil {
+		t.Fatalf("RegisterMessageType: %v", err)
+	}
+	t.Cleanup(func() {
+		messageTypeMu.Lock()
+		defer messageTypeMu.Unlock()
+		delete(messageTypeMap, custom)
+	})
+	if got := RegisteredMessageTypes(); len(got) != len(types)+1 {
+		t.Errorf("RegisteredMessageTypes after registering = %v, want %s added", got, custom)
+	}
+	if !custom.IsKnown() {
+		t.Errorf("%s is not known after it is registered", custom)
+	}
+
+	// the registered type is decoded and sent to the task status channel
+	c, err := NewDefaultClientStr("http://127.0.0.1:8188", WithTaskStatusBufferSize(1))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	if err := c.Handle(`{"type":"test_custom_event","data":{"text":"hello"}}`); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	message := <-c.ch
+	if d, ok := message.Data.(*customEvent); !ok || d.Text != "hello" {
+		t.Errorf("data = %#v, want the custom event", message.Data)
+	}
+}
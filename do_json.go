@@ -0,0 +1,48 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// HTTPError is returned by DoJSON when the server answers with a status other than 2xx
+type HTTPError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s %s: status code %d: %s", e.Method, e.Path, e.StatusCode, string(e.Body))
+}
+
+// DoJSON calls an endpoint the client has no method for, e.g. one of a custom node
+// path is relative to the base url and gets the api prefix like the other requests, auth and the circuit breaker
+// apply too
+// body is sent as json unless it is nil, the response is decoded into out unless it is nil
+func (c *Client) DoJSON(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := c.requestJson(ctx, method, path, nil, body, nil)
+	if err != nil {
+		return fmt.Errorf("c.requestJson: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll: error: %w", err)
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return &HTTPError{Method: method, Path: path, StatusCode: resp.StatusCode, Body: b}
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("json.Unmarshal: error: %w, resp.Body: %v", err, string(b))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestDoJSON(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/api/custom/echo", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"method": r.Method,
+			"auth":   r.Header.Get("Authorization"),
+			"body":   body,
+		})
+	})
+	m.mux.HandleFunc("/api/custom/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "boom")
+	})
+	c, err := NewDefaultClientStr(m.URL, WithAPIPrefix(true))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	c.SetBearerToken("secret")
+
+	var out struct {
+		Method string                 `json:"method"`
+		Auth   string                 `json:"auth"`
+		Body   map[string]interface{} `json:"body"`
+	}
+	if err := c.DoJSON(context.Background(), http.MethodPost, "/custom/echo", map[string]interface{}{"n": 1}, &out); err != nil {
+		t.Fatalf("DoJSON: %v", err)
+	}
+	if out.Method != http.MethodPost || out.Auth != "Bearer secret" || out.Body["n"] != float64(1) {
+		t.Errorf("DoJSON decoded %+v, want the echoed POST with auth", out)
+	}
+
+	if err := c.DoJSON(context.Background(), http.MethodGet, "/custom/echo", nil, nil); err != nil {
+		t.Errorf("DoJSON without out: %v", err)
+	}
+
+	err = c.DoJSON(context.Background(), http.MethodGet, "/custom/broken", nil, &out)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusInternalServerError || string(httpErr.Body) != "boom" {
+		t.Errorf("DoJSON = %v, want an HTTPError with status 500", err)
+	}
+}
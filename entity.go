@@ -1,8 +1,13 @@
 package comfyUIclient
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"mime"
+	"path"
+	"sort"
+	"strings"
 )
 
 // SystemStats contains a system info and gpu infos
@@ -16,6 +21,8 @@ type System struct {
 	OS             string `json:"os"`
 	PythonVersion  string `json:"python_version"`
 	EmbeddedPython bool   `json:"embedded_python"`
+	// ComfyUIVersion is empty for servers older than the versions which report it
+	ComfyUIVersion string `json:"comfyui_version"`
 }
 
 // GPU contains gpu info
@@ -48,19 +55,93 @@ type DataOutputFile struct {
 	Filename  string `json:"filename"`
 	SubFolder string `json:"subfolder"`
 	Type      string `json:"type"`
+	// Data is the file inlined as base64 by some custom nodes, optionally as a data URI, see InlineData
+	Data string `json:"data,omitempty"`
+}
+
+// InlineData returns the decoded content of a file the server sent inline, so no /view request is needed
+// It reports false when the file is not inline or its data is not valid base64
+func (f *DataOutputFile) InlineData() ([]byte, bool) {
+	data := f.Data
+	if data == "" {
+		return nil, false
+	}
+	if strings.HasPrefix(data, "data:") {
+		// data:image/png;base64,<data>
+		i := strings.Index(data, ",")
+		if i < 0 || !strings.HasSuffix(data[:i], ";base64") {
+			return nil, false
+		}
+		data = data[i+1:]
+	}
+
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// outputContentTypes covers the formats ComfyUI outputs, the system mime table may miss some of them
+var outputContentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".webp": "image/webp",
+	".gif":  "image/gif",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".glb":  "model/gltf-binary",
+	".json": "application/json",
+	".txt":  "text/plain; charset=utf-8",
+}
+
+// ContentType returns the MIME type of the file inferred from its extension
+// It returns application/octet-stream when the extension is unknown
+func (f *DataOutputFile) ContentType() string {
+	ext := strings.ToLower(path.Ext(f.Filename))
+	if contentType, exist := outputContentTypes[ext]; exist {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// DownloadedFile describes a file written by DownloadOutput
+type DownloadedFile struct {
+	Filename    string
+	ContentType string
+	Size        int64
 }
 
 // PromptHistoryMember is part of prompt history
 type PromptHistoryMember struct {
 	NodeInfo *NodeInfo                            `json:"prompt"`
 	Outputs  map[string]PromptHistoryMemberImages `json:"outputs"`
+	// Status is nil for servers which do not report it
+	Status *PromptHistoryStatus `json:"status,omitempty"`
+}
+
+// PromptHistoryStatus is how a prompt in history ended
+type PromptHistoryStatus struct {
+	StatusStr string `json:"status_str"`
+	Completed bool   `json:"completed"`
+	// Messages are the [type, data] pairs of the execution messages the server sent for the prompt
+	Messages [][2]json.RawMessage `json:"messages"`
 }
 
 type PromptHistoryMemberImages struct {
-	Images []DataOutputFile  `json:"images"`
-	Gifs   []DataOutputFile  `json:"gifs"`
-	Audios []DataOutputFile  `json:"audio"`
-	Videos []string          `json:"video"`
+	Images []DataOutputFile `json:"images"`
+	Gifs   []DataOutputFile `json:"gifs"`
+	Audios []DataOutputFile `json:"audio"`
+	Videos []string         `json:"video"`
 }
 
 // PromptHistoryItem contains prompt id, WorkFlow, output info
@@ -69,6 +150,45 @@ type PromptHistoryItem struct {
 	PromptHistoryMember
 }
 
+// ImageOutputs returns the images of all nodes, ordered by node id
+func (h *PromptHistoryItem) ImageOutputs() []*DataOutputFile {
+	return h.ImageOutputsByType("")
+}
+
+// ImageOutputsByType returns the images of the given type such as output or temp, ordered by node id
+// An empty type returns all images
+func (h *PromptHistoryItem) ImageOutputsByType(imageType ImageType) []*DataOutputFile {
+	nodeIDs := make([]string, 0, len(h.Outputs))
+	for nodeID := range h.Outputs {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool { return naturalLess(nodeIDs[i], nodeIDs[j]) })
+
+	var images []*DataOutputFile
+	for _, nodeID := range nodeIDs {
+		output := h.Outputs[nodeID]
+		for i := range output.Images {
+			if imageType == "" || output.Images[i].Type == string(imageType) {
+				images = append(images, &output.Images[i])
+			}
+		}
+	}
+	return images
+}
+
+// Workflow returns the prompt graph exactly as it was submitted, nil when the history has none
+func (h *PromptHistoryItem) Workflow() map[string]interface{} {
+	if h.NodeInfo == nil || h.NodeInfo.rawPrompt == nil {
+		return nil
+	}
+
+	var workflow map[string]interface{}
+	if err := json.Unmarshal(h.NodeInfo.rawPrompt, &workflow); err != nil {
+		return nil
+	}
+	return workflow
+}
+
 // PromptNode is the data that inputs into ComfyUI
 type PromptNode struct {
 	Inputs    map[string]interface{} `json:"inputs"`
@@ -78,6 +198,7 @@ type PromptNode struct {
 // NodeObject is a part of workflow
 type NodeObject struct {
 	Input        *NodeObjectInput `json:"input"`
+	InputOrder   *NodeInputOrder  `json:"input_order,omitempty"`
 	Output       []string         `json:"output"`
 	OutputIsList []bool           `json:"output_is_list"`
 	OutputName   []string         `json:"output_name"`
@@ -94,6 +215,12 @@ type NodeObjectInput struct {
 	Optional map[string]interface{} `json:"optional,omitempty"`
 }
 
+// NodeInputOrder exposes the declared order of the inputs of a node, newer ComfyUI reports it
+type NodeInputOrder struct {
+	Required []string `json:"required"`
+	Optional []string `json:"optional,omitempty"`
+}
+
 // QueueInfo exposes the queue info
 type QueueInfo struct {
 	QueueRunning []*NodeInfo `json:"queue_running"`
@@ -107,6 +234,19 @@ type NodeInfo struct {
 	Prompt        map[string]PromptNode `json:"prompt"`
 	ExtraData     json.RawMessage       // extra data is just for user's custom data
 	OutputNodeIDs []string
+	rawPrompt     json.RawMessage
+}
+
+// ClientID returns the client id the prompt was queued with, read from its extra data
+// It is empty when the server does not report it
+func (n *NodeInfo) ClientID() string {
+	var extra struct {
+		ClientID string `json:"client_id"`
+	}
+	if len(n.ExtraData) == 0 || json.Unmarshal(n.ExtraData, &extra) != nil {
+		return ""
+	}
+	return extra.ClientID
 }
 
 // UploadFile export data address, name and type
@@ -116,6 +256,8 @@ type UploadFile struct {
 	Type      string `json:"type"`
 }
 
+// UnmarshalJSON decodes the [number, prompt_id, prompt, extra_data, outputs_to_execute] array ComfyUI uses
+// Trailing elements are optional, older and newer servers differ in the array length
 func (n *NodeInfo) UnmarshalJSON(data []byte) error {
 	var temp []json.RawMessage
 	if err := json.Unmarshal(data, &temp); err != nil {
@@ -123,7 +265,7 @@ func (n *NodeInfo) UnmarshalJSON(data []byte) error {
 	}
 
 	// Ensure the length of the array is as expected
-	if len(temp) != 5 {
+	if len(temp) < 3 {
 		return fmt.Errorf("unexpected JSON array length for NodeInfo")
 	}
 
@@ -139,11 +281,16 @@ func (n *NodeInfo) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(temp[2], &n.Prompt); err != nil {
 		return err
 	}
+	n.rawPrompt = temp[2]
 
-	n.ExtraData = temp[3]
+	if len(temp) > 3 {
+		n.ExtraData = temp[3]
+	}
 
-	if err := json.Unmarshal(temp[4], &n.OutputNodeIDs); err != nil {
-		return err
+	if len(temp) > 4 {
+		if err := json.Unmarshal(temp[4], &n.OutputNodeIDs); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -152,3 +299,12 @@ func (n *NodeInfo) UnmarshalJSON(data []byte) error {
 type extraData struct {
 	ExtraPngInfo json.RawMessage `json:"extra_pnginfo"`
 }
+
+// promptRequest is the body of POST /prompt
+type promptRequest struct {
+	ClientID  string                 `json:"client_id"`
+	Prompt    map[string]interface{} `json:"prompt"`
+	ExtraData map[string]interface{} `json:"extra_data,omitempty"`
+	// Front puts the prompt at the front of the queue
+	Front bool `json:"front,omitempty"`
+}
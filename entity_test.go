@@ -0,0 +1,187 @@
+package comfyUIclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const sampleHistory = `{
+  "p1": {
+    "prompt": [
+      3,
+      "p1",
+      {
+        "4": {"inputs": {"ckpt_name": "sd15.safetensors"}, "class_type": "CheckpointLoaderSimple"},
+        "9": {"inputs": {"filename_prefix": "final", "images": ["8", 0]}, "class_type": "SaveImage"},
+        "12": {"inputs": {"filename_prefix": "draft", "images": ["8", 0]}, "class_type": "SaveImage"},
+        "15": {"inputs": {"images": ["8", 0]}, "class_type": "PreviewImage"}
+      },
+      {"client_id": "c1"},
+      ["9", "12", "15"]
+    ],
+    "outputs": {
+      "9": {"images": [{"filename": "final_00001_.png", "subfolder": "", "type": "output"}]},
+      "12": {"images": [
+        {"filename": "draft_00001_.png", "subfolder": "drafts", "type": "output"},
+        {"filename": "draft_00002_.png", "subfolder": "drafts", "type": "output"}
+      ]},
+      "15": {"images": [{"filename": "ComfyUI_temp_00001_.png", "subfolder": "", "type": "temp"}]}
+    }
+  }
+}`
+
+func sampleHistoryItem(t *testing.T) *PromptHistoryItem {
+	t.Helper()
+	var history map[string]*PromptHistoryMember
+	if err := json.Unmarshal([]byte(sampleHistory), &history); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	return &PromptHistoryItem{PromptID: "p1", PromptHistoryMember: *history["p1"]}
+}
+
+func filenames(files []*DataOutputFile) []string {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Filename)
+	}
+	return names
+}
+
+func TestImageOutputs(t *testing.T) {
+	item := sampleHistoryItem(t)
+
+	tests := []struct {
+		name      string
+		imageType ImageType
+		want      []string
+	}{
+		{name: "all", want: []string{"final_00001_.png", "draft_00001_.png", "draft_00002_.png", "ComfyUI_temp_00001_.png"}},
+		{name: "output", imageType: "output", want: []string{"final_00001_.png", "draft_00001_.png", "draft_00002_.png"}},
+		{name: "temp", imageType: "temp", want: []string{"ComfyUI_temp_00001_.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filenames(item.ImageOutputsByType(tt.imageType))
+			if len(got) != len(tt.want) {
+				t.Fatalf("ImageOutputsByType(%q) = %v, want %v", tt.imageType, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ImageOutputsByType(%q) = %v, want %v", tt.imageType, got, tt.want)
+					break
+				}
+			}
+		})
+	}
+
+	if got := len(item.ImageOutputs()); got != 4 {
+		t.Errorf("ImageOutputs returns %d images, want 4", got)
+	}
+}
+
+func TestHistoryPromptArray(t *testing.T) {
+	item := sampleHistoryItem(t)
+
+	info := item.NodeInfo
+	if info.Num != 3 || info.PromptID != "p1" {
+		t.Errorf("number and prompt id = %d %s, want 3 p1", info.Num, info.PromptID)
+	}
+	if got := info.Prompt["4"].ClassType; got != "CheckpointLoaderSimple" {
+		t.Errorf("class type of node 4 = %s, want CheckpointLoaderSimple", got)
+	}
+	if string(info.ExtraData) != `{"client_id": "c1"}` {
+		t.Errorf("extra data = %s, want the client id object", info.ExtraData)
+	}
+	if strings.Join(info.OutputNodeIDs, ",") != "9,12,15" {
+		t.Errorf("output node ids = %v, want 9 12 15", info.OutputNodeIDs)
+	}
+
+	workflow := item.Workflow()
+	if len(workflow) != 4 {
+		t.Fatalf("Workflow has %d nodes, want 4", len(workflow))
+	}
+	inputs := workflow["9"].(map[string]interface{})["inputs"].(map[string]interface{})
+	if inputs["filename_prefix"] != "final" {
+		t.Errorf("filename_prefix of node 9 = %v, want final", inputs["filename_prefix"])
+	}
+
+	var short map[string]*PromptHistoryMember
+	if err := json.Unmarshal([]byte(`{"p2":{"prompt":[1,"p2",{}],"outputs":{}}}`), &short); err != nil {
+		t.Fatalf("json.Unmarshal of a three element prompt: %v", err)
+	}
+	if short["p2"].NodeInfo.PromptID != "p2" {
+		t.Errorf("prompt id = %s, want p2", short["p2"].NodeInfo.PromptID)
+	}
+	if err := json.Unmarshal([]byte(`{"p3":{"prompt":[1,"p3"]}}`), &short); err == nil {
+		t.Error("a prompt array without the graph is accepted")
+	}
+	if (&PromptHistoryItem{}).Workflow() != nil {
+		t.Error("Workflow of an empty history is not nil")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{filename: "ComfyUI_00001_.png", want: "image/png"},
+		{filename: "photo.JPG", want: "image/jpeg"},
+		{filename: "preview.webp", want: "image/webp"},
+		{filename: "clips/AnimateDiff_00001.mp4", want: "video/mp4"},
+		{filename: "latent.unknownext", want: "application/octet-stream"},
+		{filename: "no_extension", want: "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			file := &DataOutputFile{Filename: tt.filename}
+			if got := file.ContentType(); got != tt.want {
+				t.Errorf("ContentType() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineData(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n'}
+	encoded := base64.StdEncoding.EncodeToString(png)
+	tests := []struct {
+		name   string
+		data   string
+		want   []byte
+		wantOK bool
+	}{
+		{name: "base64", data: encoded, want: png, wantOK: true},
+		{name: "data uri", data: "data:image/png;base64," + encoded, want: png, wantOK: true},
+		{name: "not inline"},
+		{name: "invalid base64", data: "not base64!"},
+		{name: "data uri without base64", data: "data:text/plain,hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &DataOutputFile{Filename: "a.png", Data: tt.data}
+			got, ok := file.InlineData()
+			if ok != tt.wantOK || string(got) != string(tt.want) {
+				t.Errorf("InlineData() = %v, %t, want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestExecutedInlineOutput(t *testing.T) {
+	msg := `{"type":"executed","data":{"node":"9","prompt_id":"p1","output":{"images":[
+		{"filename":"inline.png","subfolder":"","type":"output","data":"` + base64.StdEncoding.EncodeToString([]byte("png")) + `"}]}}}`
+	var message WSMessage
+	if err := json.Unmarshal([]byte(msg), &message); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	files := message.Data.(*WSMessageDataExecuted).Output["images"]
+	if len(files) != 1 {
+		t.Fatalf("images = %v, want one", files)
+	}
+	if data, ok := files[0].InlineData(); !ok || string(data) != "png" {
+		t.Errorf("InlineData() = %q, %t, want the inline image", data, ok)
+	}
+}
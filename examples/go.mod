@@ -1,6 +1,6 @@
 module github.com/XdpCs/ComfyUI-client/examples
 
-go 1.18
+go 1.20
 
 replace github.com/XdpCs/comfyUIclient => ../
 
@@ -0,0 +1,50 @@
+package comfyUIclient
+
+import (
+	"expvar"
+	"sync"
+)
+
+// ExpvarName is the expvar map WithExpvar publishes the connection stats under, keyed by websocket url
+const ExpvarName = "comfyui"
+
+var (
+	expvarOnce        sync.Once
+	expvarConnections *expvar.Map
+)
+
+// connectionsExpvar returns the published map, expvar panics when a name is published twice
+func connectionsExpvar() *expvar.Map {
+	expvarOnce.Do(func() {
+		expvarConnections = expvar.NewMap(ExpvarName)
+	})
+	return expvarConnections
+}
+
+// connectionStats are the counters of a client WithExpvar publishes
+type connectionStats struct {
+	// messages counts the received messages by type
+	messages expvar.Map
+	// errors counts the errors of handling the frames, see Errors
+	errors expvar.Int
+}
+
+// publishExpvar publishes the stats of the client under its websocket url:
+// connected, reconnects, messages by type and errors
+// A client with the same url replaces the stats of the previous one
+func (c *Client) publishExpvar() {
+	ws := c.webSocket
+	stats := new(expvar.Map).Init()
+	stats.Set("connected", expvar.Func(func() interface{} { return ws.GetIsConnected() }))
+	stats.Set("reconnects", expvar.Func(func() interface{} { return ws.reconnects.Load() }))
+	stats.Set("messages", &c.stats.messages)
+	stats.Set("errors", &c.stats.errors)
+	connectionsExpvar().Set(ws.URL, stats)
+}
+
+// countMessage counts the message by type when WithExpvar is enabled
+func (c *Client) countMessage(messageType WsMessageType) {
+	if c.stats != nil {
+		c.stats.messages.Add(string(messageType), 1)
+	}
+}
@@ -0,0 +1,60 @@
+package comfyUIclient
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+)
+
+// connectionExpvar returns the published stats of the client decoded from their JSON
+func connectionExpvar(t *testing.T, c *Client) map[string]interface{} {
+	t.Helper()
+	published, ok := expvar.Get(ExpvarName).(*expvar.Map)
+	if !ok {
+		t.Fatalf("expvar %s is not published", ExpvarName)
+	}
+	stats := published.Get(c.webSocket.URL)
+	if stats == nil {
+		t.Fatalf("no stats for %s", c.webSocket.URL)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(stats.String()), &decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	return decoded
+}
+
+func TestWithExpvar(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithExpvar(), WithTaskStatusBufferSize(16))
+
+	m.send(t, executingMessage("p1", "3"))
+	m.send(t, executingMessage("p1", "4"))
+	m.send(t, progressMessage(1, 2))
+	m.send(t, `not json`)
+	waitFor(t, "handled messages", func() bool {
+		return connectionExpvar(t, c)["errors"] == float64(1)
+	})
+
+	stats := connectionExpvar(t, c)
+	if stats["connected"] != true {
+		t.Errorf("connected = %v, want true", stats["connected"])
+	}
+	if stats["reconnects"] != float64(0) {
+		t.Errorf("reconnects = %v, want 0", stats["reconnects"])
+	}
+	messages, _ := stats["messages"].(map[string]interface{})
+	if messages["executing"] != float64(2) || messages["progress"] != float64(1) || messages["status"] == nil {
+		t.Errorf("messages = %v, want 2 executing, 1 progress and the status", messages)
+	}
+}
+
+func TestExpvarIsOffByDefault(t *testing.T) {
+	c, err := NewDefaultClientStr("http://127.0.0.1:8188")
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	if published, ok := expvar.Get(ExpvarName).(*expvar.Map); ok && published.Get(c.webSocket.URL) != nil {
+		t.Error("stats are published without WithExpvar")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/kee-moo/comfyUIclient
 
-go 1.18
+go 1.20
 
 require (
 	github.com/google/uuid v1.5.0
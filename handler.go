@@ -0,0 +1,81 @@
+package comfyUIclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HandlerFunc adapts a function to a Handler, e.g. to write a middleware for Use
+type HandlerFunc func(msg string) error
+
+// Handle calls f(msg)
+func (f HandlerFunc) Handle(msg string) error {
+	return f(msg)
+}
+
+// Middleware wraps the handler of text frames, see WebSocketConnection.Use
+type Middleware func(next Handler) Handler
+
+// ErrChannelFull is returned by TeeHandler when its channel can not take the message
+var ErrChannelFull = errors.New("channel is full")
+
+// TeeHandler is a Handler which parses every message and delivers it both to a channel and to a callback
+// It lets consumers mix the channel and the callback style, either sink may be nil
+type TeeHandler struct {
+	ch       chan<- *WSMessage
+	callback func(*WSMessage) error
+}
+
+// NewTeeHandler creates a TeeHandler
+// Sending to ch never blocks, a message which does not fit is dropped with ErrChannelFull
+func NewTeeHandler(ch chan<- *WSMessage, callback func(*WSMessage) error) *TeeHandler {
+	return &TeeHandler{
+		ch:       ch,
+		callback: callback,
+	}
+}
+
+// Handle delivers the message to both sinks, the errors of both are returned as HandlerErrors
+func (t *TeeHandler) Handle(msg string) error {
+	message := &WSMessage{}
+	if err := json.Unmarshal([]byte(msg), message); err != nil {
+		return fmt.Errorf("json.Unmarshal: error: %w", err)
+	}
+
+	var errs HandlerErrors
+	if t.ch != nil {
+		select {
+		case t.ch <- message:
+		default:
+			errs = append(errs, fmt.Errorf("message %s dropped: %w", message.Type, ErrChannelFull))
+		}
+	}
+	if t.callback != nil {
+		if err := t.callback(message); err != nil {
+			errs = append(errs, fmt.Errorf("callback: error: %w", err))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// HandlerErrors contains the errors of several sinks of one message
+type HandlerErrors []error
+
+func (e HandlerErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors
+func (e HandlerErrors) Unwrap() []error {
+	return e
+}
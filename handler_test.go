@@ -0,0 +1,122 @@
+package comfyUIclient
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTeeHandler(t *testing.T) {
+	ch := make(chan *WSMessage, 1)
+	var called []*WSMessage
+	tee := NewTeeHandler(ch, func(message *WSMessage) error {
+		called = append(called, message)
+		return nil
+	})
+
+	if err := tee.Handle(executingMessage("p1", "3")); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	select {
+	case message := <-ch:
+		if message.Type != Executing {
+			t.Errorf("channel message type = %s, want %s", message.Type, Executing)
+		}
+	default:
+		t.Error("the channel received nothing")
+	}
+	if len(called) != 1 || called[0].Type != Executing {
+		t.Errorf("callback received %v, want the executing message", called)
+	}
+}
+
+func TestTeeHandlerErrors(t *testing.T) {
+	ch := make(chan *WSMessage)
+	errCallback := errors.New("callback failed")
+	calls := 0
+	tee := NewTeeHandler(ch, func(message *WSMessage) error {
+		calls++
+		return errCallback
+	})
+
+	// a full channel does not keep the message from the callback
+	err := tee.Handle(executingMessage("p1", "3"))
+	if !errors.Is(err, ErrChannelFull) || !errors.Is(err, errCallback) {
+		t.Errorf("Handle = %v, want both %v and %v", err, ErrChannelFull, errCallback)
+	}
+	if calls != 1 {
+		t.Errorf("callback is called %d times, want 1", calls)
+	}
+
+	if err := NewTeeHandler(nil, nil).Handle("not json"); err == nil {
+		t.Error("Handle of a malformed message returns no error")
+	}
+}
+
+func TestUse(t *testing.T) {
+	m := newMockServer(t)
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	handled := make(chan *WSMessage, 1)
+	ws := NewDefaultWebSocketConnection(mockWebSocketURL(m), NewTeeHandler(nil, func(message *WSMessage) error {
+		record("handler")
+		handled <- message
+		return nil
+	}), "")
+	for _, name := range []string{"first", "second"} {
+		name := name
+		ws.Use(func(next Handler) Handler {
+			return HandlerFunc(func(msg string) error {
+				record(name + " before")
+				err := next.Handle(msg)
+				record(name + " after")
+				return err
+			})
+		})
+	}
+	// a middleware may drop a frame, the handler does not see it
+	ws.Use(func(next Handler) Handler {
+		return HandlerFunc(func(msg string) error {
+			if strings.Contains(msg, `"status"`) {
+				return nil
+			}
+			return next.Handle(msg)
+		})
+	})
+	go ws.ConnectAndListen()
+	defer ws.Shutdown()
+	waitFor(t, "connection", ws.GetIsConnected)
+
+	m.send(t, executingMessage("p1", "3"))
+	select {
+	case message := <-handled:
+		if message.Type != Executing {
+			t.Errorf("handled %s, want the executing message", message.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message does not reach the handler")
+	}
+
+	waitFor(t, "middlewares", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(calls) >= 9
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	// the status frame sent on connect passes the first two and is dropped by the third
+	want := []string{
+		"first before", "second before", "second after", "first after",
+		"first before", "second before", "handler", "second after", "first after",
+	}
+	if strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
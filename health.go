@@ -0,0 +1,44 @@
+package comfyUIclient
+
+import (
+	"time"
+)
+
+// HealthStatus is the state of the websocket connection, for readiness and liveness probes
+type HealthStatus struct {
+	// Connected reports whether the websocket is connected right now
+	Connected bool
+	// Closed reports whether the connection was shut down for good, it is not reconnected anymore
+	Closed bool
+	// LastMessageAge is the time since the last frame arrived, 0 when none arrived yet
+	LastMessageAge time.Duration
+	// Reconnects is how often ConnectAndListen connected again after the connection dropped
+	Reconnects int
+	// BackingOff reports whether a reconnect is waiting before it dials again
+	BackingOff bool
+}
+
+// Ready reports whether the connection can be used, i.e. it is connected and not shut down
+func (s HealthStatus) Ready() bool {
+	return s.Connected && !s.Closed
+}
+
+// Health returns the state of the websocket connection
+func (w *WebSocketConnection) Health() HealthStatus {
+	status := HealthStatus{
+		Connected:  w.GetIsConnected(),
+		Closed:     w.Context().Err() != nil,
+		Reconnects: int(w.reconnects.Load()),
+		BackingOff: w.backingOff.Load(),
+	}
+	if last := w.lastMessage.Load(); last != 0 {
+		status.LastMessageAge = time.Since(time.Unix(0, last))
+	}
+	return status
+}
+
+// Health returns the state of the websocket connection, wire it into a readiness or liveness handler
+// A liveness check may also require a recent message, e.g. LastMessageAge below the read timeout
+func (c *Client) Health() HealthStatus {
+	return c.webSocket.Health()
+}
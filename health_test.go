@@ -0,0 +1,61 @@
+package comfyUIclient
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	m := newMockServer(t)
+	var down atomic.Bool
+	m.mux.HandleFunc("/gated/ws", func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		m.serveWS(w, r)
+	})
+	ws := NewDefaultWebSocketConnection("ws"+strings.TrimPrefix(m.URL, "http")+"/gated/ws?clientId=c1", NewTeeHandler(nil, nil), "")
+	ws.ReconnectInterval = 50 * time.Millisecond
+	ws.MaxRetry = 1
+	go ws.ConnectAndListen()
+	defer ws.Shutdown()
+
+	waitFor(t, "first message", func() bool { return ws.Health().LastMessageAge > 0 })
+	if status := ws.Health(); !status.Ready() || status.Reconnects != 0 || status.BackingOff {
+		t.Errorf("Health after connecting = %+v, want ready without reconnects", status)
+	}
+
+	// the server goes away, the client waits between its attempts to reconnect
+	down.Store(true)
+	m.closeConns()
+	waitFor(t, "backoff", func() bool {
+		status := ws.Health()
+		return !status.Connected && status.BackingOff
+	})
+	if status := ws.Health(); status.Ready() || status.Closed {
+		t.Errorf("Health while disconnected = %+v, want not ready and not closed", status)
+	}
+
+	down.Store(false)
+	waitFor(t, "reconnect", func() bool {
+		status := ws.Health()
+		return status.Ready() && status.Reconnects == 1
+	})
+
+	ws.Shutdown()
+	if status := ws.Health(); !status.Closed || status.Ready() {
+		t.Errorf("Health after Shutdown = %+v, want closed", status)
+	}
+}
+
+func TestClientHealth(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+	if status := c.Health(); !status.Ready() || status.LastMessageAge <= 0 {
+		t.Errorf("Health = %+v, want ready with the status message received", status)
+	}
+}
@@ -0,0 +1,91 @@
+package comfyUIclient
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// NumberRange is the numeric config {default, min, max, step} of an INT or FLOAT input
+type NumberRange struct {
+	Default float64
+	Min     float64
+	Max     float64
+	// Step is 0 when the input has none
+	Step float64
+}
+
+// Contains reports whether v is within the range and on a step from Min
+func (r NumberRange) Contains(v float64) bool {
+	if v < r.Min || v > r.Max {
+		return false
+	}
+	if r.Step == 0 {
+		return true
+	}
+	steps := (v - r.Min) / r.Step
+	return math.Abs(steps-math.Round(steps)) < 1e-9
+}
+
+// ServerLimits are the practical limits of the server, derived from object_info
+type ServerLimits struct {
+	// Width, Height and BatchSize are the latent limits of EmptyLatentImage
+	Width     NumberRange
+	Height    NumberRange
+	BatchSize NumberRange
+}
+
+// Limits reads the limits of the server from object_info, so that input can be validated before it is submitted
+func (c *Client) Limits(ctx context.Context) (*ServerLimits, error) {
+	info, err := c.getObjectInfoByNodeName(ctx, "EmptyLatentImage")
+	if err != nil {
+		return nil, fmt.Errorf("c.getObjectInfoByNodeName: error: %w", err)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("server has no EmptyLatentImage node")
+	}
+
+	limits := &ServerLimits{}
+	for name, r := range map[string]*NumberRange{"width": &limits.Width, "height": &limits.Height, "batch_size": &limits.BatchSize} {
+		inputRange, ok := info.InputRange(name)
+		if !ok {
+			return nil, fmt.Errorf("EmptyLatentImage input %s has no numeric config", name)
+		}
+		*r = inputRange
+	}
+	return limits, nil
+}
+
+// InputRange returns the numeric config of the input, false when the input is missing or not a number
+func (n *NodeObject) InputRange(name string) (NumberRange, bool) {
+	if n == nil || n.Input == nil {
+		return NumberRange{}, false
+	}
+	spec, exist := n.Input.Required[name]
+	if !exist {
+		if spec, exist = n.Input.Optional[name]; !exist {
+			return NumberRange{}, false
+		}
+	}
+
+	// an input spec is [type, config]
+	tuple, ok := spec.([]interface{})
+	if !ok || len(tuple) < 2 {
+		return NumberRange{}, false
+	}
+	if inputType, _ := tuple[0].(string); inputType != "INT" && inputType != "FLOAT" {
+		return NumberRange{}, false
+	}
+	config, ok := tuple[1].(map[string]interface{})
+	if !ok {
+		return NumberRange{}, false
+	}
+
+	r := NumberRange{Min: math.Inf(-1), Max: math.Inf(1)}
+	for key, field := range map[string]*float64{"default": &r.Default, "min": &r.Min, "max": &r.Max, "step": &r.Step} {
+		if v, ok := config[key].(float64); ok {
+			*field = v
+		}
+	}
+	return r, true
+}
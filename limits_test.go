@@ -0,0 +1,84 @@
+package comfyUIclient
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+)
+
+const sampleEmptyLatentImage = `{"EmptyLatentImage": {
+  "input": {"required": {
+    "width": ["INT", {"default": 512, "min": 16, "max": 16384, "step": 8}],
+    "height": ["INT", {"default": 512, "min": 16, "max": 16384, "step": 8}],
+    "batch_size": ["INT", {"default": 1, "min": 1, "max": 4096}]
+  }},
+  "output": ["LATENT"],
+  "name": "EmptyLatentImage"
+}}`
+
+func TestLimits(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/object_info/EmptyLatentImage", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sampleEmptyLatentImage)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	limits, err := c.Limits(context.Background())
+	if err != nil {
+		t.Fatalf("Limits: %v", err)
+	}
+	want := ServerLimits{
+		Width:     NumberRange{Default: 512, Min: 16, Max: 16384, Step: 8},
+		Height:    NumberRange{Default: 512, Min: 16, Max: 16384, Step: 8},
+		BatchSize: NumberRange{Default: 1, Min: 1, Max: 4096},
+	}
+	if *limits != want {
+		t.Errorf("Limits = %+v, want %+v", *limits, want)
+	}
+
+	tests := []struct {
+		v    float64
+		want bool
+	}{
+		{1024, true},
+		{16, true},
+		{1020, false},
+		{8, false},
+		{16392, false},
+	}
+	for _, tt := range tests {
+		if got := limits.Width.Contains(tt.v); got != tt.want {
+			t.Errorf("Width.Contains(%v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestInputRange(t *testing.T) {
+	node := &NodeObject{Input: &NodeObjectInput{
+		Required: map[string]interface{}{
+			"cfg":       []interface{}{"FLOAT", map[string]interface{}{"default": 8.0, "step": 0.1}},
+			"ckpt_name": []interface{}{[]interface{}{"a.safetensors"}},
+			"text":      []interface{}{"STRING", map[string]interface{}{"multiline": true}},
+		},
+		Optional: map[string]interface{}{
+			"denoise": []interface{}{"FLOAT", map[string]interface{}{"default": 1.0, "min": 0.0, "max": 1.0}},
+		},
+	}}
+
+	if r, ok := node.InputRange("cfg"); !ok || r.Default != 8 || !math.IsInf(r.Max, 1) || r.Step != 0.1 {
+		t.Errorf("InputRange(cfg) = %+v, %v, want an unbounded range", r, ok)
+	}
+	if r, ok := node.InputRange("denoise"); !ok || r.Max != 1 {
+		t.Errorf("InputRange(denoise) = %+v, %v, want the optional input", r, ok)
+	}
+	for _, name := range []string{"ckpt_name", "text", "missing"} {
+		if _, ok := node.InputRange(name); ok {
+			t.Errorf("InputRange(%s) is a range", name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// metadataExtraKey is the extra_data key prompt metadata is stored under, the server keeps it in history
+	metadataExtraKey = "client_metadata"
+	// clientLabelExtraKey is the extra_data key the label of WithClientLabel is stored under
+	clientLabelExtraKey = "client_label"
+)
+
+type promptMetadataKey struct{}
+
+// ContextWithPromptMetadata returns a context whose prompts are queued with the key set in their metadata
+// The metadata is stored in extra_data and kept in history by the server, so a prompt can be found with
+// FindPromptByMetadata even after a restart of the caller, e.g. by the id of the caller's job
+// It applies to QueuePrompt, QueuePromptWithExtra, QueuePromptFront and RunWorkflow
+func ContextWithPromptMetadata(ctx context.Context, key, value string) context.Context {
+	parent := promptMetadataFromContext(ctx)
+	metadata := make(map[string]string, len(parent)+1)
+	for k, v := range parent {
+		metadata[k] = v
+	}
+	metadata[key] = value
+	return context.WithValue(ctx, promptMetadataKey{}, metadata)
+}
+
+func promptMetadataFromContext(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(promptMetadataKey{}).(map[string]string)
+	return metadata
+}
+
+// withPromptMetadata returns the extra data with the metadata of ctx added, extraData itself is not changed
+func withPromptMetadata(ctx context.Context, extraData map[string]interface{}) map[string]interface{} {
+	metadata := promptMetadataFromContext(ctx)
+	if len(metadata) == 0 {
+		return extraData
+	}
+	return withExtra(extraData, metadataExtraKey, metadata)
+}
+
+// withExtra returns a copy of the extra data with the key set
+func withExtra(extraData map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(extraData)+1)
+	for k, v := range extraData {
+		merged[k] = v
+	}
+	merged[key] = value
+	return merged
+}
+
+// Metadata returns the metadata the prompt was queued with, see ContextWithPromptMetadata
+func (n *NodeInfo) Metadata() map[string]string {
+	var extra struct {
+		Metadata map[string]string `json:"client_metadata"`
+	}
+	if len(n.ExtraData) == 0 || json.Unmarshal(n.ExtraData, &extra) != nil {
+		return nil
+	}
+	return extra.Metadata
+}
+
+// errHistoryFound stops StreamHistory once the entry is found
+var errHistoryFound = errors.New("history entry found")
+
+// FindPromptByMetadata returns the first history entry whose metadata has the key set to value
+// It reports false when no entry matches
+func (c *Client) FindPromptByMetadata(ctx context.Context, key, value string) (*PromptHistoryItem, bool, error) {
+	var found *PromptHistoryItem
+	err := c.StreamHistory(ctx, func(item *PromptHistoryItem) error {
+		if item.NodeInfo == nil {
+			return nil
+		}
+		if v, exist := item.NodeInfo.Metadata()[key]; exist && v == value {
+			found = item
+			return errHistoryFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errHistoryFound) {
+		return nil, false, fmt.Errorf("c.StreamHistory: error: %w", err)
+	}
+	return found, found != nil, nil
+}
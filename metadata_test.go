@@ -0,0 +1,79 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// serveHistoryFromPrompts makes /history report every queued prompt with the extra data it was queued with,
+// /history/{prompt_id} reports the one prompt
+func serveHistoryFromPrompts(m *mockServer) {
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		only := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/history"), "/")
+		history := make(map[string]interface{})
+		for i, body := range m.promptBodies() {
+			promptID := fmt.Sprintf("prompt-%d", i+1)
+			if only != "" && only != promptID {
+				continue
+			}
+			extraData := body["extra_data"]
+			if extraData == nil {
+				extraData = map[string]interface{}{}
+			}
+			history[promptID] = map[string]interface{}{
+				"prompt":  []interface{}{i + 1, promptID, body["prompt"], extraData, []string{}},
+				"outputs": map[string]interface{}{},
+				"status":  map[string]interface{}{"status_str": "success", "completed": true, "messages": []interface{}{}},
+			}
+		}
+		json.NewEncoder(w).Encode(history)
+	}
+	m.mux.HandleFunc("/history", serve)
+	m.mux.HandleFunc("/history/", serve)
+}
+
+func TestFindPromptByMetadata(t *testing.T) {
+	m := newMockServer(t)
+	serveHistoryFromPrompts(m)
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	workflow := map[string]interface{}{"1": map[string]interface{}{"class_type": "SaveImage"}}
+
+	if _, err := c.QueuePrompt(context.Background(), workflow); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	ctx := ContextWithPromptMetadata(ContextWithPromptMetadata(context.Background(), "job", "job-42"), "tenant", "acme")
+	extraData := map[string]interface{}{"extra_pnginfo": map[string]interface{}{"workflow": "ui"}}
+	if _, err := c.QueuePromptWithExtra(ctx, workflow, extraData); err != nil {
+		t.Fatalf("QueuePromptWithExtra: %v", err)
+	}
+	if _, ok := extraData[metadataExtraKey]; ok {
+		t.Error("the extra data passed to QueuePromptWithExtra is changed")
+	}
+
+	item, ok, err := c.FindPromptByMetadata(context.Background(), "job", "job-42")
+	if err != nil || !ok {
+		t.Fatalf("FindPromptByMetadata = %v, %t, %v, want the second prompt", item, ok, err)
+	}
+	if item.PromptID != "prompt-2" {
+		t.Errorf("found %s, want prompt-2", item.PromptID)
+	}
+	if metadata := item.NodeInfo.Metadata(); metadata["tenant"] != "acme" {
+		t.Errorf("Metadata = %v, want both keys", metadata)
+	}
+	if _, ok := m.promptBodies()[1]["extra_data"].(map[string]interface{})["extra_pnginfo"]; !ok {
+		t.Error("extra_pnginfo is dropped when metadata is added")
+	}
+
+	for _, tt := range [][2]string{{"job", "job-43"}, {"missing", "job-42"}} {
+		if item, ok, err := c.FindPromptByMetadata(context.Background(), tt[0], tt[1]); err != nil || ok || item != nil {
+			t.Errorf("FindPromptByMetadata(%s, %s) = %v, %t, %v, want not found", tt[0], tt[1], item, ok, err)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package comfyUIclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// mockServer is a minimal ComfyUI server, it serves /ws and /prompt and lets tests add routes
+type mockServer struct {
+	*httptest.Server
+	mux *http.ServeMux
+
+	mu     sync.Mutex
+	conns  []*websocket.Conn
+	wsURLs []string
+	// wsHeaders are the handshake headers of the websocket connections
+	wsHeaders []http.Header
+	prompts   []map[string]interface{}
+	headers   []http.Header
+	// running and pending are the prompt ids /queue reports
+	running []string
+	pending []string
+	// owners maps a queued prompt id to the client id /queue reports in its extra data
+	owners map[string]string
+	// calls records the POST requests to /queue and /interrupt as "path body"
+	calls   []string
+	promptN int
+	// onPrompt is called before /prompt responds, so the messages it sends may arrive before the prompt id
+	onPrompt func(promptID string, body map[string]interface{})
+	// silentWS skips the initial status message
+	silentWS bool
+	// received are the text frames the clients sent over the websocket
+	received []string
+}
+
+func newMockServer(t *testing.T) *mockServer {
+	t.Helper()
+	m := &mockServer{mux: http.NewServeMux()}
+	m.mux.HandleFunc("/ws", m.serveWS)
+	m.mux.HandleFunc("/prompt", m.servePrompt)
+	m.mux.HandleFunc("/queue", m.serveQueue)
+	m.mux.HandleFunc("/interrupt", m.serveInterrupt)
+	m.Server = httptest.NewServer(m.mux)
+	t.Cleanup(func() {
+		m.closeConns()
+		m.Server.Close()
+	})
+	return m
+}
+
+func (m *mockServer) serveWS(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.conns = append(m.conns, conn)
+	m.wsURLs = append(m.wsURLs, r.URL.String())
+	m.wsHeaders = append(m.wsHeaders, r.Header.Clone())
+	if !m.silentWS {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+			`{"type":"status","data":{"status":{"exec_info":{"queue_remaining":0}},"sid":%q}}`,
+			r.URL.Query().Get("clientId"))))
+	}
+	m.mu.Unlock()
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType == websocket.TextMessage {
+			m.mu.Lock()
+			m.received = append(m.received, string(message))
+			m.mu.Unlock()
+		}
+	}
+}
+
+func (m *mockServer) servePrompt(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		fmt.Fprint(w, `{"exec_info":{"queue_remaining":0}}`)
+		return
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	m.mu.Lock()
+	m.promptN++
+	number := m.promptN
+	promptID := fmt.Sprintf("prompt-%d", number)
+	m.prompts = append(m.prompts, body)
+	m.headers = append(m.headers, r.Header.Clone())
+	onPrompt := m.onPrompt
+	m.mu.Unlock()
+
+	if onPrompt != nil {
+		onPrompt(promptID, body)
+	}
+	fmt.Fprintf(w, `{"prompt_id":%q,"number":%d,"node_errors":{}}`, promptID, number)
+}
+
+func (m *mockServer) serveQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		m.recordCall(r)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	items := func(promptIDs []string) []interface{} {
+		result := make([]interface{}, 0, len(promptIDs))
+		for i, promptID := range promptIDs {
+			extraData := map[string]interface{}{}
+			if owner, exist := m.owners[promptID]; exist {
+				extraData["client_id"] = owner
+			}
+			result = append(result, []interface{}{i, promptID, map[string]interface{}{}, extraData, []string{}})
+		}
+		return result
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"queue_running": items(m.running),
+		"queue_pending": items(m.pending),
+	})
+}
+
+func (m *mockServer) serveInterrupt(w http.ResponseWriter, r *http.Request) {
+	m.recordCall(r)
+}
+
+func (m *mockServer) recordCall(r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, strings.TrimSpace(r.URL.Path+" "+string(body)))
+}
+
+// setQueue sets the prompt ids /queue reports as running and pending
+func (m *mockServer) setQueue(running, pending []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running = running
+	m.pending = pending
+}
+
+// setQueueOwner sets the client id /queue reports for the prompt
+func (m *mockServer) setQueueOwner(promptID, clientID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owners == nil {
+		m.owners = make(map[string]string)
+	}
+	m.owners[promptID] = clientID
+}
+
+// recordedCalls returns the POST requests to /queue and /interrupt
+func (m *mockServer) recordedCalls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.calls...)
+}
+
+// setSilentWS makes new websocket connections skip the initial status message, so no sid is delivered
+func (m *mockServer) setSilentWS() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.silentWS = true
+}
+
+// promptBodies returns the bodies posted to /prompt
+func (m *mockServer) promptBodies() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]map[string]interface{}(nil), m.prompts...)
+}
+
+// promptHeaders returns the headers of the requests posted to /prompt
+func (m *mockServer) promptHeaders() []http.Header {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]http.Header(nil), m.headers...)
+}
+
+// send writes a text frame to the latest websocket connection
+func (m *mockServer) send(t *testing.T, msg string) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.conns) == 0 {
+		t.Fatal("no websocket connection")
+	}
+	if err := m.conns[len(m.conns)-1].WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Errorf("WriteMessage: %v", err)
+	}
+}
+
+// sendBinary writes a binary frame to the latest websocket connection
+func (m *mockServer) sendBinary(t *testing.T, b []byte) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.conns) == 0 {
+		t.Fatal("no websocket connection")
+	}
+	if err := m.conns[len(m.conns)-1].WriteMessage(websocket.BinaryMessage, b); err != nil {
+		t.Errorf("WriteMessage: %v", err)
+	}
+}
+
+// wsRequestURL returns the request url of the i-th websocket connection
+func (m *mockServer) wsRequestURL(i int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.wsURLs[i]
+}
+
+// wsHeader returns the handshake headers of the i-th websocket connection
+func (m *mockServer) wsHeader(i int) http.Header {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.wsHeaders[i]
+}
+
+// receivedFrames returns the text frames the clients sent over the websocket
+func (m *mockServer) receivedFrames() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.received...)
+}
+
+// connCount returns how many websocket connections the server accepted
+func (m *mockServer) connCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+func (m *mockServer) closeConns() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+}
+
+// newConnectedClient creates a client for the server and waits until its websocket is connected
+func newConnectedClient(t *testing.T, m *mockServer, opts ...ClientOption) *Client {
+	t.Helper()
+	c, err := NewDefaultClientStr(m.URL, opts...)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	c.ConnectAndListen()
+	t.Cleanup(func() { c.webSocket.Shutdown() })
+
+	waitFor(t, "websocket connection", c.IsInitialized)
+	m.mu.Lock()
+	silent := m.silentWS
+	m.mu.Unlock()
+	if !silent {
+		waitFor(t, "session id", func() bool { return c.SessionID() != "" })
+	}
+	return c
+}
+
+// waitFor polls cond until it is true or fails the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// receive returns the next message of the task status channel
+func receive(t *testing.T, c *Client) *WSMessage {
+	t.Helper()
+	select {
+	case message := <-c.GetTaskStatus():
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a task status message")
+		return nil
+	}
+}
@@ -0,0 +1,97 @@
+package comfyUIclient
+
+import (
+	"reflect"
+	"sort"
+)
+
+// ObjectInfoDiff lists the node classes and inputs which differ between two object info snapshots
+type ObjectInfoDiff struct {
+	AddedNodes   []string
+	RemovedNodes []string
+	// ChangedNodes holds the input changes of node classes present in both snapshots
+	ChangedNodes map[string]*NodeInputDiff
+}
+
+// NodeInputDiff lists the inputs of a node class which differ between two snapshots
+// An input moved between required and optional or with another config is changed
+type NodeInputDiff struct {
+	AddedInputs   []string
+	RemovedInputs []string
+	ChangedInputs []string
+}
+
+// IsEmpty reports whether the snapshots are compatible
+func (d ObjectInfoDiff) IsEmpty() bool {
+	return len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 && len(d.ChangedNodes) == 0
+}
+
+// DiffObjectInfo compares two object info snapshots, e.g. before and after upgrading ComfyUI
+func DiffObjectInfo(oldInfos, newInfos map[string]*NodeObject) ObjectInfoDiff {
+	diff := ObjectInfoDiff{ChangedNodes: make(map[string]*NodeInputDiff)}
+	for name, newInfo := range newInfos {
+		oldInfo, exist := oldInfos[name]
+		if !exist {
+			diff.AddedNodes = append(diff.AddedNodes, name)
+			continue
+		}
+		if inputDiff := diffNodeInputs(oldInfo, newInfo); inputDiff != nil {
+			diff.ChangedNodes[name] = inputDiff
+		}
+	}
+	for name := range oldInfos {
+		if _, exist := newInfos[name]; !exist {
+			diff.RemovedNodes = append(diff.RemovedNodes, name)
+		}
+	}
+	sort.Strings(diff.AddedNodes)
+	sort.Strings(diff.RemovedNodes)
+	return diff
+}
+
+func diffNodeInputs(oldInfo, newInfo *NodeObject) *NodeInputDiff {
+	oldInputs, newInputs := nodeInputs(oldInfo), nodeInputs(newInfo)
+	diff := &NodeInputDiff{}
+	for name, newInput := range newInputs {
+		oldInput, exist := oldInputs[name]
+		switch {
+		case !exist:
+			diff.AddedInputs = append(diff.AddedInputs, name)
+		case !reflect.DeepEqual(oldInput, newInput):
+			diff.ChangedInputs = append(diff.ChangedInputs, name)
+		}
+	}
+	for name := range oldInputs {
+		if _, exist := newInputs[name]; !exist {
+			diff.RemovedInputs = append(diff.RemovedInputs, name)
+		}
+	}
+
+	if len(diff.AddedInputs) == 0 && len(diff.RemovedInputs) == 0 && len(diff.ChangedInputs) == 0 {
+		return nil
+	}
+	sort.Strings(diff.AddedInputs)
+	sort.Strings(diff.RemovedInputs)
+	sort.Strings(diff.ChangedInputs)
+	return diff
+}
+
+type nodeInput struct {
+	required bool
+	config   interface{}
+}
+
+// nodeInputs merges the required and optional inputs of a node by name
+func nodeInputs(info *NodeObject) map[string]nodeInput {
+	inputs := make(map[string]nodeInput)
+	if info == nil || info.Input == nil {
+		return inputs
+	}
+	for name, config := range info.Input.Required {
+		inputs[name] = nodeInput{required: true, config: config}
+	}
+	for name, config := range info.Input.Optional {
+		inputs[name] = nodeInput{config: config}
+	}
+	return inputs
+}
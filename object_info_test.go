@@ -0,0 +1,118 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDiffObjectInfo(t *testing.T) {
+	oldInfos := map[string]*NodeObject{
+		"KSampler": {Input: &NodeObjectInput{
+			Required: map[string]interface{}{
+				"seed":    []interface{}{"INT", map[string]interface{}{"max": 1000}},
+				"steps":   []interface{}{"INT"},
+				"cfg":     []interface{}{"FLOAT"},
+				"denoise": []interface{}{"FLOAT"},
+			},
+		}},
+		"SaveImage":   {Input: &NodeObjectInput{Required: map[string]interface{}{"images": []interface{}{"IMAGE"}}}},
+		"OldUpscaler": {},
+		"VAEDecode":   {Input: &NodeObjectInput{Required: map[string]interface{}{"vae": []interface{}{"VAE"}}}},
+	}
+	newInfos := map[string]*NodeObject{
+		"KSampler": {Input: &NodeObjectInput{
+			Required: map[string]interface{}{
+				"seed":  []interface{}{"INT", map[string]interface{}{"max": 2000}},
+				"steps": []interface{}{"INT"},
+			},
+			Optional: map[string]interface{}{
+				"cfg":       []interface{}{"FLOAT"},
+				"scheduler": []interface{}{"STRING"},
+			},
+		}},
+		"SaveImage":   {Input: &NodeObjectInput{Required: map[string]interface{}{"images": []interface{}{"IMAGE"}}}},
+		"NewUpscaler": {},
+		"VAEDecode":   {Input: &NodeObjectInput{Required: map[string]interface{}{"vae": []interface{}{"VAE"}}}},
+	}
+
+	diff := DiffObjectInfo(oldInfos, newInfos)
+	if diff.IsEmpty() {
+		t.Fatal("diff of different snapshots is empty")
+	}
+	if !reflect.DeepEqual(diff.AddedNodes, []string{"NewUpscaler"}) {
+		t.Errorf("added nodes = %v, want NewUpscaler", diff.AddedNodes)
+	}
+	if !reflect.DeepEqual(diff.RemovedNodes, []string{"OldUpscaler"}) {
+		t.Errorf("removed nodes = %v, want OldUpscaler", diff.RemovedNodes)
+	}
+	if len(diff.ChangedNodes) != 1 {
+		t.Fatalf("changed nodes = %v, want only KSampler", diff.ChangedNodes)
+	}
+	want := &NodeInputDiff{AddedInputs: []string{"scheduler"}, RemovedInputs: []string{"denoise"}, ChangedInputs: []string{"cfg", "seed"}}
+	if got := diff.ChangedNodes["KSampler"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("KSampler diff = %+v, want %+v", got, want)
+	}
+
+	if !DiffObjectInfo(newInfos, newInfos).IsEmpty() {
+		t.Error("diff of a snapshot with itself is not empty")
+	}
+}
+
+func TestStreamObjectInfo(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/object_info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+  "CheckpointLoaderSimple": {"input": {"required": {"ckpt_name": [["a.safetensors"]]}}, "output": ["MODEL", "CLIP", "VAE"], "name": "CheckpointLoaderSimple"},
+  "EmptyLatentImage": {"input": {"required": {"width": ["INT", {"default": 512}]}}, "output": ["LATENT"], "name": "EmptyLatentImage"},
+  "KSampler": {"input": {"required": {"seed": ["INT", {"default": 0}]}}, "output": ["LATENT"], "name": "KSampler"},
+  "SaveImage": {"input": {"required": {"images": ["IMAGE"]}}, "output": [], "name": "SaveImage", "output_node": true}
+}`)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	var classes []string
+	err = c.StreamObjectInfo(context.Background(), func(nodeClass string, info *NodeObject) error {
+		if info.Name != nodeClass {
+			t.Errorf("node class %s has info of %s", nodeClass, info.Name)
+		}
+		classes = append(classes, nodeClass)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamObjectInfo: %v", err)
+	}
+	if want := []string{"CheckpointLoaderSimple", "EmptyLatentImage", "KSampler", "SaveImage"}; !reflect.DeepEqual(classes, want) {
+		t.Errorf("streamed %v, want %v", classes, want)
+	}
+
+	errStop := errors.New("stop")
+	classes = nil
+	err = c.StreamObjectInfo(context.Background(), func(nodeClass string, info *NodeObject) error {
+		classes = append(classes, nodeClass)
+		if nodeClass == "EmptyLatentImage" {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || len(classes) != 2 {
+		t.Errorf("StreamObjectInfo = %v after %v, want to stop at EmptyLatentImage", err, classes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	classes = nil
+	err = c.StreamObjectInfo(ctx, func(nodeClass string, info *NodeObject) error {
+		classes = append(classes, nodeClass)
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || len(classes) != 1 {
+		t.Errorf("StreamObjectInfo = %v after %v, want to stop once ctx is cancelled", err, classes)
+	}
+}
@@ -0,0 +1,393 @@
+package comfyUIclient
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClientOption configures a Client, it is applied by NewClient before the websocket connection is created
+type ClientOption func(*Client)
+
+// WithClientID sets the client id used for the websocket session and the client_id of prompts
+// A random one is generated when it is not set or empty
+func WithClientID(id string) ClientOption {
+	return func(c *Client) {
+		c.ID = id
+	}
+}
+
+// WithPersistentClientID loads the client id with loader and saves a generated one with saver, so a restarted
+// process reattaches to its session and can recover the prompts it was waiting for, e.g. with WaitForPrompt
+// loader returns an empty id when none is saved yet, a client id set by WithClientID takes precedence
+func WithPersistentClientID(loader func() string, saver func(string)) ClientOption {
+	return func(c *Client) {
+		c.clientIDLoader = loader
+		c.clientIDSaver = saver
+	}
+}
+
+// WithAPIPrefix prepends "/api" to all REST routers and the websocket router
+// Newer ComfyUI serves every route under both "/" and "/api"
+func WithAPIPrefix(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.apiPrefix = enabled
+	}
+}
+
+// WithStrictSessionFilter makes the client ignore status messages whose sid does not match its session
+// It keeps the queue count and the session id from being changed by other sessions on a shared websocket
+// Only status messages carry a sid, execution events are not isolated by it, they are routed by prompt id
+func WithStrictSessionFilter() ClientOption {
+	return func(c *Client) {
+		c.strictSessionFilter = true
+	}
+}
+
+// WithTaskStatusBufferSize sets the buffer size of the task status channel, the default is unbuffered
+func WithTaskStatusBufferSize(size int) ClientOption {
+	return func(c *Client) {
+		c.chSize = size
+	}
+}
+
+// WithChannelOverflowPolicy sets what happens when the task status channel is full
+// The default OverflowBlock keeps every message but lets a slow consumer stall the listen loop,
+// the drop policies keep the listen loop healthy and count the dropped messages in DroppedMessages
+func WithChannelOverflowPolicy(policy OverflowPolicy) ClientOption {
+	return func(c *Client) {
+		c.overflowPolicy = policy
+	}
+}
+
+// WithRunConcurrency bounds the number of workflows RunWorkflows runs at once
+func WithRunConcurrency(n int) ClientOption {
+	return func(c *Client) {
+		c.runConcurrency = n
+	}
+}
+
+// WithPromptInterceptor sets a hook which is called with every workflow before it is sent to /prompt
+// It lets a platform audit workflows or enforce policies on them in one place
+func WithPromptInterceptor(interceptor PromptInterceptor) ClientOption {
+	return func(c *Client) {
+		c.promptInterceptor = interceptor
+	}
+}
+
+// WithBinaryPreviews sends the binary preview frames to the task status channel as BinaryPreview messages
+func WithBinaryPreviews() ClientOption {
+	return func(c *Client) {
+		c.binaryPreviews = true
+	}
+}
+
+// WithSessionGate makes QueuePrompt wait up to timeout for the first status message which carries the sid
+// of the websocket session, and queue prompts with that sid
+// A prompt queued before the server knows the session would never have its events routed back
+func WithSessionGate(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.sessionTimeout = timeout
+	}
+}
+
+// WithUserID sets the user id sent in the Comfy-User header of every HTTP request
+// Multi-user ComfyUI namespaces histories and outputs by user, so history and view requests need it
+func WithUserID(id string) ClientOption {
+	return func(c *Client) {
+		c.userID = id
+	}
+}
+
+// WithReadDeadline makes the websocket reconnect when no frame arrives within d
+// Every frame resets the deadline, so it detects silent hangs even when the server does not answer pings
+func WithReadDeadline(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(w *WebSocketConnection) {
+			w.ReadTimeout = d
+		})
+	}
+}
+
+// WithHandlerTimeout bounds how long the listen loop waits for each message to be handled
+// It is a safety valve against a consumer which stalls the read loop, at the cost of message ordering
+// once a call times out
+func WithHandlerTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(w *WebSocketConnection) {
+			w.HandlerTimeout = d
+		})
+	}
+}
+
+// WithPool adds the client to the pool, its listen loop and dispatch workers then count against the limit
+// of the pool
+func WithPool(pool *Pool) ClientOption {
+	return func(c *Client) {
+		pool.add(c)
+		c.wsOpts = append(c.wsOpts, func(w *WebSocketConnection) {
+			w.Limiter = pool.limiter
+		})
+	}
+}
+
+// WithRecorder records every websocket frame the client receives to w, see Recorder
+func WithRecorder(w io.Writer) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			ws.handler = NewRecorder(w, ws.handler)
+		})
+	}
+}
+
+// WithCircuitBreaker makes HTTP calls fail fast with ErrCircuitOpen after failures consecutive failures,
+// until cooldown elapses and a trial request succeeds
+// Transport errors and 5xx responses count as failures, failures <= 0 disables the breaker
+func WithCircuitBreaker(failures int, cooldown time.Duration) ClientOption {
+	return func(c *Client) {
+		if failures <= 0 {
+			c.breaker = nil
+			return
+		}
+		c.breaker = newCircuitBreaker(failures, cooldown)
+	}
+}
+
+// WithDialBackoff sets the exponential backoff between the dial attempts of the websocket
+// initial is the delay before the first retry and max caps it
+func WithDialBackoff(initial, max time.Duration) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			ws.DialBackoff = initial
+			ws.MaxDialBackoff = max
+		})
+	}
+}
+
+// WithMessageFilter drops the messages filter returns false for as soon as they are read, before any handler runs
+// Filtered messages never reach the client, keep status and the execution messages to use the session state,
+// RunWorkflow and WaitForPrompt
+func WithMessageFilter(filter func(WSMessage) bool) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			ws.MessageFilter = filter
+		})
+	}
+}
+
+// WithTokenProvider refreshes the bearer token when the websocket handshake is rejected as unauthorized
+// The refreshed token is used by the later HTTP calls too, a call which already failed returns ErrUnauthorized
+func WithTokenProvider(provider func(ctx context.Context) (string, error)) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			ws.TokenProvider = func(ctx context.Context) (string, error) {
+				token, err := provider(ctx)
+				if err == nil {
+					c.setHTTPBearerToken(token)
+				}
+				return token, err
+			}
+		})
+	}
+}
+
+// WithInterruptOnDisconnect interrupts the prompt this client was running when the websocket drops unexpectedly,
+// so no GPU work is left behind for a client which is gone
+// It is destructive, the prompt is lost even if the connection comes back
+func WithInterruptOnDisconnect() ClientOption {
+	return func(c *Client) {
+		c.interruptOnDisconnect = true
+	}
+}
+
+// WithWireTrace writes a line for every websocket frame sent or received to w,
+// with its direction, kind, size and the start of its payload
+func WithWireTrace(w io.Writer) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			ws.WireTrace = w
+		})
+	}
+}
+
+// WithOnQueueUpdated calls fn with the queue servers which push queue_updated or queue messages send, so a
+// dashboard follows the queue without polling /queue
+// fn is called from the listen loop and should return quickly
+func WithOnQueueUpdated(fn func(queue *WSMessageDataQueueUpdated)) ClientOption {
+	return func(c *Client) {
+		c.onQueueUpdated = fn
+	}
+}
+
+// WithVersionCheck checks the ComfyUI version of the server once the websocket session is ready, see
+// CheckServerVersion
+// An untested version is passed to warn, with a nil warn it is logged
+func WithVersionCheck(warn func(err *UntestedVersionError)) ClientOption {
+	return func(c *Client) {
+		c.versionCheck = true
+		c.versionWarning = warn
+	}
+}
+
+// WithOnReconnect calls fn after the websocket reconnected and the prompts waited for were recovered from history
+// The event reports the downtime and how many terminal messages were recovered, to debug lost messages
+func WithOnReconnect(fn func(event ReconnectEvent)) ClientOption {
+	return func(c *Client) {
+		c.onReconnect = fn
+	}
+}
+
+// WithExpvar publishes the stats of the connection with expvar, under ExpvarName keyed by the websocket url:
+// whether it is connected, its reconnects, the received messages by type and the errors of handling them
+func WithExpvar() ClientOption {
+	return func(c *Client) {
+		c.stats = &connectionStats{}
+	}
+}
+
+// WithSubscriptionTTL drops the state the client keeps per prompt ttl after the prompt finished, such as the
+// timings of WithTimingTracker, the trace of WithExecutionTrace and the routing of its messages
+// It bounds the memory of a long lived client which handles many prompts; messages of the prompt which arrive
+// after the ttl are handled like the ones of a prompt the client does not know
+func WithSubscriptionTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.subscriptionTTL = ttl
+	}
+}
+
+// WithTracer starts a span of tracer for every prompt the client submits, with the execution messages of the
+// prompt as events; the span ends with the prompt and its status is the error of the prompt
+// Messages which arrive before the server answers the submission are not added to the span
+func WithTracer(tracer Tracer) ClientOption {
+	return func(c *Client) {
+		c.spans = newPromptSpans(tracer)
+	}
+}
+
+// WithTimingTracker feeds the execution messages of the client to tracker, including the ones RunWorkflow consumes
+func WithTimingTracker(tracker *TimingTracker) ClientOption {
+	return func(c *Client) {
+		c.timingTracker = tracker
+	}
+}
+
+// WithProgressTracker feeds the execution messages of the client to tracker, including the ones RunWorkflow
+// consumes, and tells it the nodes of every prompt the client queues
+func WithProgressTracker(tracker *ProgressTracker) ClientOption {
+	return func(c *Client) {
+		c.progressTracker = tracker
+	}
+}
+
+// WithExecutionTrace feeds the execution messages of the client to trace, including the ones RunWorkflow consumes
+func WithExecutionTrace(trace *ExecutionTrace) ClientOption {
+	return func(c *Client) {
+		c.executionTrace = trace
+	}
+}
+
+// WithProgressCoalesce forwards the progress of a prompt at most once per minInterval to the subscriptions and
+// the task status channel, progress arriving in between is replaced by the latest one
+// The final progress of a node is always forwarded
+func WithProgressCoalesce(minInterval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.progressCoalescer = newProgressCoalescer(minInterval, c.dispatch)
+	}
+}
+
+// WithOOMRetry makes RunWorkflow free the server memory and resubmit a prompt which fails with an out of memory
+// error, up to maxRetries times
+// Other errors are returned as is
+func WithOOMRetry(maxRetries int) ClientOption {
+	return func(c *Client) {
+		c.oomRetries = maxRetries
+	}
+}
+
+// WithInsecureSkipVerify skips the verification of the server certificate for both HTTP and the websocket
+// It is INSECURE, a man in the middle can read and change all traffic, only use it for a local server with
+// a self-signed certificate
+// The transport of the HTTP client is copied, the one passed to NewClient is not changed, a transport other than
+// *http.Transport is left as is
+func WithInsecureSkipVerify() ClientOption {
+	return func(c *Client) {
+		transport, ok := c.httpClient.Transport.(*http.Transport)
+		if c.httpClient.Transport == nil {
+			transport, ok = http.DefaultTransport.(*http.Transport)
+		}
+		if ok {
+			transport = transport.Clone()
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.InsecureSkipVerify = true
+			httpClient := *c.httpClient
+			httpClient.Transport = transport
+			c.httpClient = &httpClient
+		}
+
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			dialer := *websocket.DefaultDialer
+			if ws.Dialer != nil {
+				dialer = *ws.Dialer
+			}
+			if dialer.TLSClientConfig == nil {
+				dialer.TLSClientConfig = &tls.Config{}
+			} else {
+				dialer.TLSClientConfig = dialer.TLSClientConfig.Clone()
+			}
+			dialer.TLSClientConfig.InsecureSkipVerify = true
+			ws.Dialer = &dialer
+		})
+	}
+}
+
+// WithClientLabel sets a human readable label, e.g. the hostname, which the server side can identify the client by
+// It is sent in the ClientLabelHeader of HTTP requests and the websocket handshake, and in the extra_data of
+// prompts, which the queue and history report
+func WithClientLabel(label string) ClientOption {
+	return func(c *Client) {
+		if label == "" {
+			return
+		}
+		c.clientLabel = label
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			if ws.Header == nil {
+				ws.Header = make(http.Header)
+			}
+			ws.Header.Set(ClientLabelHeader, label)
+		})
+	}
+}
+
+// WithHeartbeat sends payload as a JSON text frame over the websocket every interval, for proxies which expect
+// application messages rather than websocket pings and close idle connections otherwise
+func WithHeartbeat(interval time.Duration, payload interface{}) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			ws.HeartbeatInterval = interval
+			ws.HeartbeatPayload = payload
+		})
+	}
+}
+
+// WithDownloadRetries makes DownloadOutput resume a download which breaks off, up to retries times
+// The rest is requested with a Range header if the server accepts ranges, otherwise the file is downloaded again
+func WithDownloadRetries(retries int) ClientOption {
+	return func(c *Client) {
+		c.downloadRetries = retries
+	}
+}
+
+// WithReconnectInterval sets how often the websocket is checked and reconnected after it drops
+func WithReconnectInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.wsOpts = append(c.wsOpts, func(ws *WebSocketConnection) {
+			ws.ReconnectInterval = d
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package comfyUIclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// NodeOutputFile is an output file with the node which produced it
+type NodeOutputFile struct {
+	NodeID string
+	File   *DataOutputFile
+}
+
+// OrderOutputs flattens outputs keyed by node id into a stable order, by node id then filename
+// Node ids are compared numerically, so node 2 comes before node 10
+func OrderOutputs(outputs map[string][]*DataOutputFile) []NodeOutputFile {
+	var ordered []NodeOutputFile
+	for nodeID, files := range outputs {
+		for _, file := range files {
+			ordered = append(ordered, NodeOutputFile{NodeID: nodeID, File: file})
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].NodeID != ordered[j].NodeID {
+			return naturalLess(ordered[i].NodeID, ordered[j].NodeID)
+		}
+		return ordered[i].File.Filename < ordered[j].File.Filename
+	})
+	return ordered
+}
+
+// OrderedOutputs returns the outputs of the run in a stable order, see OrderOutputs
+func (r *RunResult) OrderedOutputs() []NodeOutputFile {
+	return OrderOutputs(r.Outputs)
+}
+
+// VerifyOutputs returns the subset of outputs the server still serves, checked with a HEAD request to /view
+// Files which are gone, e.g. temp files the server already cleaned up, are dropped, as are nodes left without
+// files; files the server sent inline are kept without a request
+func (c *Client) VerifyOutputs(ctx context.Context, outputs map[string][]*DataOutputFile) (map[string][]*DataOutputFile, error) {
+	exist := make(map[string][]*DataOutputFile, len(outputs))
+	for nodeID, files := range outputs {
+		for _, file := range files {
+			ok, err := c.outputExists(ctx, file)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				exist[nodeID] = append(exist[nodeID], file)
+			}
+		}
+	}
+	return exist, nil
+}
+
+// outputExists asks /view whether the file exists without downloading it
+func (c *Client) outputExists(ctx context.Context, file *DataOutputFile) (bool, error) {
+	if _, ok := file.InlineData(); ok {
+		return true, nil
+	}
+
+	params := url.Values{}
+	params.Add("filename", file.Filename)
+	params.Add("subfolder", file.SubFolder)
+	params.Add("type", file.Type)
+	resp, err := c.makeRequest(ctx, http.MethodHead, string(ViewRouter), params, nil, nil, "")
+	if err != nil {
+		return false, fmt.Errorf("c.makeRequest: error: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("verify %s: unexpected status code: %d", file.Filename, resp.StatusCode)
+	}
+}
+
+// naturalLess compares the runs of digits of a and b as numbers and the rest as text,
+// e.g. "2" < "10" and "5.2.1" < "5.10"
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		aDigits, bDigits := isDigit(a[0]), isDigit(b[0])
+		if aDigits != bDigits {
+			return aDigits
+		}
+		var aChunk, bChunk string
+		aChunk, a = splitChunk(a, aDigits)
+		bChunk, b = splitChunk(b, bDigits)
+		if aChunk == bChunk {
+			continue
+		}
+		if aDigits {
+			// numbers without leading zeros compare by length first
+			aNum, bNum := strings.TrimLeft(aChunk, "0"), strings.TrimLeft(bChunk, "0")
+			if len(aNum) != len(bNum) {
+				return len(aNum) < len(bNum)
+			}
+			if aNum != bNum {
+				return aNum < bNum
+			}
+			return len(aChunk) < len(bChunk)
+		}
+		return aChunk < bChunk
+	}
+	return len(a) < len(b)
+}
+
+// splitChunk splits off the leading run of digits or non digits of s
+func splitChunk(s string, digits bool) (chunk, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
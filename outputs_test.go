@@ -0,0 +1,100 @@
+package comfyUIclient
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestOrderOutputs(t *testing.T) {
+	file := func(name string) *DataOutputFile { return &DataOutputFile{Filename: name, Type: "output"} }
+	result := &RunResult{Outputs: map[string][]*DataOutputFile{
+		"10":    {file("b.png"), file("a.png")},
+		"2":     {file("c.png")},
+		"5.10":  {file("e.png")},
+		"5.2.1": {file("d.png")},
+		"save":  {file("f.png")},
+	}}
+
+	var got []string
+	for _, output := range result.OrderedOutputs() {
+		got = append(got, output.NodeID+"/"+output.File.Filename)
+	}
+	want := []string{"2/c.png", "5.2.1/d.png", "5.10/e.png", "10/a.png", "10/b.png", "save/f.png"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OrderedOutputs = %v, want %v", got, want)
+	}
+	if got := OrderOutputs(nil); len(got) != 0 {
+		t.Errorf("OrderOutputs(nil) = %v, want none", got)
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2", "10", true},
+		{"10", "2", false},
+		{"9", "9", false},
+		{"02", "2", false},
+		{"2", "02", true},
+		{"5.2", "5.10", true},
+		{"5", "5.1", true},
+		{"10", "a", true},
+		{"node2", "node10", true},
+	}
+	for _, tt := range tests {
+		if got := naturalLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalLess(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyOutputs(t *testing.T) {
+	m := newMockServer(t)
+	var mu sync.Mutex
+	var methods []string
+	m.mux.HandleFunc("/view", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		if r.URL.Query().Get("filename") != "kept.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("png data"))
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	kept := &DataOutputFile{Filename: "kept.png", Type: "output"}
+	cleaned := &DataOutputFile{Filename: "ComfyUI_temp_00001_.png", Type: "temp"}
+	outputs := map[string][]*DataOutputFile{
+		"9":  {kept},
+		"12": {cleaned},
+	}
+	exist, err := c.VerifyOutputs(context.Background(), outputs)
+	if err != nil {
+		t.Fatalf("VerifyOutputs: %v", err)
+	}
+	want := map[string][]*DataOutputFile{"9": {kept}}
+	if !reflect.DeepEqual(exist, want) {
+		t.Errorf("VerifyOutputs = %v, want only kept.png", exist)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, method := range methods {
+		if method != http.MethodHead {
+			t.Errorf("/view is requested with %s, want HEAD", method)
+		}
+	}
+	if len(methods) != 2 {
+		t.Errorf("/view is requested %d times, want 2", len(methods))
+	}
+}
@@ -0,0 +1,110 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// GoroutineLimiter bounds the listen loops and dispatch workers of the connections sharing it, see Pool
+type GoroutineLimiter struct {
+	slots  chan struct{}
+	active atomic.Int64
+}
+
+// NewGoroutineLimiter returns a limiter allowing max goroutines at once, max below 1 allows one
+func NewGoroutineLimiter(max int) *GoroutineLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &GoroutineLimiter{slots: make(chan struct{}, max)}
+}
+
+// Active returns how many goroutines hold a slot
+func (l *GoroutineLimiter) Active() int {
+	return int(l.active.Load())
+}
+
+// Max returns how many goroutines may hold a slot at once
+func (l *GoroutineLimiter) Max() int {
+	return cap(l.slots)
+}
+
+// acquire waits for a slot until ctx or done is done
+func (l *GoroutineLimiter) acquire(ctx context.Context, done <-chan struct{}) bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.active.Add(1)
+		return true
+	case <-ctx.Done():
+		return false
+	case <-done:
+		return false
+	}
+}
+
+// tryAcquire takes a slot if one is free
+func (l *GoroutineLimiter) tryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.active.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *GoroutineLimiter) release() {
+	l.active.Add(-1)
+	<-l.slots
+}
+
+// Pool is a fleet of clients whose listen loops and dispatch workers share one GoroutineLimiter
+// A connected client waits for a slot before its listen loop starts, so its messages are only read once
+// a slot is free; a dispatch worker without a free slot handles its message in the listen loop instead
+type Pool struct {
+	limiter *GoroutineLimiter
+
+	mu      sync.Mutex
+	clients []*Client
+}
+
+// NewPool returns a pool allowing maxGoroutines listen loops and dispatch workers at once, add clients with WithPool
+func NewPool(maxGoroutines int) *Pool {
+	return &Pool{limiter: NewGoroutineLimiter(maxGoroutines)}
+}
+
+// Clients returns the clients of the pool
+func (p *Pool) Clients() []*Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Client(nil), p.clients...)
+}
+
+// Active returns how many listen loops and dispatch workers of the pool are running
+func (p *Pool) Active() int {
+	return p.limiter.Active()
+}
+
+// Limiter returns the limiter shared by the clients of the pool
+func (p *Pool) Limiter() *GoroutineLimiter {
+	return p.limiter
+}
+
+// Close closes every client of the pool
+func (p *Pool) Close() error {
+	var errs []error
+	for _, c := range p.Clients() {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pool) add(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients = append(p.clients, c)
+}
@@ -0,0 +1,102 @@
+package comfyUIclient
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolLimitsGoroutines(t *testing.T) {
+	m := newMockServer(t)
+	pool := NewPool(2)
+
+	var mu sync.Mutex
+	maxActive := 0
+	observe := func(next Handler) Handler {
+		return HandlerFunc(func(msg string) error {
+			mu.Lock()
+			if active := pool.Active(); active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			return next.Handle(msg)
+		})
+	}
+
+	clients := make([]*Client, 8)
+	for i := range clients {
+		c, err := NewDefaultClientStr(m.URL, WithPool(pool), WithHandlerTimeout(time.Second), WithTaskStatusBufferSize(16))
+		if err != nil {
+			t.Fatalf("NewDefaultClientStr: %v", err)
+		}
+		c.Use(observe)
+		c.ConnectAndListen()
+		t.Cleanup(func() { c.webSocket.Shutdown() })
+		clients[i] = c
+	}
+	if got := len(pool.Clients()); got != len(clients) {
+		t.Fatalf("Clients = %d, want %d", got, len(clients))
+	}
+	for _, c := range clients {
+		waitFor(t, "websocket connection", c.IsInitialized)
+	}
+
+	listening := func() []*Client {
+		var result []*Client
+		for _, c := range clients {
+			if c.SessionID() != "" {
+				result = append(result, c)
+			}
+		}
+		return result
+	}
+	waitFor(t, "two listening clients", func() bool { return len(listening()) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if got := len(listening()); got != 2 {
+		t.Fatalf("listening clients = %d, want 2", got)
+	}
+	if got := pool.Active(); got != 2 {
+		t.Fatalf("Active = %d, want 2", got)
+	}
+
+	// closing the listening clients frees their slots for the waiting ones
+	for _, c := range listening() {
+		c.Close()
+	}
+	waitFor(t, "four listening clients", func() bool { return len(listening()) == 4 })
+
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	waitFor(t, "no active goroutines", func() bool { return pool.Active() == 0 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxActive > pool.Limiter().Max() {
+		t.Errorf("max active = %d, want at most %d", maxActive, pool.Limiter().Max())
+	}
+}
+
+func TestGoroutineLimiterDispatchWithoutSlot(t *testing.T) {
+	limiter := NewGoroutineLimiter(1)
+	if !limiter.tryAcquire() {
+		t.Fatal("tryAcquire: want a slot")
+	}
+	handled := make(chan struct{}, 1)
+	w := &WebSocketConnection{
+		handler:        HandlerFunc(func(string) error { handled <- struct{}{}; return nil }),
+		HandlerTimeout: time.Second,
+		Limiter:        limiter,
+	}
+	// the only slot is taken, the message is handled in the calling goroutine
+	w.dispatch(1, []byte(`{"type":"status","data":{}}`))
+	select {
+	case <-handled:
+	default:
+		t.Fatal("message was not handled inline")
+	}
+	if got := limiter.Active(); got != 1 {
+		t.Errorf("Active = %d, want 1", got)
+	}
+}
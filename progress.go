@@ -0,0 +1,170 @@
+package comfyUIclient
+
+import "sync"
+
+// ProgressTracker computes the overall progress of the prompts whose messages it observes
+// Every node of a prompt counts with the weight of its node type, a node type without weight counts 1, so by
+// default all nodes count the same; the weights make slow nodes such as samplers count more, e.g. KSampler: 20
+// Pass it to WithProgressTracker to observe the messages of a client and learn the node types of its prompts
+type ProgressTracker struct {
+	weights map[string]float64
+
+	mu      sync.Mutex
+	prompts map[string]*promptProgress
+}
+
+// promptProgress is the progress of one prompt
+type promptProgress struct {
+	// nodeTypes are the class types of the nodes of the workflow, see Expect
+	nodeTypes map[string]string
+	// done is how much of every started node is done, from 0 to 1
+	done map[string]float64
+	// displayNode is the running node, as the workflow knows it
+	displayNode string
+	succeeded   bool
+}
+
+// NewProgressTracker returns a tracker weighting the nodes by their node type, nil weights all nodes the same
+func NewProgressTracker(weights map[string]float64) *ProgressTracker {
+	return &ProgressTracker{
+		weights: weights,
+		prompts: make(map[string]*promptProgress),
+	}
+}
+
+func (t *ProgressTracker) prompt(promptID string) *promptProgress {
+	p, exist := t.prompts[promptID]
+	if !exist {
+		p = &promptProgress{nodeTypes: make(map[string]string), done: make(map[string]float64)}
+		t.prompts[promptID] = p
+	}
+	return p
+}
+
+// Expect tells the tracker the nodes of the prompt, so the nodes which did not start yet count too
+func (t *ProgressTracker) Expect(promptID string, workflow map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.prompt(promptID)
+	for node, v := range workflow {
+		classType := ""
+		if fields, ok := v.(map[string]interface{}); ok {
+			classType, _ = fields["class_type"].(string)
+		}
+		p.nodeTypes[node] = classType
+	}
+}
+
+// Observe records the message, messages which are not about the execution of a prompt are ignored
+// Progress messages without prompt id belong to the prompt which runs, like on older servers
+func (t *ProgressTracker) Observe(message *WSMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch d := message.Data.(type) {
+	case *WSMessageDataExecutionStart:
+		t.prompt(d.PromptID)
+	case *WSMessageDataExecutionCached:
+		p := t.prompt(d.PromptID)
+		for _, node := range d.Nodes {
+			p.done[node] = 1
+		}
+	case *WSMessageDataExecuting:
+		p := t.prompt(d.PromptID)
+		if p.displayNode != "" {
+			p.done[p.displayNode] = 1
+		}
+		p.displayNode = d.DisplayNode
+		if d.IsFinished() {
+			p.succeeded = true
+			return
+		}
+		if _, exist := p.done[d.DisplayNode]; !exist {
+			p.done[d.DisplayNode] = 0
+		}
+	case *WSMessageDataProgress:
+		p := t.runningPrompt(d.PromptID)
+		if p == nil || d.Max <= 0 {
+			return
+		}
+		node := d.DisplayNode
+		if node == "" {
+			node = p.displayNode
+		}
+		if node == "" {
+			return
+		}
+		done := float64(d.Value) / float64(d.Max)
+		if done > 1 {
+			done = 1
+		}
+		if done > p.done[node] {
+			p.done[node] = done
+		}
+	case *WSMessageDataExecuted:
+		t.prompt(d.PromptID).done[d.DisplayNode] = 1
+	case *WSMessageExecuteSuccess:
+		p := t.prompt(d.PromptID)
+		p.displayNode, p.succeeded = "", true
+	case *WSMessageExecutionError:
+		t.prompt(d.PromptID).displayNode = ""
+	case *WSMessageExecutionInterrupted:
+		t.prompt(d.PromptID).displayNode = ""
+	}
+}
+
+// runningPrompt returns the prompt of a progress message, without prompt id the one whose node runs
+func (t *ProgressTracker) runningPrompt(promptID string) *promptProgress {
+	if promptID != "" {
+		return t.prompt(promptID)
+	}
+	for _, p := range t.prompts {
+		if p.displayNode != "" {
+			return p
+		}
+	}
+	return nil
+}
+
+// Percent returns the weighted progress of the prompt from 0 to 100 and whether the tracker knows the prompt
+// A prompt which succeeded is at 100, a failed or interrupted one stays where it stopped
+func (t *ProgressTracker) Percent(promptID string) (float64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, exist := t.prompts[promptID]
+	if !exist {
+		return 0, false
+	}
+	if p.succeeded {
+		return 100, true
+	}
+
+	var total, done float64
+	weigh := func(node string, fraction float64) {
+		weight := 1.0
+		if w, ok := t.weights[p.nodeTypes[node]]; ok {
+			weight = w
+		}
+		total += weight
+		done += weight * fraction
+	}
+	for node := range p.nodeTypes {
+		weigh(node, p.done[node])
+	}
+	for node, fraction := range p.done {
+		if _, expected := p.nodeTypes[node]; !expected {
+			weigh(node, fraction)
+		}
+	}
+	if total == 0 {
+		return 0, true
+	}
+	return done / total * 100, true
+}
+
+// Forget drops the progress of the prompt, a long running tracker should forget the prompts it is done with
+func (t *ProgressTracker) Forget(promptID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.prompts, promptID)
+}
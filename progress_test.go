@@ -0,0 +1,135 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func progressWorkflow() map[string]interface{} {
+	return map[string]interface{}{
+		"1": map[string]interface{}{"class_type": "CheckpointLoaderSimple"},
+		"2": map[string]interface{}{"class_type": "CLIPTextEncode"},
+		"3": map[string]interface{}{"class_type": "KSampler"},
+		"4": map[string]interface{}{"class_type": "VAEDecode"},
+		"5": map[string]interface{}{"class_type": "SaveImage"},
+	}
+}
+
+func observeAll(t *testing.T, trackers []*ProgressTracker, messages ...string) {
+	t.Helper()
+	for _, raw := range messages {
+		var message WSMessage
+		if err := json.Unmarshal([]byte(raw), &message); err != nil {
+			t.Fatalf("json.Unmarshal %s: %v", raw, err)
+		}
+		for _, tracker := range trackers {
+			tracker.Observe(&message)
+		}
+	}
+}
+
+func assertPercent(t *testing.T, tracker *ProgressTracker, promptID string, want float64) {
+	t.Helper()
+	got, ok := tracker.Percent(promptID)
+	if !ok {
+		t.Fatalf("Percent(%s): prompt unknown", promptID)
+	}
+	if math.Abs(got-want) > 0.01 {
+		t.Errorf("Percent(%s) = %.2f, want %.2f", promptID, got, want)
+	}
+}
+
+func TestProgressTrackerWeights(t *testing.T) {
+	equal := NewProgressTracker(nil)
+	weighted := NewProgressTracker(map[string]float64{"KSampler": 8})
+	trackers := []*ProgressTracker{equal, weighted}
+	for _, tracker := range trackers {
+		tracker.Expect("p1", progressWorkflow())
+	}
+
+	observeAll(t, trackers,
+		`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+		`{"type":"execution_cached","data":{"nodes":["1","2"],"prompt_id":"p1"}}`,
+		executingMessage("p1", "3"),
+		`{"type":"progress","data":{"value":5,"max":20,"prompt_id":"p1","node":"3"}}`,
+	)
+	// equal: (1 + 1 + 0.25) / 5, weighted: (1 + 1 + 8*0.25) / 12
+	assertPercent(t, equal, "p1", 45)
+	assertPercent(t, weighted, "p1", 100.0*4/12)
+
+	// progress of older servers has no prompt id and belongs to the running node
+	observeAll(t, trackers, progressMessage(20, 20))
+	assertPercent(t, equal, "p1", 60)
+	assertPercent(t, weighted, "p1", 100.0*10/12)
+
+	observeAll(t, trackers, executingMessage("p1", "4"), executingMessage("p1", "5"))
+	// the sampler outweighs the nodes after it
+	assertPercent(t, equal, "p1", 80)
+	assertPercent(t, weighted, "p1", 100.0*11/12)
+
+	observeAll(t, trackers, executedMessage("p1", "5", "a.png"), `{"type":"execution_success","data":{"prompt_id":"p1"}}`)
+	assertPercent(t, equal, "p1", 100)
+	assertPercent(t, weighted, "p1", 100)
+
+	equal.Forget("p1")
+	if _, ok := equal.Percent("p1"); ok {
+		t.Error("Percent after Forget: prompt still known")
+	}
+}
+
+func TestProgressTrackerFailedPromptStops(t *testing.T) {
+	tracker := NewProgressTracker(nil)
+	tracker.Expect("p1", progressWorkflow())
+	observeAll(t, []*ProgressTracker{tracker},
+		executingMessage("p1", "1"),
+		executingMessage("p1", "2"),
+		`{"type":"execution_error","data":{"prompt_id":"p1","node_id":"2","node_type":"CLIPTextEncode","exception_message":"boom"}}`,
+		// a later prompt without prompt id progress does not move p1
+		progressMessage(1, 1),
+	)
+	assertPercent(t, tracker, "p1", 20)
+}
+
+func TestWithProgressTracker(t *testing.T) {
+	m := newMockServer(t)
+	tracker := NewProgressTracker(map[string]float64{"KSampler": 8})
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		m.send(t, fmt.Sprintf(`{"type":"execution_start","data":{"prompt_id":%q}}`, promptID))
+		m.send(t, executingMessage(promptID, "3"))
+		m.send(t, fmt.Sprintf(`{"type":"progress","data":{"value":1,"max":2,"prompt_id":%q,"node":"3"}}`, promptID))
+	}
+	c := newConnectedClient(t, m, WithProgressTracker(tracker), WithTaskStatusBufferSize(8))
+
+	resp, err := c.QueuePrompt(context.Background(), progressWorkflow())
+	if err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	// the sampler is half done: 8*0.5 of 12
+	waitFor(t, "progress", func() bool {
+		percent, _ := tracker.Percent(resp.PromptID)
+		return math.Abs(percent-100.0*4/12) < 0.01
+	})
+}
+
+func TestProgressTrackerDisplayNode(t *testing.T) {
+	tracker := NewProgressTracker(nil)
+	tracker.Expect("p1", map[string]interface{}{
+		"11": map[string]interface{}{"class_type": "CheckpointLoaderSimple"},
+		"12": map[string]interface{}{"class_type": "SamplerSubgraph"},
+	})
+	// the subgraph node 12 expands to 12:5, which the workflow does not know
+	observeAll(t, []*ProgressTracker{tracker},
+		`{"type":"executing","data":{"node":"12:5","display_node":"12","prompt_id":"p1"}}`,
+		`{"type":"progress","data":{"value":1,"max":2,"prompt_id":"p1","node":"12:5","display_node":"12"}}`,
+	)
+	assertPercent(t, tracker, "p1", 25)
+
+	// without display_node the node is the display node
+	observeAll(t, []*ProgressTracker{tracker},
+		`{"type":"progress","data":{"value":1,"max":1,"prompt_id":"p1","node":"11"}}`,
+	)
+	assertPercent(t, tracker, "p1", 75)
+}
@@ -0,0 +1,171 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PromptStatus is where a prompt is in its life on the server
+type PromptStatus string
+
+const (
+	PromptPending   PromptStatus = "pending"
+	PromptRunning   PromptStatus = "running"
+	PromptCompleted PromptStatus = "completed"
+	// PromptFailed is a prompt which raised an error or was interrupted
+	PromptFailed   PromptStatus = "failed"
+	PromptNotFound PromptStatus = "not_found"
+)
+
+// recentPromptsSize is how many prompt ids the client remembers it queued
+const recentPromptsSize = 64
+
+// GetPromptStatus returns the status of the prompt from /queue and /history, for callers which poll instead of
+// listening on the websocket
+// A prompt this client just queued which the server does not report yet is pending
+func (c *Client) GetPromptStatus(ctx context.Context, promptID string) (PromptStatus, error) {
+	status, err := c.queuedPromptStatus(ctx, promptID)
+	if err != nil || status != PromptNotFound {
+		return status, err
+	}
+
+	history, err := c.getHistoryByPromptID(ctx, promptID)
+	if err != nil {
+		return "", fmt.Errorf("c.getHistoryByPromptID: error: %w", err)
+	}
+	if history != nil {
+		if history.Status != nil && history.Status.StatusStr == "error" {
+			return PromptFailed, nil
+		}
+		return PromptCompleted, nil
+	}
+
+	// the prompt may have left the queue for history between the two requests, history is checked again then
+	status, err = c.queuedPromptStatus(ctx, promptID)
+	if err != nil || status != PromptNotFound {
+		return status, err
+	}
+	if c.queuedRecently(promptID) {
+		return PromptPending, nil
+	}
+	return PromptNotFound, nil
+}
+
+// queuedPromptStatus returns whether the prompt is running or pending, PromptNotFound when it is not in the queue
+func (c *Client) queuedPromptStatus(ctx context.Context, promptID string) (PromptStatus, error) {
+	queueInfo, err := c.getQueueInfo(ctx)
+	if err != nil {
+		return "", fmt.Errorf("c.getQueueInfo: error: %w", err)
+	}
+	for _, item := range queueInfo.QueueRunning {
+		if item.PromptID == promptID {
+			return PromptRunning, nil
+		}
+	}
+	for _, item := range queueInfo.QueuePending {
+		if item.PromptID == promptID {
+			return PromptPending, nil
+		}
+	}
+	return PromptNotFound, nil
+}
+
+// QueuePosition returns how many prompts run before the prompt, the running ones included
+// It is 0 for a running prompt, a prompt queued behind one running and two pending ones is at 3
+// A prompt which is not in the queue returns ErrPromptNotFound
+func (c *Client) QueuePosition(ctx context.Context, promptID string) (int, error) {
+	queueInfo, err := c.getQueueInfo(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("c.getQueueInfo: error: %w", err)
+	}
+	for _, item := range queueInfo.QueueRunning {
+		if item.PromptID == promptID {
+			return 0, nil
+		}
+	}
+
+	// the server does not keep the pending list in order, prompts run by their number
+	pending := append([]*NodeInfo(nil), queueInfo.QueuePending...)
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].Num < pending[j].Num })
+	for i, item := range pending {
+		if item.PromptID == promptID {
+			return len(queueInfo.QueueRunning) + i, nil
+		}
+	}
+	return 0, fmt.Errorf("prompt %s is not in queue: %w", promptID, ErrPromptNotFound)
+}
+
+// rememberPrompt records a prompt id this client queued, only the latest recentPromptsSize ones are kept
+func (c *Client) rememberPrompt(promptID string) {
+	c.recentMu.Lock()
+	defer c.recentMu.Unlock()
+	c.recentPrompts = append(c.recentPrompts, promptID)
+	if len(c.recentPrompts) > recentPromptsSize {
+		c.recentPrompts = c.recentPrompts[len(c.recentPrompts)-recentPromptsSize:]
+	}
+}
+
+func (c *Client) queuedRecently(promptID string) bool {
+	c.recentMu.Lock()
+	defer c.recentMu.Unlock()
+	for _, id := range c.recentPrompts {
+		if id == promptID {
+			return true
+		}
+	}
+	return false
+}
+
+// SubmitAndPoll queues the workflow and polls /history every pollInterval until the prompt is done, without the
+// websocket, for infrastructure which blocks websockets
+// The result and the errors are the ones of RunWorkflow, an interval <= 0 polls every second
+func (c *Client) SubmitAndPoll(ctx context.Context, workflow map[string]interface{}, pollInterval time.Duration) (*RunResult, error) {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	start := time.Now()
+	resp, err := c.QueuePrompt(ctx, workflow)
+	if err != nil {
+		return nil, fmt.Errorf("c.QueuePrompt: error: %w", err)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		history, err := c.getHistoryByPromptID(ctx, resp.PromptID)
+		if err != nil {
+			return nil, fmt.Errorf("c.getHistoryByPromptID: error: %w", err)
+		}
+		// a prompt is added to history once it is done
+		if history != nil {
+			outputs, err := replayHistory(ctx, resp.PromptID, history)
+			return &RunResult{
+				PromptID:    resp.PromptID,
+				Outputs:     outputs,
+				Duration:    time.Since(start),
+				Interrupted: errors.Is(err, ErrPromptInterrupted),
+			}, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return &RunResult{PromptID: resp.PromptID, Duration: time.Since(start)}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// replayHistory collects the outputs and the end of a prompt from its history like waitForPrompt does from
+// the websocket messages
+func replayHistory(ctx context.Context, promptID string, history *PromptHistoryItem) (map[string][]*DataOutputFile, error) {
+	messages := historyMessages(history)
+	sub := newSubscription(promptID, len(messages))
+	for _, message := range messages {
+		sub.deliver(message)
+	}
+	return waitForPrompt(ctx, context.Background(), sub)
+}
@@ -0,0 +1,156 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetPromptStatus(t *testing.T) {
+	m := newMockServer(t)
+	histories := map[string]string{
+		"done":   `{"done":{"prompt":[1,"done",{},{},[]],"outputs":{},"status":{"status_str":"success","completed":true,"messages":[]}}}`,
+		"broken": `{"broken":{"prompt":[2,"broken",{},{},[]],"outputs":{},"status":{"status_str":"error","completed":false,"messages":[]}}}`,
+	}
+	m.mux.HandleFunc("/history/", func(w http.ResponseWriter, r *http.Request) {
+		promptID := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if history, exist := histories[promptID]; exist {
+			fmt.Fprint(w, history)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	m.setQueue([]string{"running"}, []string{"pending"})
+	// the server has not put the prompt it just accepted in /queue yet
+	submitted, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{"class_type": "SaveImage"}})
+	if err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+
+	tests := []struct {
+		promptID string
+		want     PromptStatus
+	}{
+		{"running", PromptRunning},
+		{"pending", PromptPending},
+		{"done", PromptCompleted},
+		{"broken", PromptFailed},
+		{submitted.PromptID, PromptPending},
+		{"unknown", PromptNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.promptID, func(t *testing.T) {
+			got, err := c.GetPromptStatus(context.Background(), tt.promptID)
+			if err != nil {
+				t.Fatalf("GetPromptStatus: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GetPromptStatus = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueuePosition(t *testing.T) {
+	m := newMockServer(t)
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	m.setQueue([]string{"running"}, []string{"first", "second", "mine", "last"})
+
+	tests := []struct {
+		promptID string
+		want     int
+		wantErr  error
+	}{
+		{promptID: "running", want: 0},
+		{promptID: "first", want: 1},
+		{promptID: "mine", want: 3},
+		{promptID: "unknown", wantErr: ErrPromptNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.promptID, func(t *testing.T) {
+			got, err := c.QueuePosition(context.Background(), tt.promptID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("QueuePosition = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("QueuePosition = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("pending out of order", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"queue_running":[],"queue_pending":[[7,"later",{},{},[]],[5,"mine",{},{},[]],[3,"sooner",{},{},[]]]}`)
+		}))
+		defer server.Close()
+		c, err := NewDefaultClientStr(server.URL)
+		if err != nil {
+			t.Fatalf("NewDefaultClientStr: %v", err)
+		}
+		if got, err := c.QueuePosition(context.Background(), "mine"); err != nil || got != 1 {
+			t.Errorf("QueuePosition = %d, %v, want 1 behind the prompt with the lower number", got, err)
+		}
+	})
+}
+
+func TestSubmitAndPoll(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		wantErr error
+	}{
+		{name: "success", status: `{"status_str":"success","completed":true,"messages":[]}`},
+		{
+			name:    "error",
+			status:  `{"status_str":"error","completed":false,"messages":[["execution_error",{"prompt_id":"prompt-1","node_id":"12","node_type":"SaveImage","exception_message":"disk full","exception_type":"OSError","traceback":[],"current_inputs":{},"current_outputs":{}}]]}`,
+			wantErr: ErrPromptFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			var polls atomic.Int32
+			m.mux.HandleFunc("/history/prompt-1", func(w http.ResponseWriter, r *http.Request) {
+				// the prompt is queued and running for the first two polls
+				if polls.Add(1) <= 2 {
+					fmt.Fprint(w, `{}`)
+					return
+				}
+				fmt.Fprintf(w, `{"prompt-1":{"prompt":[1,"prompt-1",{}],"outputs":{
+					"9":{"images":[{"filename":"a.png","subfolder":"","type":"output"}]}},"status":%s}}`, tt.status)
+			})
+			// no websocket is connected
+			c, err := NewDefaultClientStr(m.URL)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+
+			result, err := c.SubmitAndPoll(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}, 10*time.Millisecond)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SubmitAndPoll = %v, want %v", err, tt.wantErr)
+			}
+			if result == nil || result.PromptID != "prompt-1" || len(result.Outputs["9"]) != 1 {
+				t.Errorf("result = %+v, want prompt-1 with a.png", result)
+			}
+			if got := polls.Load(); got != 3 {
+				t.Errorf("history is polled %d times, want 3", got)
+			}
+			if m.connCount() != 0 {
+				t.Errorf("websocket connections = %d, want none", m.connCount())
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Kinds of RecordedFrame
+const (
+	TextFrame   = "text"
+	BinaryFrame = "binary"
+)
+
+// RecordedFrame is a websocket frame written by Recorder as one JSON line
+// Kind tells text and binary frames apart, an empty binary frame has no payload to tell it by
+type RecordedFrame struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind,omitempty"`
+	Text   string    `json:"text,omitempty"`
+	Binary []byte    `json:"binary,omitempty"`
+}
+
+// IsBinary reports whether the frame is a binary frame, recordings without kind are told by their payload
+func (f *RecordedFrame) IsBinary() bool {
+	if f.Kind != "" {
+		return f.Kind == BinaryFrame
+	}
+	return f.Binary != nil
+}
+
+// Recorder wraps a Handler and writes every frame it receives to a writer as JSONL
+// It captures a real ComfyUI session which Player can replay later
+type Recorder struct {
+	handler Handler
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewRecorder(w io.Writer, handler Handler) *Recorder {
+	return &Recorder{
+		handler: handler,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (r *Recorder) Handle(msg string) error {
+	recordErr := r.record(&RecordedFrame{Time: time.Now(), Kind: TextFrame, Text: msg})
+	if err := r.handler.Handle(msg); err != nil {
+		return err
+	}
+	return recordErr
+}
+
+func (r *Recorder) HandleBinary(b []byte) error {
+	recordErr := r.record(&RecordedFrame{Time: time.Now(), Kind: BinaryFrame, Binary: b})
+	if binaryHandler, ok := r.handler.(BinaryHandler); ok {
+		if err := binaryHandler.HandleBinary(b); err != nil {
+			return err
+		}
+	}
+	return recordErr
+}
+
+func (r *Recorder) HandleDisconnect(err error) {
+	if disconnectHandler, ok := r.handler.(DisconnectHandler); ok {
+		disconnectHandler.HandleDisconnect(err)
+	}
+}
+
+func (r *Recorder) HandleReconnect() {
+	if reconnectHandler, ok := r.handler.(ReconnectHandler); ok {
+		reconnectHandler.HandleReconnect()
+	}
+}
+
+func (r *Recorder) HandleError(err error) {
+	if errorHandler, ok := r.handler.(ErrorHandler); ok {
+		errorHandler.HandleError(err)
+	}
+}
+
+func (r *Recorder) record(frame *RecordedFrame) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.encoder.Encode(frame); err != nil {
+		return fmt.Errorf("encoder.Encode: error: %w", err)
+	}
+	return nil
+}
+
+// Player replays frames written by Recorder into a Handler
+type Player struct {
+	decoder *json.Decoder
+}
+
+func NewPlayer(r io.Reader) *Player {
+	return &Player{decoder: json.NewDecoder(r)}
+}
+
+// Play replays all frames into the handler
+// speed scales the recorded timing, 1 keeps it, 2 plays twice as fast and 0 plays without delay
+// Like the listen loop, errors returned by the handler do not stop the replay
+func (p *Player) Play(ctx context.Context, handler Handler, speed float64) error {
+	var last time.Time
+	for {
+		var frame RecordedFrame
+		if err := p.decoder.Decode(&frame); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("decoder.Decode: error: %w", err)
+		}
+
+		if speed > 0 && !last.IsZero() {
+			timer := time.NewTimer(time.Duration(float64(frame.Time.Sub(last)) / speed))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		last = frame.Time
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if frame.IsBinary() {
+			if binaryHandler, ok := handler.(BinaryHandler); ok {
+				if frame.Binary == nil {
+					frame.Binary = []byte{}
+				}
+				binaryHandler.HandleBinary(frame.Binary)
+			}
+			continue
+		}
+		handler.Handle(frame.Text)
+	}
+}
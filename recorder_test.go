@@ -0,0 +1,118 @@
+package comfyUIclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// countingHandler counts the text and binary frames it receives
+type countingHandler struct {
+	texts    []string
+	binaries [][]byte
+}
+
+func (h *countingHandler) Handle(msg string) error {
+	h.texts = append(h.texts, msg)
+	return nil
+}
+
+func (h *countingHandler) HandleBinary(b []byte) error {
+	h.binaries = append(h.binaries, b)
+	return nil
+}
+
+func TestRecorderAndPlayer(t *testing.T) {
+	var buf bytes.Buffer
+	recorded := &countingHandler{}
+	recorder := NewRecorder(&buf, recorded)
+
+	frames := []string{
+		`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+		`{"type":"executing","data":{"node":"9","prompt_id":"p1"}}`,
+		`{"type":"executing","data":{"node":null,"prompt_id":"p1"}}`,
+	}
+	for _, frame := range frames {
+		if err := recorder.Handle(frame); err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+	}
+	// an empty binary frame must not come back as a text frame
+	if err := recorder.HandleBinary([]byte{}); err != nil {
+		t.Fatalf("HandleBinary: %v", err)
+	}
+	if len(recorded.texts) != 3 || len(recorded.binaries) != 1 {
+		t.Fatalf("recorder passed %d text and %d binary frames, want 3 and 1", len(recorded.texts), len(recorded.binaries))
+	}
+
+	replayed := &countingHandler{}
+	if err := NewPlayer(&buf).Play(context.Background(), replayed, 0); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	if len(replayed.texts) != 3 || len(replayed.binaries) != 1 {
+		t.Fatalf("player replayed %d text and %d binary frames, want 3 and 1", len(replayed.texts), len(replayed.binaries))
+	}
+	for i, frame := range frames {
+		if replayed.texts[i] != frame {
+			t.Errorf("frame %d = %s, want %s", i, replayed.texts[i], frame)
+		}
+	}
+}
+
+func TestRecorderForwardsReconnect(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/history/p1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"p1":{"prompt":[1,"p1",{}],"outputs":{
+			"9":{"images":[{"filename":"a.png","subfolder":"","type":"output"}]}},
+			"status":{"status_str":"success","completed":true,"messages":[]}}}`)
+	})
+	c := newConnectedClient(t, m, WithRecorder(io.Discard), WithReconnectInterval(10*time.Millisecond))
+
+	done := make(chan error, 1)
+	var outputs map[string][]*DataOutputFile
+	go func() {
+		var err error
+		outputs, err = c.WaitForPrompt(context.Background(), "p1")
+		done <- err
+	}()
+	waitFor(t, "subscription", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1
+	})
+
+	// p1 ends while the websocket is down, only history knows it
+	m.closeConns()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitForPrompt = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForPrompt is not recovered behind the recorder")
+	}
+	if len(outputs["9"]) != 1 {
+		t.Errorf("outputs = %v, want a.png of node 9", outputs)
+	}
+}
+
+func TestRecorderForwardsErrors(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithRecorder(io.Discard), WithTaskStatusBufferSize(4))
+
+	m.send(t, `{"type":"progress","data":{"value":"three","max":20}}`)
+	select {
+	case err := <-c.Errors():
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || parseErr.Type != Progress {
+			t.Errorf("error = %v, want a ParseError of the progress frame", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error is sent behind the recorder")
+	}
+}
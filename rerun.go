@@ -0,0 +1,100 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+)
+
+// RerunOption configures RerunFromHistory
+type RerunOption func(*rerunOptions)
+
+type rerunOptions struct {
+	newSeed bool
+}
+
+// seedInputs are the inputs RerunWithNewSeed randomizes
+var seedInputs = []string{"seed", "noise_seed"}
+
+// RerunWithNewSeed gives every seed and noise_seed input of the workflow a new random value
+func RerunWithNewSeed() RerunOption {
+	return func(o *rerunOptions) {
+		o.newSeed = true
+	}
+}
+
+// RerunFromHistory queues the workflow of a prompt in history again, like a regenerate button
+// The extra data of the prompt, e.g. extra_pnginfo, is sent again as well
+// A prompt which is no longer in history returns ErrPromptNotFound
+func (c *Client) RerunFromHistory(ctx context.Context, promptID string, opts ...RerunOption) (*QueuePromptResp, error) {
+	var o rerunOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	history, err := c.getHistoryByPromptID(ctx, promptID)
+	if err != nil {
+		return nil, fmt.Errorf("c.getHistoryByPromptID: error: %w", err)
+	}
+	if history == nil {
+		return nil, fmt.Errorf("prompt %s is not in history: %w", promptID, ErrPromptNotFound)
+	}
+	workflow := history.Workflow()
+	if workflow == nil {
+		return nil, fmt.Errorf("history of prompt %s has no workflow", promptID)
+	}
+	if o.newSeed {
+		randomizeSeeds(workflow)
+	}
+
+	var extraData map[string]interface{}
+	if len(history.NodeInfo.ExtraData) != 0 {
+		if err := json.Unmarshal(history.NodeInfo.ExtraData, &extraData); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: extra data error: %w", err)
+		}
+		// the new prompt belongs to this client, and its metadata comes from ctx
+		delete(extraData, "client_id")
+		delete(extraData, metadataExtraKey)
+		delete(extraData, clientLabelExtraKey)
+	}
+	resp, err := c.QueuePromptWithExtra(ctx, workflow, extraData)
+	if err != nil {
+		return nil, fmt.Errorf("c.QueuePromptWithExtra: error: %w", err)
+	}
+	return resp, nil
+}
+
+// randomizeSeeds sets every numeric seed input of the workflow to a random value
+func randomizeSeeds(workflow map[string]interface{}) {
+	for _, node := range workflow {
+		n, ok := node.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		inputs, ok := n["inputs"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, name := range seedInputs {
+			if _, ok := inputs[name].(float64); ok {
+				// 53 bits keep the seed exact through the float64 of a decoded workflow
+				inputs[name] = rand.Int63n(1 << 53)
+			}
+		}
+	}
+}
+
+// ReplacePrompt cancels the prompt and queues the workflow instead, like an edit and regenerate button
+// A running prompt is interrupted and a pending one deleted from the queue, a finished one is left as is
+// The workflow is only queued once the prompt is cancelled, so a failed cancel never leaves both running
+func (c *Client) ReplacePrompt(ctx context.Context, oldPromptID string, newWorkflow map[string]interface{}) (*QueuePromptResp, error) {
+	if _, _, err := c.cancelPrompt(ctx, oldPromptID); err != nil {
+		return nil, fmt.Errorf("c.cancelPrompt: error: %w", err)
+	}
+	resp, err := c.QueuePrompt(ctx, newWorkflow)
+	if err != nil {
+		return nil, fmt.Errorf("prompt %s is cancelled, c.QueuePrompt: error: %w", oldPromptID, err)
+	}
+	return resp, nil
+}
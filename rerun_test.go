@@ -0,0 +1,124 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRerunFromHistory(t *testing.T) {
+	m := newMockServer(t)
+	serveHistoryFromPrompts(m)
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	workflow := map[string]interface{}{
+		"3": map[string]interface{}{"class_type": "KSampler", "inputs": map[string]interface{}{"seed": 42, "model": []interface{}{"4", 0}}},
+		"4": map[string]interface{}{"class_type": "CheckpointLoaderSimple", "inputs": map[string]interface{}{"ckpt_name": "sd15.safetensors"}},
+	}
+	extraData := map[string]interface{}{"extra_pnginfo": map[string]interface{}{"workflow": "ui"}}
+	if _, err := c.QueuePromptWithExtra(context.Background(), workflow, extraData); err != nil {
+		t.Fatalf("QueuePromptWithExtra: %v", err)
+	}
+
+	resp, err := c.RerunFromHistory(context.Background(), "prompt-1")
+	if err != nil {
+		t.Fatalf("RerunFromHistory: %v", err)
+	}
+	if resp.PromptID != "prompt-2" {
+		t.Errorf("prompt id = %s, want prompt-2", resp.PromptID)
+	}
+	bodies := m.promptBodies()
+	if !reflect.DeepEqual(bodies[1]["prompt"], bodies[0]["prompt"]) {
+		t.Errorf("rerun workflow = %v, want %v", bodies[1]["prompt"], bodies[0]["prompt"])
+	}
+	if !reflect.DeepEqual(bodies[1]["extra_data"], bodies[0]["extra_data"]) {
+		t.Errorf("rerun extra data = %v, want %v", bodies[1]["extra_data"], bodies[0]["extra_data"])
+	}
+
+	if _, err := c.RerunFromHistory(context.Background(), "prompt-1", RerunWithNewSeed()); err != nil {
+		t.Fatalf("RerunFromHistory with a new seed: %v", err)
+	}
+	rerun := m.promptBodies()[2]["prompt"].(map[string]interface{})
+	inputs := rerun["3"].(map[string]interface{})["inputs"].(map[string]interface{})
+	if inputs["seed"] == float64(42) {
+		t.Error("seed is unchanged with RerunWithNewSeed")
+	}
+	if !reflect.DeepEqual(inputs["model"], []interface{}{"4", float64(0)}) {
+		t.Errorf("model input = %v, want the link kept", inputs["model"])
+	}
+
+	if _, err := c.RerunFromHistory(context.Background(), "gone"); !errors.Is(err, ErrPromptNotFound) {
+		t.Errorf("RerunFromHistory of a prompt not in history = %v, want %v", err, ErrPromptNotFound)
+	}
+}
+
+func TestReplacePrompt(t *testing.T) {
+	tests := []struct {
+		name      string
+		oldPrompt string
+		wantCalls []string
+	}{
+		{name: "running", oldPrompt: "p1", wantCalls: []string{`/interrupt {"prompt_id":"p1"}`}},
+		{name: "pending", oldPrompt: "p2", wantCalls: []string{`/queue {"delete":["p2"]}`}},
+		{name: "finished", oldPrompt: "p0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			m.setQueue([]string{"p1"}, []string{"p2"})
+			var callsAtSubmit []string
+			m.onPrompt = func(promptID string, body map[string]interface{}) {
+				callsAtSubmit = m.recordedCalls()
+			}
+			c, err := NewDefaultClientStr(m.URL)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+
+			workflow := map[string]interface{}{"3": map[string]interface{}{"inputs": map[string]interface{}{"seed": float64(2)}}}
+			resp, err := c.ReplacePrompt(context.Background(), tt.oldPrompt, workflow)
+			if err != nil {
+				t.Fatalf("ReplacePrompt: %v", err)
+			}
+			if resp.PromptID != "prompt-1" {
+				t.Errorf("PromptID = %q, want prompt-1", resp.PromptID)
+			}
+			// the old prompt is cancelled before the new one is queued
+			if !reflect.DeepEqual(callsAtSubmit, tt.wantCalls) {
+				t.Errorf("calls before the submission = %v, want %v", callsAtSubmit, tt.wantCalls)
+			}
+			bodies := m.promptBodies()
+			if len(bodies) != 1 || !reflect.DeepEqual(bodies[0]["prompt"], workflow) {
+				t.Errorf("submitted = %v, want the new workflow", bodies)
+			}
+		})
+	}
+}
+
+func TestReplacePromptCancelFails(t *testing.T) {
+	var submitted atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/prompt" {
+			submitted.Store(true)
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	c, err := NewDefaultClientStr(server.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	if _, err := c.ReplacePrompt(context.Background(), "p1", map[string]interface{}{"3": map[string]interface{}{}}); err == nil {
+		t.Fatal("ReplacePrompt: want error")
+	}
+	if submitted.Load() {
+		t.Error("the new workflow is queued although the old prompt was not cancelled")
+	}
+}
@@ -0,0 +1,74 @@
+package comfyUIclient
+
+import (
+	"context"
+	"fmt"
+)
+
+// ResultStream sends each output file of the prompt as soon as its executed message arrives, for a UI which
+// shows the images while the rest of the workflow still runs
+// The file channel is closed once the prompt ends; if it fails, is interrupted or the wait is given up, the error
+// is sent on the error channel first, which is closed as well
+// Like WaitForPrompt, it must be called before the outputs are sent
+func (c *Client) ResultStream(ctx context.Context, promptID string) (<-chan *DataOutputFile, <-chan error) {
+	files := make(chan *DataOutputFile, 16)
+	errs := make(chan error, 1)
+	// the subscription is made before returning, so no message of the prompt is missed
+	sub := c.subscribe(promptID)
+	go func() {
+		defer close(errs)
+		defer close(files)
+		defer c.unsubscribe(sub)
+		if err := c.streamResults(ctx, sub, files); err != nil {
+			errs <- err
+		}
+	}()
+	return files, errs
+}
+
+// streamResults sends the new files of the subscription until the prompt ends
+func (c *Client) streamResults(ctx context.Context, sub *subscription, files chan<- *DataOutputFile) error {
+	if err := c.acquireConnection(ctx); err != nil {
+		return fmt.Errorf("c.acquireConnection: error: %w", err)
+	}
+	defer c.releaseConnection()
+
+	connCtx := c.Context()
+	sent := make(map[string][]*DataOutputFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-connCtx.Done():
+			return ErrConnectionClosed
+		case message := <-sub.ch:
+			switch d := message.Data.(type) {
+			case *WSMessageDataExecuted:
+				before := len(sent[d.DisplayNode])
+				sent[d.DisplayNode] = appendNewFiles(sent[d.DisplayNode], flattenOutput(d.Output))
+				for _, file := range sent[d.DisplayNode][before:] {
+					select {
+					case files <- file:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			case *WSMessageDataExecuting:
+				if d.IsFinished() {
+					return nil
+				}
+			case *WSMessageExecuteSuccess:
+				return nil
+			case *WSMessageExecutionInterrupted:
+				return &PromptInterruptedError{
+					PromptID: d.PromptID,
+					NodeID:   d.NodeID,
+					NodeType: d.NodeType,
+					Executed: d.Executed,
+				}
+			case *WSMessageExecutionError:
+				return &PromptExecutionError{WSMessageExecutionError: d}
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResultStream(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+
+	files, errs := c.ResultStream(context.Background(), "p1")
+	waitFor(t, "subscription", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1
+	})
+
+	receive := func() *DataOutputFile {
+		t.Helper()
+		select {
+		case file := <-files:
+			return file
+		case <-time.After(5 * time.Second):
+			t.Fatal("no file is streamed")
+			return nil
+		}
+	}
+
+	// each file arrives before the prompt ends
+	m.send(t, executedMessage("p1", "9", "a.png"))
+	if file := receive(); file == nil || file.Filename != "a.png" {
+		t.Fatalf("first file = %v, want a.png", file)
+	}
+	m.send(t, executedMessage("p1", "12", "b.png"))
+	if file := receive(); file == nil || file.Filename != "b.png" {
+		t.Fatalf("second file = %v, want b.png", file)
+	}
+
+	m.send(t, `{"type":"execution_success","data":{"prompt_id":"p1"}}`)
+	if file, ok := <-files; ok {
+		t.Fatalf("unexpected file %v, want the channel closed", file)
+	}
+	if err, ok := <-errs; ok {
+		t.Fatalf("error = %v, want the channel closed", err)
+	}
+}
+
+func TestResultStreamError(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+
+	files, errs := c.ResultStream(context.Background(), "p1")
+	waitFor(t, "subscription", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1
+	})
+	m.send(t, `{"type":"execution_error","data":{"prompt_id":"p1","node_id":"12","node_type":"SaveImage","exception_message":"disk full","exception_type":"OSError","traceback":[],"current_inputs":{},"current_outputs":{}}}`)
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrPromptFailed) {
+			t.Errorf("error = %v, want ErrPromptFailed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error is sent")
+	}
+	if _, ok := <-files; ok {
+		t.Error("file channel is not closed")
+	}
+}
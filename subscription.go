@@ -0,0 +1,352 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subscription receives the messages of one prompt
+type subscription struct {
+	promptID string
+	ch       chan *WSMessage
+	done     chan struct{}
+	once     sync.Once
+	// reconnected is set when the websocket reconnected while the prompt was not finished,
+	// messages sent while it was down are lost
+	reconnected atomic.Bool
+}
+
+// deliver sends the message to the subscription, it gives up once the subscription is closed
+func (s *subscription) deliver(message *WSMessage) {
+	select {
+	case s.ch <- message:
+	case <-s.done:
+	}
+}
+
+func (s *subscription) close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// heldMessage is a message held back while a submission is in flight, with the prompt it belongs to
+type heldMessage struct {
+	promptID string
+	message  *WSMessage
+}
+
+// newSubscription creates a subscription whose buffer has room for extra messages on top of the default
+func newSubscription(promptID string, extra int) *subscription {
+	return &subscription{
+		promptID: promptID,
+		ch:       make(chan *WSMessage, 16+extra),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *Client) subscribe(promptID string) *subscription {
+	sub := newSubscription(promptID, 0)
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.addSubscriptionLocked(sub)
+	return sub
+}
+
+// addSubscriptionLocked registers the subscription, the caller must hold subMu
+func (c *Client) addSubscriptionLocked(sub *subscription) {
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]map[*subscription]struct{})
+	}
+	if c.subscriptions[sub.promptID] == nil {
+		c.subscriptions[sub.promptID] = make(map[*subscription]struct{})
+	}
+	c.subscriptions[sub.promptID][sub] = struct{}{}
+}
+
+func (c *Client) unsubscribe(sub *subscription) {
+	// close first, so a pending deliver does not hold Handle while we wait for the lock
+	sub.close()
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	delete(c.subscriptions[sub.promptID], sub)
+	if len(c.subscriptions[sub.promptID]) == 0 {
+		delete(c.subscriptions, sub.promptID)
+	}
+}
+
+// submitAndSubscribe queues the workflow and subscribes to its messages
+// The prompt id is only known once /prompt returns, but its messages may arrive on the websocket before that
+// While a submission is in flight, messages nobody claims are held back instead of being sent to the
+// task status channel, the new subscription takes the ones of its prompt and the rest is released afterwards
+func (c *Client) submitAndSubscribe(ctx context.Context, workflow map[string]interface{}) (*QueuePromptResp, *subscription, error) {
+	c.subMu.Lock()
+	c.submitting++
+	c.subMu.Unlock()
+
+	resp, err := c.QueuePrompt(ctx, workflow)
+	if err == nil && resp.PromptID == "" {
+		err = fmt.Errorf("prompt is not queued, node errors: %v", resp.NodeErrors)
+	} else if err != nil {
+		err = fmt.Errorf("c.QueuePrompt: error: %w", err)
+	}
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.submitting--
+	defer c.releaseHeldLocked()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var held []*WSMessage
+	var rest []heldMessage
+	finished := false
+	for _, h := range c.held {
+		if h.promptID == resp.PromptID {
+			held = append(held, h.message)
+			finished = finished || isPromptFinished(h.message)
+		} else {
+			rest = append(rest, h)
+		}
+	}
+	c.held = rest
+
+	if !finished {
+		if c.ownedPrompts == nil {
+			c.ownedPrompts = make(map[string]struct{})
+		}
+		c.ownedPrompts[resp.PromptID] = struct{}{}
+	}
+	// the buffer has room for every held message, so they are delivered before any later one
+	sub := newSubscription(resp.PromptID, len(held))
+	for _, message := range held {
+		sub.ch <- message
+	}
+	c.addSubscriptionLocked(sub)
+	return resp, sub, nil
+}
+
+// releaseHeldLocked sends the held messages to the task status channel once no submission is in flight
+// They are sent from a goroutine so a slow consumer does not stall the submitter, messages which arrive
+// meanwhile are held too so the order is kept
+// The caller must hold subMu
+func (c *Client) releaseHeldLocked() {
+	if c.submitting > 0 || c.releasingHeld || len(c.held) == 0 {
+		return
+	}
+	c.releasingHeld = true
+	go func() {
+		for {
+			c.subMu.Lock()
+			if c.submitting > 0 || len(c.held) == 0 {
+				c.releasingHeld = false
+				c.subMu.Unlock()
+				return
+			}
+			messages := c.held
+			c.held = nil
+			c.subMu.Unlock()
+
+			for _, h := range messages {
+				c.sendUnclaimed(h.message)
+			}
+		}
+	}()
+}
+
+// dispatchToSubscriptions delivers the message to the subscriptions of its prompt
+// It reports whether the message is consumed, messages of prompts submitted by RunWorkflow are
+// always consumed so they never reach the task status channel, and so are the messages held back
+// while a submission is in flight
+func (c *Client) dispatchToSubscriptions(message *WSMessage) bool {
+	c.subMu.Lock()
+	promptID := c.trackPrompt(message)
+	subs := make([]*subscription, 0, len(c.subscriptions[promptID]))
+	for sub := range c.subscriptions[promptID] {
+		subs = append(subs, sub)
+	}
+	_, owned := c.ownedPrompts[promptID]
+	if isPromptFinished(message) {
+		delete(c.ownedPrompts, promptID)
+	}
+	if !owned && len(subs) == 0 && (c.submitting > 0 || c.releasingHeld) {
+		c.held = append(c.held, heldMessage{promptID: promptID, message: message})
+		c.subMu.Unlock()
+		return true
+	}
+	c.subMu.Unlock()
+
+	for _, sub := range subs {
+		sub.deliver(message)
+	}
+	return owned || len(subs) > 0
+}
+
+// trackPrompt returns the prompt id of the message and keeps track of the running prompt
+// Messages without a prompt id such as the progress of older servers belong to the running prompt
+// The caller must hold subMu
+func (c *Client) trackPrompt(message *WSMessage) string {
+	promptID := messagePromptID(message)
+	if message.Type == ExecutionStart {
+		c.runningPromptID = promptID
+		return promptID
+	}
+	if promptID == "" {
+		return c.runningPromptID
+	}
+	if isPromptFinished(message) && c.runningPromptID == promptID {
+		c.runningPromptID = ""
+	}
+	return promptID
+}
+
+// messagePromptID returns the prompt id the message carries, empty for messages without one
+func messagePromptID(message *WSMessage) string {
+	switch d := message.Data.(type) {
+	case *WSMessageDataExecutionStart:
+		return d.PromptID
+	case *WSMessageDataExecutionCached:
+		return d.PromptID
+	case *WSMessageDataExecuting:
+		return d.PromptID
+	case *WSMessageDataExecuted:
+		return d.PromptID
+	case *WSMessageExecutionInterrupted:
+		return d.PromptID
+	case *WSMessageExecutionError:
+		return d.PromptID
+	case *WSMessageExecuteSuccess:
+		return d.PromptID
+	case *WSMessageDataProgress:
+		return d.PromptID
+	}
+	return ""
+}
+
+// isPromptFinished reports whether the message is the last one ComfyUI sends for a prompt
+// ComfyUI sends an executing message without node after the prompt has been executed
+func isPromptFinished(message *WSMessage) bool {
+	d, ok := message.Data.(*WSMessageDataExecuting)
+	return ok && d.IsFinished()
+}
+
+// ReconnectEvent describes a reconnect of the websocket, see WithOnReconnect
+type ReconnectEvent struct {
+	// Downtime is how long the websocket was down, 0 when the drop was not noticed
+	Downtime time.Duration
+	// Recovered is how many waited for prompts ended while the websocket was down, their end was delivered
+	// from history, so each one is a terminal message the connection missed
+	Recovered int
+	// Pending is how many waited for prompts are still queued or running, or could not be looked up
+	Pending int
+}
+
+// HandleReconnect recovers the prompts whose messages may be lost while the websocket was down
+// Every prompt which is waited for and is already in history gets its outputs and its end delivered from there,
+// the waiters of the others stay subscribed and fill in the outputs they missed from history once their prompt ends
+func (c *Client) HandleReconnect() {
+	event := ReconnectEvent{}
+	if at := c.disconnectedAt.Swap(0); at != 0 {
+		event.Downtime = time.Since(time.Unix(0, at))
+	}
+
+	c.subMu.Lock()
+	promptIDs := make([]string, 0, len(c.subscriptions))
+	for promptID := range c.subscriptions {
+		promptIDs = append(promptIDs, promptID)
+	}
+	c.subMu.Unlock()
+
+	for _, promptID := range promptIDs {
+		ctx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
+		history, err := c.getHistoryByPromptID(ctx, promptID)
+		cancel()
+		if err != nil {
+			fmt.Printf("[%s] recover prompt %s from history error %v\n", c.baseURL, promptID, err)
+			c.markReconnected(promptID)
+			event.Pending++
+			continue
+		}
+		if history == nil {
+			// still queued or running, its messages arrive on the new connection
+			c.markReconnected(promptID)
+			event.Pending++
+			continue
+		}
+		for _, message := range historyMessages(history) {
+			c.dispatchToSubscriptions(message)
+		}
+		event.Recovered++
+	}
+
+	if c.onReconnect != nil {
+		c.onReconnect(event)
+	}
+}
+
+// markReconnected marks the subscriptions of the prompt as having missed messages
+func (c *Client) markReconnected(promptID string) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	for sub := range c.subscriptions[promptID] {
+		sub.reconnected.Store(true)
+	}
+}
+
+// historyMessages synthesizes the messages of a finished prompt from its history:
+// an executed message per output node followed by the message the prompt ended with
+func historyMessages(history *PromptHistoryItem) []*WSMessage {
+	nodes := make([]string, 0, len(history.Outputs))
+	for node := range history.Outputs {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return naturalLess(nodes[i], nodes[j]) })
+
+	var messages []*WSMessage
+	for _, node := range nodes {
+		output := make(map[string][]*DataOutputFile)
+		add := func(name string, files []DataOutputFile) {
+			for i := range files {
+				output[name] = append(output[name], &files[i])
+			}
+		}
+		add("images", history.Outputs[node].Images)
+		add("gifs", history.Outputs[node].Gifs)
+		add("audio", history.Outputs[node].Audios)
+		messages = append(messages, &WSMessage{
+			Type: Executed,
+			Data: &WSMessageDataExecuted{Node: node, DisplayNode: node, PromptID: history.PromptID, Output: output},
+		})
+	}
+
+	if status := history.Status; status != nil {
+		for i := len(status.Messages) - 1; i >= 0; i-- {
+			var messageType WsMessageType
+			if err := json.Unmarshal(status.Messages[i][0], &messageType); err != nil {
+				continue
+			}
+			if messageType != ExecutionError && messageType != ExecutionInterrupted {
+				continue
+			}
+			raw, err := json.Marshal(map[string]json.RawMessage{"type": status.Messages[i][0], "data": status.Messages[i][1]})
+			if err != nil {
+				continue
+			}
+			message := &WSMessage{}
+			if err := json.Unmarshal(raw, message); err == nil {
+				return append(messages, message)
+			}
+		}
+	}
+	return append(messages, &WSMessage{
+		Type: Executing,
+		Data: &WSMessageDataExecuting{PromptID: history.PromptID},
+	})
+}
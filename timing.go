@@ -0,0 +1,122 @@
+package comfyUIclient
+
+import (
+	"sync"
+	"time"
+)
+
+// PromptTimings holds when a prompt started and ended and how long each of its nodes ran
+type PromptTimings struct {
+	PromptID string
+	Start    time.Time
+	// End is zero while the prompt runs
+	End time.Time
+	// Nodes holds the duration of every executed node, from its executing message to the next one
+	Nodes map[string]time.Duration
+
+	node      string
+	nodeStart time.Time
+}
+
+// Total returns how long the prompt ran, 0 while it runs
+func (t *PromptTimings) Total() time.Duration {
+	if t.End.IsZero() {
+		return 0
+	}
+	return t.End.Sub(t.Start)
+}
+
+// endNode closes the timing of the running node
+func (p *PromptTimings) endNode(now time.Time) {
+	if p.node != "" {
+		p.Nodes[p.node] += now.Sub(p.nodeStart)
+		p.node = ""
+	}
+}
+
+func (p *PromptTimings) end(now time.Time) {
+	if p.End.IsZero() {
+		p.End = now
+	}
+}
+
+// TimingTracker records the timings of the prompts whose messages it observes
+// Pass it to WithTimingTracker to observe the messages of a client
+type TimingTracker struct {
+	mu      sync.Mutex
+	prompts map[string]*PromptTimings
+	// now is the clock, tests replace it
+	now func() time.Time
+}
+
+func NewTimingTracker() *TimingTracker {
+	return &TimingTracker{
+		prompts: make(map[string]*PromptTimings),
+		now:     time.Now,
+	}
+}
+
+// Observe records the message, messages which are not about the execution of a prompt are ignored
+func (t *TimingTracker) Observe(message *WSMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+
+	switch d := message.Data.(type) {
+	case *WSMessageDataExecutionStart:
+		t.prompts[d.PromptID] = &PromptTimings{
+			PromptID: d.PromptID,
+			Start:    now,
+			Nodes:    make(map[string]time.Duration),
+		}
+	case *WSMessageDataExecuting:
+		timings, exist := t.prompts[d.PromptID]
+		if !exist {
+			return
+		}
+		timings.endNode(now)
+		if d.IsFinished() {
+			// older servers end a prompt with executing null instead of execution_success
+			timings.end(now)
+			return
+		}
+		timings.node, timings.nodeStart = d.DisplayNode, now
+	case *WSMessageExecuteSuccess:
+		t.endPrompt(d.PromptID, now)
+	case *WSMessageExecutionError:
+		t.endPrompt(d.PromptID, now)
+	case *WSMessageExecutionInterrupted:
+		t.endPrompt(d.PromptID, now)
+	}
+}
+
+func (t *TimingTracker) endPrompt(promptID string, now time.Time) {
+	if timings, exist := t.prompts[promptID]; exist {
+		timings.endNode(now)
+		timings.end(now)
+	}
+}
+
+// Timings returns a copy of the timings of the prompt and whether its execution_start was observed
+func (t *TimingTracker) Timings(promptID string) (*PromptTimings, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings, exist := t.prompts[promptID]
+	if !exist {
+		return nil, false
+	}
+
+	clone := *timings
+	clone.Nodes = make(map[string]time.Duration, len(timings.Nodes))
+	for node, d := range timings.Nodes {
+		clone.Nodes[node] = d
+	}
+	return &clone, true
+}
+
+// Forget drops the timings of the prompt, a long running tracker should forget the prompts it is done with
+func (t *TimingTracker) Forget(promptID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.prompts, promptID)
+}
@@ -0,0 +1,86 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimingTracker(t *testing.T) {
+	tracker := NewTimingTracker()
+	start := time.Unix(1700000000, 0)
+	now := start
+	tracker.now = func() time.Time { return now }
+
+	steps := []struct {
+		after time.Duration
+		msg   string
+	}{
+		{msg: `{"type":"execution_start","data":{"prompt_id":"p1"}}`},
+		{after: 100 * time.Millisecond, msg: executingMessage("p1", "4")},
+		{after: 2 * time.Second, msg: executingMessage("p1", "3")},
+		{after: 5 * time.Second, msg: `{"type":"progress","data":{"value":20,"max":20,"prompt_id":"p1","node":"3"}}`},
+		{after: 3 * time.Second, msg: executingMessage("p1", "9")},
+		{after: 500 * time.Millisecond, msg: executingMessage("p1", "")},
+		{after: 10 * time.Millisecond, msg: `{"type":"execution_success","data":{"prompt_id":"p1"}}`},
+	}
+	for _, step := range steps {
+		now = now.Add(step.after)
+		var message WSMessage
+		if err := json.Unmarshal([]byte(step.msg), &message); err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		tracker.Observe(&message)
+	}
+
+	timings, ok := tracker.Timings("p1")
+	if !ok {
+		t.Fatal("no timings for p1")
+	}
+	if got, want := timings.Total(), 10600*time.Millisecond; got != want {
+		t.Errorf("Total() = %v, want %v", got, want)
+	}
+	want := map[string]time.Duration{"4": 2 * time.Second, "3": 8 * time.Second, "9": 500 * time.Millisecond}
+	for node, d := range want {
+		if timings.Nodes[node] != d {
+			t.Errorf("node %s ran %v, want %v", node, timings.Nodes[node], d)
+		}
+	}
+	if len(timings.Nodes) != len(want) {
+		t.Errorf("nodes = %v, want %v", timings.Nodes, want)
+	}
+
+	timings.Nodes["4"] = 0
+	if again, _ := tracker.Timings("p1"); again.Nodes["4"] != 2*time.Second {
+		t.Error("Timings returns the tracked timings instead of a copy")
+	}
+	tracker.Forget("p1")
+	if _, ok := tracker.Timings("p1"); ok {
+		t.Error("timings of a forgotten prompt are returned")
+	}
+}
+
+func TestWithTimingTracker(t *testing.T) {
+	m := newMockServer(t)
+	tracker := NewTimingTracker()
+	c := newConnectedClient(t, m, WithTimingTracker(tracker))
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		go func() {
+			m.send(t, `{"type":"execution_start","data":{"prompt_id":"`+promptID+`"}}`)
+			m.send(t, executingMessage(promptID, "9"))
+			m.send(t, executingMessage(promptID, ""))
+		}()
+	}
+
+	if _, err := c.RunWorkflow(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err != nil {
+		t.Fatalf("RunWorkflow: %v", err)
+	}
+	timings, ok := tracker.Timings("prompt-1")
+	if !ok || timings.End.IsZero() {
+		t.Fatalf("Timings = %+v, %t, want the finished prompt", timings, ok)
+	}
+	if _, ok := timings.Nodes["9"]; !ok {
+		t.Errorf("nodes = %v, want node 9", timings.Nodes)
+	}
+}
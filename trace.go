@@ -0,0 +1,73 @@
+package comfyUIclient
+
+import "sync"
+
+// TracedNode is a node of a prompt in the order the server reached it
+type TracedNode struct {
+	NodeID string
+	// Cached reports whether the node was taken from the cache instead of being executed
+	Cached bool
+}
+
+// ExecutionTrace records the order in which the nodes of the prompts it observes are executed
+// Pass it to WithExecutionTrace to observe the messages of a client
+type ExecutionTrace struct {
+	mu      sync.Mutex
+	prompts map[string][]TracedNode
+}
+
+func NewExecutionTrace() *ExecutionTrace {
+	return &ExecutionTrace{prompts: make(map[string][]TracedNode)}
+}
+
+// Observe records the message, messages which are not about the execution of a prompt are ignored
+// A trace starts with execution_start, messages of a prompt whose start was not observed are ignored
+func (t *ExecutionTrace) Observe(message *WSMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch d := message.Data.(type) {
+	case *WSMessageDataExecutionStart:
+		t.prompts[d.PromptID] = nil
+	case *WSMessageDataExecutionCached:
+		if _, exist := t.prompts[d.PromptID]; !exist {
+			return
+		}
+		for _, node := range d.Nodes {
+			t.prompts[d.PromptID] = append(t.prompts[d.PromptID], TracedNode{NodeID: node, Cached: true})
+		}
+	case *WSMessageDataExecuting:
+		if _, exist := t.prompts[d.PromptID]; !exist || d.IsFinished() {
+			return
+		}
+		t.prompts[d.PromptID] = append(t.prompts[d.PromptID], TracedNode{NodeID: d.Node})
+	}
+}
+
+// Trace returns a copy of the traced nodes of the prompt and whether its execution_start was observed
+func (t *ExecutionTrace) Trace(promptID string) ([]TracedNode, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	nodes, exist := t.prompts[promptID]
+	if !exist {
+		return nil, false
+	}
+	return append([]TracedNode(nil), nodes...), true
+}
+
+// NodeOrder returns the ids of the traced nodes of the prompt in order, the cached ones included
+func (t *ExecutionTrace) NodeOrder(promptID string) []string {
+	nodes, _ := t.Trace(promptID)
+	order := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		order = append(order, node.NodeID)
+	}
+	return order
+}
+
+// Forget drops the trace of the prompt, a long running trace should forget the prompts it is done with
+func (t *ExecutionTrace) Forget(promptID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.prompts, promptID)
+}
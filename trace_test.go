@@ -0,0 +1,73 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExecutionTrace(t *testing.T) {
+	trace := NewExecutionTrace()
+	messages := []string{
+		executingMessage("p1", "4"),
+		`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+		`{"type":"execution_cached","data":{"nodes":["4","6"],"prompt_id":"p1"}}`,
+		executingMessage("p1", "5"),
+		`{"type":"progress","data":{"value":1,"max":20}}`,
+		executingMessage("p1", "3"),
+		executingMessage("p2", "7"),
+		executingMessage("p1", "8"),
+		executingMessage("p1", ""),
+		`{"type":"execution_success","data":{"prompt_id":"p1"}}`,
+	}
+	for _, msg := range messages {
+		var message WSMessage
+		if err := json.Unmarshal([]byte(msg), &message); err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		trace.Observe(&message)
+	}
+
+	want := []TracedNode{{"4", true}, {"6", true}, {"5", false}, {"3", false}, {"8", false}}
+	nodes, ok := trace.Trace("p1")
+	if !ok || !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Trace = %v, %t, want %v", nodes, ok, want)
+	}
+	if got := trace.NodeOrder("p1"); !reflect.DeepEqual(got, []string{"4", "6", "5", "3", "8"}) {
+		t.Errorf("NodeOrder = %v, want cached 4, 6 then 5, 3, 8", got)
+	}
+	if _, ok := trace.Trace("p2"); ok {
+		t.Error("p2 is traced without its execution_start")
+	}
+
+	nodes[0].NodeID = "changed"
+	if again := trace.NodeOrder("p1"); again[0] != "4" {
+		t.Error("Trace returns the recorded nodes instead of a copy")
+	}
+	trace.Forget("p1")
+	if got := trace.NodeOrder("p1"); len(got) != 0 {
+		t.Errorf("NodeOrder of a forgotten prompt = %v", got)
+	}
+}
+
+func TestWithExecutionTrace(t *testing.T) {
+	m := newMockServer(t)
+	trace := NewExecutionTrace()
+	c := newConnectedClient(t, m, WithExecutionTrace(trace))
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		go func() {
+			m.send(t, `{"type":"execution_start","data":{"prompt_id":"`+promptID+`"}}`)
+			m.send(t, `{"type":"execution_cached","data":{"nodes":["4"],"prompt_id":"`+promptID+`"}}`)
+			m.send(t, executingMessage(promptID, "9"))
+			m.send(t, executingMessage(promptID, ""))
+		}()
+	}
+
+	if _, err := c.RunWorkflow(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err != nil {
+		t.Fatalf("RunWorkflow: %v", err)
+	}
+	if got := trace.NodeOrder("prompt-1"); !reflect.DeepEqual(got, []string{"4", "9"}) {
+		t.Errorf("NodeOrder = %v, want [4 9]", got)
+	}
+}
@@ -0,0 +1,154 @@
+package comfyUIclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Tracer starts the span of a submitted prompt
+// It mirrors the part of the OpenTelemetry trace API the client uses, so an OpenTelemetry tracer is adapted in a
+// few lines without the client depending on OpenTelemetry
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is the span of one prompt, like an OpenTelemetry span
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	// SetStatus is called with nil once the prompt succeeds and with its error otherwise
+	SetStatus(err error)
+	End()
+}
+
+// Attribute is a key value pair of a span or an event
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+const (
+	// PromptSpanName is the name of the span of a prompt
+	PromptSpanName = "comfyui.prompt"
+	// AttributePromptID and AttributeNode are the keys of the prompt id and the node of spans and events
+	AttributePromptID = "comfyui.prompt_id"
+	AttributeNode     = "comfyui.node"
+)
+
+// promptSpans are the spans of the submitted prompts which have not ended yet
+type promptSpans struct {
+	tracer Tracer
+
+	mu    sync.Mutex
+	spans map[string]Span
+	// ended are the prompts which ended before their span was registered, with their error, the response of the
+	// submission may arrive after the last message of a fast prompt
+	ended      map[string]error
+	endedOrder []string
+}
+
+func newPromptSpans(tracer Tracer) *promptSpans {
+	return &promptSpans{
+		tracer: tracer,
+		spans:  make(map[string]Span),
+		ended:  make(map[string]error),
+	}
+}
+
+// start starts the span of a submission, register it with the prompt id once the prompt is queued
+func (p *promptSpans) start(ctx context.Context) (context.Context, Span) {
+	return p.tracer.Start(ctx, PromptSpanName)
+}
+
+// register keeps the span of the queued prompt until the prompt ends
+func (p *promptSpans) register(promptID string, span Span) {
+	span.SetAttributes(Attribute{Key: AttributePromptID, Value: promptID})
+
+	p.mu.Lock()
+	err, ended := p.ended[promptID]
+	if !ended {
+		p.spans[promptID] = span
+	}
+	p.mu.Unlock()
+	if ended {
+		span.SetStatus(err)
+		span.End()
+	}
+}
+
+// observe adds the message to the span of its prompt as an event and ends the span with the prompt
+func (p *promptSpans) observe(promptID string, message *WSMessage) {
+	finished, err := promptEnd(message)
+
+	p.mu.Lock()
+	span, exist := p.spans[promptID]
+	if finished {
+		delete(p.spans, promptID)
+		if !exist {
+			p.rememberEnded(promptID, err)
+		}
+	}
+	p.mu.Unlock()
+	if !exist {
+		return
+	}
+
+	attrs := []Attribute{{Key: AttributePromptID, Value: promptID}}
+	switch d := message.Data.(type) {
+	case *WSMessageDataExecuting:
+		if d.Node != "" {
+			attrs = append(attrs, Attribute{Key: AttributeNode, Value: d.DisplayNode})
+		}
+	case *WSMessageDataExecuted:
+		attrs = append(attrs, Attribute{Key: AttributeNode, Value: d.DisplayNode})
+	case *WSMessageDataProgress:
+		if d.DisplayNode != "" {
+			attrs = append(attrs, Attribute{Key: AttributeNode, Value: d.DisplayNode})
+		}
+		attrs = append(attrs, Attribute{Key: "comfyui.progress", Value: fmt.Sprintf("%d/%d", d.Value, d.Max)})
+	case *WSMessageExecutionError:
+		attrs = append(attrs, Attribute{Key: AttributeNode, Value: d.Node})
+	case *WSMessageExecutionInterrupted:
+		attrs = append(attrs, Attribute{Key: AttributeNode, Value: d.NodeID})
+	}
+	span.AddEvent(string(message.Type), attrs...)
+	if finished {
+		span.SetStatus(err)
+		span.End()
+	}
+}
+
+// rememberEnded keeps the end of the last prompts which had no span yet, the caller must hold mu
+func (p *promptSpans) rememberEnded(promptID string, err error) {
+	// executing null may follow the error of a prompt, the error is kept
+	if _, exist := p.ended[promptID]; exist {
+		return
+	}
+	p.ended[promptID] = err
+	p.endedOrder = append(p.endedOrder, promptID)
+	if len(p.endedOrder) > recentPromptsSize {
+		delete(p.ended, p.endedOrder[0])
+		p.endedOrder = p.endedOrder[1:]
+	}
+}
+
+// promptEnd reports whether the message ends its prompt and the error of the prompt if it did not succeed
+func promptEnd(message *WSMessage) (bool, error) {
+	switch d := message.Data.(type) {
+	case *WSMessageDataExecuting:
+		return d.IsFinished(), nil
+	case *WSMessageExecuteSuccess:
+		return true, nil
+	case *WSMessageExecutionInterrupted:
+		return true, &PromptInterruptedError{
+			PromptID: d.PromptID,
+			NodeID:   d.NodeID,
+			NodeType: d.NodeType,
+			Executed: d.Executed,
+		}
+	case *WSMessageExecutionError:
+		return true, &PromptExecutionError{WSMessageExecutionError: d}
+	}
+	return false, nil
+}
@@ -0,0 +1,199 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordedEvent struct {
+	name  string
+	attrs []Attribute
+}
+
+type recordingSpan struct {
+	mu     sync.Mutex
+	name   string
+	attrs  []Attribute
+	events []recordedEvent
+	status error
+	ended  bool
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *recordingSpan) AddEvent(name string, attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, recordedEvent{name: name, attrs: attrs})
+}
+
+func (s *recordingSpan) SetStatus(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = err
+}
+
+func (s *recordingSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+func (s *recordingSpan) isEnded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ended
+}
+
+// recordingTracer keeps the spans it starts in memory
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &recordingSpan{name: name, attrs: attrs}
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+	return ctx, span
+}
+
+func (r *recordingTracer) recorded() []*recordingSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*recordingSpan(nil), r.spans...)
+}
+
+func TestWithTracer(t *testing.T) {
+	m := newMockServer(t)
+	tracer := &recordingTracer{}
+	c := newConnectedClient(t, m, WithTracer(tracer), WithTaskStatusBufferSize(16))
+
+	resp, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+	if err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	promptID := resp.PromptID
+	m.send(t, fmt.Sprintf(`{"type":"execution_start","data":{"prompt_id":%q}}`, promptID))
+	m.send(t, executingMessage(promptID, "3"))
+	m.send(t, fmt.Sprintf(`{"type":"progress","data":{"value":1,"max":2,"prompt_id":%q,"node":"3"}}`, promptID))
+	m.send(t, executedMessage(promptID, "3", "out.png"))
+	m.send(t, fmt.Sprintf(`{"type":"execution_success","data":{"prompt_id":%q}}`, promptID))
+
+	spans := tracer.recorded()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d, want 1", len(spans))
+	}
+	span := spans[0]
+	waitFor(t, "span ended", span.isEnded)
+
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	if span.name != PromptSpanName {
+		t.Errorf("name = %q, want %q", span.name, PromptSpanName)
+	}
+	if want := []Attribute{{Key: AttributePromptID, Value: promptID}}; !reflect.DeepEqual(span.attrs, want) {
+		t.Errorf("attrs = %v, want %v", span.attrs, want)
+	}
+	if span.status != nil {
+		t.Errorf("status = %v, want nil", span.status)
+	}
+	prompt := Attribute{Key: AttributePromptID, Value: promptID}
+	node := Attribute{Key: AttributeNode, Value: "3"}
+	want := []recordedEvent{
+		{name: "execution_start", attrs: []Attribute{prompt}},
+		{name: "executing", attrs: []Attribute{prompt, node}},
+		{name: "progress", attrs: []Attribute{prompt, node, {Key: "comfyui.progress", Value: "1/2"}}},
+		{name: "executed", attrs: []Attribute{prompt, node}},
+		{name: "execution_success", attrs: []Attribute{prompt}},
+	}
+	if !reflect.DeepEqual(span.events, want) {
+		t.Errorf("events = %v, want %v", span.events, want)
+	}
+}
+
+func TestWithTracerEndsBeforeSubmissionReturns(t *testing.T) {
+	m := newMockServer(t)
+	tracer := &recordingTracer{}
+	c := newConnectedClient(t, m, WithTracer(tracer), WithTaskStatusBufferSize(16))
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		m.send(t, fmt.Sprintf(`{"type":"execution_error","data":{"prompt_id":%q,"node_id":"3","node_type":"KSampler","exception_message":"boom"}}`, promptID))
+	}
+	if _, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+
+	spans := tracer.recorded()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d, want 1", len(spans))
+	}
+	waitFor(t, "span ended", spans[0].isEnded)
+	spans[0].mu.Lock()
+	defer spans[0].mu.Unlock()
+	if !errors.Is(spans[0].status, ErrPromptFailed) {
+		t.Errorf("status = %v, want ErrPromptFailed", spans[0].status)
+	}
+}
+
+func TestWithTracerSubmissionError(t *testing.T) {
+	tracer := &recordingTracer{}
+	c, err := NewDefaultClientStr("http://127.0.0.1:1", WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	if _, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err == nil {
+		t.Fatal("QueuePrompt: want error")
+	}
+	spans := tracer.recorded()
+	if len(spans) != 1 || !spans[0].ended || spans[0].status == nil {
+		t.Fatalf("spans = %v, want one ended span with an error", spans)
+	}
+}
+
+func TestWithTracerNodeErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":{"type":"prompt_outputs_failed_validation","message":"Prompt outputs failed validation"},
+			"node_errors":{"3":{"errors":[{"type":"value_not_in_list","message":"Value not in list"}],"class_type":"KSampler"}}}`)
+	}))
+	defer server.Close()
+	tracer := &recordingTracer{}
+	progress := NewProgressTracker(nil)
+	c, err := NewDefaultClientStr(server.URL, WithTracer(tracer), WithProgressTracker(progress))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+
+	resp, err := c.QueuePrompt(context.Background(), map[string]interface{}{"3": map[string]interface{}{}})
+	if err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	if resp.PromptID != "" || len(resp.NodeErrors) != 1 {
+		t.Fatalf("resp = %+v, want the node errors without prompt id", resp)
+	}
+	spans := tracer.recorded()
+	if len(spans) != 1 || !spans[0].ended || spans[0].status == nil {
+		t.Fatalf("spans = %v, want one ended span with an error", spans)
+	}
+	if !strings.Contains(spans[0].status.Error(), "node errors") {
+		t.Errorf("status = %v, want the node errors", spans[0].status)
+	}
+	if len(c.spans.spans) != 0 {
+		t.Errorf("registered spans = %d, want 0", len(c.spans.spans))
+	}
+	if _, ok := progress.Percent(""); ok {
+		t.Error("progress is tracked for an empty prompt id")
+	}
+}
@@ -0,0 +1,262 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// uiWorkflow is the workflow format the ComfyUI front-end saves, with positions and links
+type uiWorkflow struct {
+	Nodes []*uiNode `json:"nodes"`
+	// Links are [id, origin_id, origin_slot, target_id, target_slot, type]
+	Links [][]json.RawMessage `json:"links"`
+}
+
+type uiNode struct {
+	ID            json.RawMessage `json:"id"`
+	Type          string          `json:"type"`
+	Title         string          `json:"title"`
+	Mode          int             `json:"mode"`
+	Inputs        []*uiNodeInput  `json:"inputs"`
+	WidgetsValues json.RawMessage `json:"widgets_values"`
+}
+
+type uiNodeInput struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Link *int   `json:"link"`
+}
+
+type uiLink struct {
+	originID   string
+	originSlot int
+	linkType   string
+}
+
+const (
+	uiNodeModeMuted    = 2
+	uiNodeModeBypassed = 4
+)
+
+// ConvertUIWorkflowToAPI converts a workflow saved by the front-end into the API prompt format /prompt accepts
+// It is best-effort: widget values are mapped to inputs by the input order object info reports,
+// which newer ComfyUI provides, front-end only nodes such as notes are dropped, reroutes are followed,
+// muted nodes are skipped with the inputs they feed, and bypassed nodes pass their matching input through
+func (c *Client) ConvertUIWorkflowToAPI(ctx context.Context, uiWorkflow map[string]interface{}) (map[string]interface{}, error) {
+	objectInfos, err := c.getObjectInfos(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("c.getObjectInfos: error: %w", err)
+	}
+	return convertUIWorkflow(uiWorkflow, objectInfos)
+}
+
+func convertUIWorkflow(workflow map[string]interface{}, objectInfos map[string]*NodeObject) (map[string]interface{}, error) {
+	raw, err := json.Marshal(workflow)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: error: %w", err)
+	}
+	var ui uiWorkflow
+	if err := json.Unmarshal(raw, &ui); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: error: %w", err)
+	}
+
+	nodes := make(map[string]*uiNode, len(ui.Nodes))
+	for _, node := range ui.Nodes {
+		nodes[uiNodeID(node.ID)] = node
+	}
+
+	links := make(map[int]uiLink, len(ui.Links))
+	for _, link := range ui.Links {
+		if len(link) < 3 {
+			continue
+		}
+		var id, originSlot int
+		if err := json.Unmarshal(link[0], &id); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: link id %s error: %w", link[0], err)
+		}
+		if err := json.Unmarshal(link[2], &originSlot); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: link %d origin slot error: %w", id, err)
+		}
+		var linkType string
+		if len(link) > 5 {
+			// a type which is not a string, e.g. from an old front-end, just disables matching by type
+			json.Unmarshal(link[5], &linkType)
+		}
+		links[id] = uiLink{originID: uiNodeID(link[1]), originSlot: originSlot, linkType: linkType}
+	}
+
+	prompt := make(map[string]interface{})
+	for _, node := range ui.Nodes {
+		info, exist := objectInfos[node.Type]
+		if !exist || node.Mode == uiNodeModeMuted || node.Mode == uiNodeModeBypassed {
+			continue
+		}
+
+		inputs, err := uiNodeInputs(node, info, nodes, links, objectInfos)
+		if err != nil {
+			return nil, fmt.Errorf("node %s (%s): %w", uiNodeID(node.ID), node.Type, err)
+		}
+
+		apiNode := map[string]interface{}{
+			"class_type": node.Type,
+			"inputs":     inputs,
+		}
+		if node.Title != "" {
+			apiNode["_meta"] = map[string]interface{}{"title": node.Title}
+		}
+		prompt[uiNodeID(node.ID)] = apiNode
+	}
+	return prompt, nil
+}
+
+// uiNodeInputs maps the links and widget values of a front-end node to the inputs of the API format
+func uiNodeInputs(node *uiNode, info *NodeObject, nodes map[string]*uiNode, links map[int]uiLink, objectInfos map[string]*NodeObject) (map[string]interface{}, error) {
+	inputs := make(map[string]interface{})
+
+	// some custom nodes save their widget values as an object keyed by input name
+	var namedValues map[string]interface{}
+	var values []interface{}
+	if len(node.WidgetsValues) > 0 && node.WidgetsValues[0] == '{' {
+		if err := json.Unmarshal(node.WidgetsValues, &namedValues); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: widgets_values error: %w", err)
+		}
+	} else if len(node.WidgetsValues) > 0 {
+		if err := json.Unmarshal(node.WidgetsValues, &values); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: widgets_values error: %w", err)
+		}
+	}
+
+	if namedValues == nil && len(values) > 0 {
+		if info.InputOrder == nil {
+			return nil, fmt.Errorf("object info has no input_order to map widget values")
+		}
+		configs := nodeInputs(info)
+		names := append(append([]string{}, info.InputOrder.Required...), info.InputOrder.Optional...)
+		index := 0
+		for _, name := range names {
+			config := configs[name].config
+			if !isWidgetInput(config) {
+				continue
+			}
+			if index >= len(values) {
+				break
+			}
+			inputs[name] = values[index]
+			index++
+			if hasControlAfterGenerate(name, config) {
+				// the front-end saves the control_after_generate choice right after the value
+				index++
+			}
+		}
+	}
+	for name, value := range namedValues {
+		inputs[name] = value
+	}
+
+	for _, input := range node.Inputs {
+		if input.Link == nil {
+			continue
+		}
+		link, exist := resolveUILink(*input.Link, nodes, links)
+		if !exist {
+			continue
+		}
+		if origin, exist := nodes[link.originID]; !exist || objectInfos[origin.Type] == nil {
+			// a front-end only origin such as a primitive node, its value is already in the widget values
+			continue
+		}
+		inputs[input.Name] = []interface{}{link.originID, link.originSlot}
+	}
+	return inputs, nil
+}
+
+// resolveUILink follows reroute and bypassed nodes back to the node which produces the value
+// A link whose value comes from a muted node resolves to nothing
+func resolveUILink(linkID int, nodes map[string]*uiNode, links map[int]uiLink) (uiLink, bool) {
+	for hops := 0; hops <= len(links); hops++ {
+		link, exist := links[linkID]
+		if !exist {
+			return uiLink{}, false
+		}
+		origin, exist := nodes[link.originID]
+		if !exist {
+			return link, true
+		}
+
+		var next *int
+		switch {
+		case origin.Mode == uiNodeModeMuted:
+			return uiLink{}, false
+		case origin.Type == "Reroute":
+			if len(origin.Inputs) > 0 {
+				next = origin.Inputs[0].Link
+			}
+		case origin.Mode == uiNodeModeBypassed:
+			next = bypassedInput(origin, link)
+		default:
+			return link, true
+		}
+		if next == nil {
+			return uiLink{}, false
+		}
+		linkID = *next
+	}
+	return uiLink{}, false
+}
+
+// bypassedInput returns the link of the input a bypassed node passes through to the output slot of link,
+// like the front-end it prefers the input in the same slot and falls back to the first input of the same type
+func bypassedInput(node *uiNode, link uiLink) *int {
+	if link.originSlot < len(node.Inputs) {
+		input := node.Inputs[link.originSlot]
+		if link.linkType == "" || input.Type == link.linkType {
+			return input.Link
+		}
+	}
+	for _, input := range node.Inputs {
+		if link.linkType != "" && input.Type == link.linkType {
+			return input.Link
+		}
+	}
+	return nil
+}
+
+// isWidgetInput reports whether the input is edited by a widget rather than connected by a link
+func isWidgetInput(config interface{}) bool {
+	spec, ok := config.([]interface{})
+	if !ok || len(spec) == 0 {
+		return false
+	}
+	switch t := spec[0].(type) {
+	case []interface{}:
+		return true
+	case string:
+		switch t {
+		case "INT", "FLOAT", "STRING", "BOOLEAN", "COMBO":
+			return true
+		}
+	}
+	return false
+}
+
+// hasControlAfterGenerate reports whether the front-end adds a control_after_generate widget after the input
+func hasControlAfterGenerate(name string, config interface{}) bool {
+	spec, _ := config.([]interface{})
+	if len(spec) > 1 {
+		if options, ok := spec[1].(map[string]interface{}); ok {
+			if control, ok := options["control_after_generate"].(bool); ok {
+				return control
+			}
+		}
+	}
+	if len(spec) > 0 && spec[0] == "INT" {
+		return name == "seed" || name == "noise_seed"
+	}
+	return false
+}
+
+func uiNodeID(raw json.RawMessage) string {
+	return strings.Trim(string(raw), `"`)
+}
@@ -0,0 +1,94 @@
+package comfyUIclient
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const sampleUIWorkflow = `{
+  "nodes": [
+    {"id": 1, "type": "CheckpointLoaderSimple", "mode": 0, "inputs": [], "widgets_values": ["sd15.safetensors"]},
+    {"id": 2, "type": "LoraLoader", "mode": 4, "inputs": [
+      {"name": "clip", "type": "CLIP", "link": 2},
+      {"name": "model", "type": "MODEL", "link": 1}
+    ], "widgets_values": [0.5]},
+    {"id": 3, "type": "KSampler", "title": "Sampler", "mode": 0, "inputs": [
+      {"name": "model", "type": "MODEL", "link": 3},
+      {"name": "latent_image", "type": "LATENT", "link": 4}
+    ], "widgets_values": [42, "fixed", 20]},
+    {"id": 4, "type": "EmptyLatentImage", "mode": 2, "inputs": [], "widgets_values": [512]},
+    {"id": 5, "type": "CLIPTextEncode", "mode": 0, "inputs": [{"name": "clip", "type": "CLIP", "link": 5}], "widgets_values": ["a cat"]},
+    {"id": 6, "type": "Note", "mode": 0, "widgets_values": ["just a note"]}
+  ],
+  "links": [
+    [1, 1, 0, 2, 1, "MODEL"],
+    [2, 1, 1, 2, 0, "CLIP"],
+    [3, 2, 0, 3, 0, "MODEL"],
+    [4, 4, 0, 3, 1, "LATENT"],
+    [5, 2, 1, 5, 0, "CLIP"]
+  ]
+}`
+
+func sampleObjectInfos() map[string]*NodeObject {
+	return map[string]*NodeObject{
+		"CheckpointLoaderSimple": {
+			Input:      &NodeObjectInput{Required: map[string]interface{}{"ckpt_name": []interface{}{[]interface{}{"sd15.safetensors"}}}},
+			InputOrder: &NodeInputOrder{Required: []string{"ckpt_name"}},
+		},
+		"LoraLoader": {
+			Input: &NodeObjectInput{Required: map[string]interface{}{
+				"model": []interface{}{"MODEL"}, "clip": []interface{}{"CLIP"}, "strength_model": []interface{}{"FLOAT"},
+			}},
+			InputOrder: &NodeInputOrder{Required: []string{"model", "clip", "strength_model"}},
+		},
+		"KSampler": {
+			Input: &NodeObjectInput{Required: map[string]interface{}{
+				"model": []interface{}{"MODEL"}, "seed": []interface{}{"INT"}, "steps": []interface{}{"INT"}, "latent_image": []interface{}{"LATENT"},
+			}},
+			InputOrder: &NodeInputOrder{Required: []string{"model", "seed", "steps", "latent_image"}},
+		},
+		"EmptyLatentImage": {
+			Input:      &NodeObjectInput{Required: map[string]interface{}{"width": []interface{}{"INT"}}},
+			InputOrder: &NodeInputOrder{Required: []string{"width"}},
+		},
+		"CLIPTextEncode": {
+			Input:      &NodeObjectInput{Required: map[string]interface{}{"text": []interface{}{"STRING"}, "clip": []interface{}{"CLIP"}}},
+			InputOrder: &NodeInputOrder{Required: []string{"text", "clip"}},
+		},
+	}
+}
+
+func TestConvertUIWorkflow(t *testing.T) {
+	var workflow map[string]interface{}
+	if err := json.Unmarshal([]byte(sampleUIWorkflow), &workflow); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	got, err := convertUIWorkflow(workflow, sampleObjectInfos())
+	if err != nil {
+		t.Fatalf("convertUIWorkflow: %v", err)
+	}
+
+	// the bypassed lora passes the checkpoint through by type, the muted latent drops the input it fed
+	want := map[string]interface{}{
+		"1": map[string]interface{}{
+			"class_type": "CheckpointLoaderSimple",
+			"inputs":     map[string]interface{}{"ckpt_name": "sd15.safetensors"},
+		},
+		"3": map[string]interface{}{
+			"class_type": "KSampler",
+			"inputs":     map[string]interface{}{"model": []interface{}{"1", 0}, "seed": float64(42), "steps": float64(20)},
+			"_meta":      map[string]interface{}{"title": "Sampler"},
+		},
+		"5": map[string]interface{}{
+			"class_type": "CLIPTextEncode",
+			"inputs":     map[string]interface{}{"clip": []interface{}{"1", 1}, "text": "a cat"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("convertUIWorkflow =\n%s\nwant\n%s", gotJSON, wantJSON)
+	}
+}
@@ -0,0 +1,111 @@
+package comfyUIclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is how many bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// UploadedImage is an image uploaded by UploadImageFile
+type UploadedImage struct {
+	UploadFile
+	// ContentType is the type detected from the first bytes of the file
+	ContentType string
+}
+
+// quoteEscaper escapes a file name like multipart.Writer.CreateFormFile does
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// UploadImageFile uploads the image at path to the input folder under its base name
+// The content type is detected from the first 512 bytes and the file is streamed, it is never held in memory
+func (c *Client) UploadImageFile(ctx context.Context, path string, overwrite bool) (*UploadedImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: error: %w", err)
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("io.ReadFull: error: %w", err)
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+
+	pr, pw := io.Pipe()
+	// closing the read side unblocks the writer when the request ends before the body is read
+	defer pr.Close()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		reader := io.MultiReader(bytes.NewReader(head), f)
+		pw.CloseWithError(writeUploadForm(writer, reader, filepath.Base(path), contentType, overwrite))
+	}()
+
+	headers := map[string]string{"Content-Type": writer.FormDataContentType()}
+	resp, err := c.makeRequest(ctx, http.MethodPost, string(UploadImageRouter), nil, pr, headers, "multipart/form-data")
+	if err != nil {
+		return nil, fmt.Errorf("c.makeRequest: error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll: error: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upload %s: status code %d: %s", path, resp.StatusCode, string(body))
+	}
+	uploaded := &UploadedImage{ContentType: contentType}
+	if err := json.Unmarshal(body, &uploaded.UploadFile); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: error: %w, resp.Body: %v", err, string(body))
+	}
+	return uploaded, nil
+}
+
+// NodeInputValue returns the value of the image input of a LoadImage node which loads the uploaded file
+// Files in a subfolder are referenced as subfolder/name, files outside the input folder get their folder
+// appended in brackets, like the ComfyUI frontend does
+func (u *UploadFile) NodeInputValue() string {
+	value := u.Filename
+	if u.SubFolder != "" {
+		value = path.Join(u.SubFolder, u.Filename)
+	}
+	if u.Type != "" && u.Type != string(InputImageType) {
+		value += " [" + u.Type + "]"
+	}
+	return value
+}
+
+// writeUploadForm writes the image part with its content type and the fields of an upload to the input folder
+func writeUploadForm(writer *multipart.Writer, reader io.Reader, fileName, contentType string, overwrite bool) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="image"; filename="%s"`, quoteEscaper.Replace(fileName)))
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return fmt.Errorf("writer.CreatePart: error: %w", err)
+	}
+	if _, err := io.Copy(part, reader); err != nil {
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+	if err := writer.WriteField("overwrite", fmt.Sprintf("%v", overwrite)); err != nil {
+		return fmt.Errorf("writer.WriteField: overwrite %v error: %w", overwrite, err)
+	}
+	if err := writer.WriteField("type", string(InputImageType)); err != nil {
+		return fmt.Errorf("writer.WriteField: type error: %w", err)
+	}
+	return writer.Close()
+}
@@ -0,0 +1,104 @@
+package comfyUIclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadImageFile(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 4096)...)
+	tests := []struct {
+		name            string
+		fileName        string
+		content         []byte
+		wantContentType string
+	}{
+		{name: "png", fileName: "large.png", content: png, wantContentType: "image/png"},
+		{name: "jpeg with a wrong extension", fileName: "photo.png", content: []byte("\xff\xd8\xff\xe0 jfif"), wantContentType: "image/jpeg"},
+		{name: "text", fileName: "notes.txt", content: []byte("hello"), wantContentType: "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			var gotType, gotOverwrite, gotFolder, gotName string
+			var gotContent []byte
+			m.mux.HandleFunc("/upload/image", func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseMultipartForm(1 << 20); err != nil {
+					t.Errorf("ParseMultipartForm: %v", err)
+					return
+				}
+				file, header, err := r.FormFile("image")
+				if err != nil {
+					t.Errorf("FormFile: %v", err)
+					return
+				}
+				defer file.Close()
+				gotContent, _ = io.ReadAll(file)
+				gotType, gotName = header.Header.Get("Content-Type"), header.Filename
+				gotOverwrite, gotFolder = r.FormValue("overwrite"), r.FormValue("type")
+				fmt.Fprintf(w, `{"name":%q,"subfolder":"","type":"input"}`, header.Filename)
+			})
+			c, err := NewDefaultClientStr(m.URL)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+
+			path := filepath.Join(t.TempDir(), tt.fileName)
+			if err := os.WriteFile(path, tt.content, 0o600); err != nil {
+				t.Fatalf("os.WriteFile: %v", err)
+			}
+			uploaded, err := c.UploadImageFile(context.Background(), path, true)
+			if err != nil {
+				t.Fatalf("UploadImageFile: %v", err)
+			}
+			if uploaded.ContentType != tt.wantContentType || gotType != tt.wantContentType {
+				t.Errorf("content type = %s, sent as %s, want %s", uploaded.ContentType, gotType, tt.wantContentType)
+			}
+			if !bytes.Equal(gotContent, tt.content) {
+				t.Errorf("uploaded %d bytes, want the %d bytes of the file", len(gotContent), len(tt.content))
+			}
+			if gotName != tt.fileName || uploaded.Filename != tt.fileName || gotOverwrite != "true" || gotFolder != "input" {
+				t.Errorf("uploaded %s overwrite=%s type=%s, response %+v", gotName, gotOverwrite, gotFolder, uploaded.UploadFile)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		c, err := NewDefaultClientStr("http://127.0.0.1:1")
+		if err != nil {
+			t.Fatalf("NewDefaultClientStr: %v", err)
+		}
+		if _, err := c.UploadImageFile(context.Background(), filepath.Join(t.TempDir(), "missing.png"), false); !os.IsNotExist(errors.Unwrap(err)) {
+			t.Errorf("UploadImageFile = %v, want a not exist error", err)
+		}
+	})
+}
+
+func TestNodeInputValue(t *testing.T) {
+	tests := []struct {
+		name string
+		file UploadFile
+		want string
+	}{
+		{name: "without subfolder", file: UploadFile{Filename: "a.png", Type: "input"}, want: "a.png"},
+		{name: "with subfolder", file: UploadFile{Filename: "a.png", SubFolder: "masks", Type: "input"}, want: "masks/a.png"},
+		{name: "nested subfolder", file: UploadFile{Filename: "a.png", SubFolder: "a/b/", Type: "input"}, want: "a/b/a.png"},
+		{name: "without type", file: UploadFile{Filename: "a.png"}, want: "a.png"},
+		{name: "output folder", file: UploadFile{Filename: "a.png", SubFolder: "runs", Type: "output"}, want: "runs/a.png [output]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploaded := &UploadedImage{UploadFile: tt.file}
+			if got := uploaded.NodeInputValue(); got != tt.want {
+				t.Errorf("NodeInputValue = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MinTestedVersion and MaxTestedVersion are the ComfyUI versions the client is tested with
+	// A version newer than MaxTestedVersion within the same minor version is considered tested too
+	MinTestedVersion = "0.2.0"
+	MaxTestedVersion = "0.3.0"
+)
+
+// ErrVersionUnknown is returned by ServerVersion when the server does not report its version, e.g. it is
+// older than the versions which report it
+var ErrVersionUnknown = errors.New("server version unknown")
+
+// UntestedVersionError reports a server version outside MinTestedVersion and MaxTestedVersion
+// The client may still work, but messages may have changed and fail to parse
+type UntestedVersionError struct {
+	Version string
+	// Newer is set when the version is newer than the tested ones, otherwise it is older
+	Newer bool
+}
+
+func (e *UntestedVersionError) Error() string {
+	if e.Newer {
+		return fmt.Sprintf("ComfyUI %s is newer than the tested versions %s to %s", e.Version, MinTestedVersion, MaxTestedVersion)
+	}
+	return fmt.Sprintf("ComfyUI %s is older than the tested versions %s to %s", e.Version, MinTestedVersion, MaxTestedVersion)
+}
+
+// ServerVersion returns the ComfyUI version the server reports in its system stats
+func (c *Client) ServerVersion(ctx context.Context) (string, error) {
+	resp, err := c.getJsonUsesRouter(ctx, SystemStatsRouter, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("c.getJsonUsesRouter: error: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("io.ReadAll: error: %w", err)
+	}
+	var stats SystemStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return "", fmt.Errorf("json.Unmarshal: error: %w, resp.Body: %v", err, string(body))
+	}
+	if stats.System == nil || stats.System.ComfyUIVersion == "" {
+		return "", ErrVersionUnknown
+	}
+	return stats.System.ComfyUIVersion, nil
+}
+
+// CheckServerVersion returns an UntestedVersionError when the version of the server is outside the tested ones
+func (c *Client) CheckServerVersion(ctx context.Context) error {
+	version, err := c.ServerVersion(ctx)
+	if err != nil {
+		return err
+	}
+	return checkVersion(version)
+}
+
+// checkVersion compares the major and minor version with the tested ones, a version which can not be parsed
+// is considered newer
+func checkVersion(version string) error {
+	parsed, ok := parseVersion(version)
+	if !ok {
+		return &UntestedVersionError{Version: version, Newer: true}
+	}
+	min, _ := parseVersion(MinTestedVersion)
+	max, _ := parseVersion(MaxTestedVersion)
+	if compareVersions(parsed, min) < 0 {
+		return &UntestedVersionError{Version: version}
+	}
+	if compareVersions(parsed[:2], max[:2]) > 0 {
+		return &UntestedVersionError{Version: version, Newer: true}
+	}
+	return nil
+}
+
+// parseVersion parses a version such as v0.3.10 or 0.3.10-rc1 into its major, minor and patch numbers
+func parseVersion(version string) ([]int, bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return nil, false
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
+
+func compareVersions(a, b []int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionCheckTimeout bounds the version check WithVersionCheck runs once connected
+const versionCheckTimeout = 10 * time.Second
+
+// checkVersionOnConnect runs the version check of WithVersionCheck
+func (c *Client) checkVersionOnConnect() {
+	ctx, cancel := context.WithTimeout(c.Context(), versionCheckTimeout)
+	defer cancel()
+	err := c.CheckServerVersion(ctx)
+	var untested *UntestedVersionError
+	if !errors.As(err, &untested) {
+		if err != nil && !errors.Is(err, ErrVersionUnknown) {
+			fmt.Printf("[%s] check server version error %v\n", c.baseURL, err)
+		}
+		return
+	}
+	if c.versionWarning != nil {
+		c.versionWarning(untested)
+		return
+	}
+	fmt.Printf("[%s] warning: %v\n", c.baseURL, untested)
+}
@@ -0,0 +1,95 @@
+package comfyUIclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		version   string
+		wantErr   bool
+		wantNewer bool
+	}{
+		{version: "0.2.0"},
+		{version: "v0.3.0"},
+		{version: "0.3.27"},
+		{version: "0.3.10-rc1"},
+		{version: "0.1.9", wantErr: true},
+		{version: "0.4.0", wantErr: true, wantNewer: true},
+		{version: "1.0", wantErr: true, wantNewer: true},
+		{version: "nightly", wantErr: true, wantNewer: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			err := checkVersion(tt.version)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("checkVersion = %v, want nil", err)
+				}
+				return
+			}
+			var untested *UntestedVersionError
+			if !errors.As(err, &untested) {
+				t.Fatalf("checkVersion = %v, want UntestedVersionError", err)
+			}
+			if untested.Newer != tt.wantNewer || untested.Version != tt.version {
+				t.Errorf("checkVersion = %+v, want newer %v", untested, tt.wantNewer)
+			}
+		})
+	}
+}
+
+func serveSystemStats(m *mockServer, version string) {
+	m.mux.HandleFunc("/system_stats", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"system":{"os":"posix","comfyui_version":%q,"python_version":"3.11"},"devices":[]}`, version)
+	})
+}
+
+func TestServerVersion(t *testing.T) {
+	m := newMockServer(t)
+	serveSystemStats(m, "0.3.27")
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	version, err := c.ServerVersion(context.Background())
+	if err != nil || version != "0.3.27" {
+		t.Fatalf("ServerVersion = %q, %v, want 0.3.27", version, err)
+	}
+	if err := c.CheckServerVersion(context.Background()); err != nil {
+		t.Errorf("CheckServerVersion = %v, want nil", err)
+	}
+}
+
+func TestServerVersionUnknown(t *testing.T) {
+	m := newMockServer(t)
+	serveSystemStats(m, "")
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	if _, err := c.ServerVersion(context.Background()); !errors.Is(err, ErrVersionUnknown) {
+		t.Errorf("ServerVersion error = %v, want ErrVersionUnknown", err)
+	}
+}
+
+func TestWithVersionCheck(t *testing.T) {
+	m := newMockServer(t)
+	serveSystemStats(m, "1.2.0")
+	warnings := make(chan *UntestedVersionError, 1)
+	newConnectedClient(t, m, WithVersionCheck(func(err *UntestedVersionError) { warnings <- err }))
+
+	select {
+	case err := <-warnings:
+		if err.Version != "1.2.0" || !err.Newer {
+			t.Errorf("warning = %+v, want newer version 1.2.0", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no warning about the untested version")
+	}
+}
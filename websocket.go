@@ -1,98 +1,759 @@
 package comfyUIclient
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+var (
+	// ErrNotConnected is returned when the websocket is used while it is not connected
+	ErrNotConnected = errors.New("websocket is not connected")
+	// ErrConnectionClosed is returned by waiters when the connection shuts down
+	ErrConnectionClosed = errors.New("websocket connection is closed")
+	// ErrUnauthorized is returned when the server rejects the credentials with 401 or 403
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrListening is returned by ReadMessage while a listen loop reads the connection
+	ErrListening = errors.New("websocket is read by the listen loop")
+)
+
 type WebSocketConnection struct {
-	URL         string
+	// URL is the primary url, with failover urls the one in use is returned by CurrentURL
+	URL      string
+	clientID string
+	// urls are the failover urls, urlIndex is the one dialed next, both are guarded by mu
+	urls     []string
+	urlIndex int
+	// Conn is the current connection, it is guarded by mu and replaced on every reconnect
+	// It is exported for compatibility only, using it directly races with reconnects, use Send to write
 	Conn        *websocket.Conn
+	mu          sync.Mutex
+	writeMu     sync.Mutex
 	isConnected atomic.Bool
 	MaxRetry    int
 	handler     Handler
+	// middlewares wrap handler for text frames, chain is handler wrapped by all of them, both are guarded by mu
+	middlewares []Middleware
+	chain       Handler
+	// BearerToken is sent on the handshake, it is guarded by mu, change it with SetBearerToken
 	BearerToken string
+	// ReadTimeout makes a read fail when no frame arrives within it, which triggers a reconnect
+	// It catches half-open connections, 0 disables it
+	ReadTimeout time.Duration
+	// HandlerTimeout stops waiting for a handler call after it, the message is considered dropped
+	// The timed out call keeps running, so later messages may be handled concurrently and out of order
+	// 0 waits for every call
+	HandlerTimeout time.Duration
+	// DialBackoff is the delay before the first retry of Connect, it doubles after each failed attempt
+	DialBackoff time.Duration
+	// MaxDialBackoff caps the delay between the attempts of Connect
+	MaxDialBackoff time.Duration
+	// TokenProvider returns a fresh bearer token when the handshake is rejected as unauthorized
+	// Without it an unauthorized handshake is not retried and ConnectAndListen stops
+	TokenProvider func(ctx context.Context) (string, error)
+	// ReconnectInterval is how often ConnectAndListen checks the connection and reconnects it, 0 means 5s
+	ReconnectInterval time.Duration
+	// MessageFilter drops the messages it returns false for before they reach the handler, nil passes everything
+	// Frames which can not be parsed are passed on, so the handler still reports them
+	MessageFilter func(WSMessage) bool
+	// Header is sent on every handshake along with the bearer token, set it before connecting
+	Header http.Header
+	// HeartbeatInterval is how often HeartbeatPayload is sent as a JSON text frame, for proxies which time out
+	// connections without application messages, 0 disables it
+	HeartbeatInterval time.Duration
+	HeartbeatPayload  interface{}
+	// Dialer dials the connection, nil uses websocket.DefaultDialer
+	Dialer *websocket.Dialer
+	// WireTrace receives a line for every frame sent or received, nil disables tracing
+	// It is meant for debugging, set it before connecting
+	WireTrace io.Writer
+	traceMu   sync.Mutex
+	// Limiter bounds the listen loop and dispatch workers together with the other connections sharing it,
+	// nil leaves them unbounded, set it before connecting, see Pool
+	Limiter *GoroutineLimiter
+
+	// lastMessage is the unix nanoseconds the last frame arrived, reconnects counts the reconnects of
+	// ConnectAndListen and backingOff is set while it waits before dialing again, see Health
+	lastMessage atomic.Int64
+	reconnects  atomic.Int64
+	backingOff  atomic.Bool
+	// droppedBinary counts the binary frames dropped because the handler is no BinaryHandler
+	droppedBinary atomic.Uint64
+
+	// listenDone is set while a listen loop runs and closed when it exits
+	listenDone chan struct{}
+	flushing   atomic.Bool
+
+	// ctx lives as long as the connection, it is cancelled by Shutdown or when ConnectAndListenContext returns
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+const (
+	defaultDialBackoff    = 500 * time.Millisecond
+	defaultMaxDialBackoff = 10 * time.Second
+	// defaultReconnectInterval is how often ConnectAndListen checks the connection by default
+	defaultReconnectInterval = 5 * time.Second
+	// flushIdle is how long Flush waits for another frame before it considers the connection drained
+	flushIdle = 200 * time.Millisecond
+	// wireTracePayload is how many bytes of a payload WireTrace shows
+	wireTracePayload = 256
+)
+
 type Handler interface {
 	Handle(string) error
 }
 
+// DisconnectHandler is implemented by handlers which want to know when the connection drops unexpectedly
+type DisconnectHandler interface {
+	HandleDisconnect(err error)
+}
+
+// ReconnectHandler is implemented by handlers which want to know when ConnectAndListen connects again
+// after the connection dropped, it is called from its own goroutine while the new connection is read
+type ReconnectHandler interface {
+	HandleReconnect()
+}
+
+// ErrorHandler is implemented by handlers which want the errors their Handle and HandleBinary return
+// The listen loop goes on with the next frame after it
+type ErrorHandler interface {
+	HandleError(err error)
+}
+
+// BinaryHandler is implemented by handlers which accept binary frames such as previews
+type BinaryHandler interface {
+	HandleBinary([]byte) error
+}
+
 func NewDefaultWebSocketConnection(url string, handler Handler, bearerToken string) *WebSocketConnection {
 	return NewWebSocketConnection(url, 3, handler, bearerToken)
 }
 
-func NewWebSocketConnection(url string, maxRetry int, handler Handler, bearerToken string) *WebSocketConnection {
-	return &WebSocketConnection{
-		URL:         url,
+// NewWebSocketConnection creates a websocket connection
+// If the url has no clientId query, a random client id is generated and appended,
+// without it the server would never route prompt events back to this connection
+func NewWebSocketConnection(rawURL string, maxRetry int, handler Handler, bearerToken string) *WebSocketConnection {
+	w := &WebSocketConnection{
+		URL:         rawURL,
 		MaxRetry:    maxRetry,
 		handler:     handler,
 		BearerToken: bearerToken,
 	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.clientID = clientIDOf(rawURL)
+	if w.clientID == "" {
+		w.clientID = uuid.New().String()
+		separator := "?"
+		if strings.Contains(rawURL, "?") {
+			separator = "&"
+		}
+		w.URL = rawURL + separator + "clientId=" + url.QueryEscape(w.clientID)
+	}
+	return w
+}
+
+// NewFailoverWebSocketConnection creates a websocket connection which fails over between the urls, e.g. the
+// front-ends of one backend
+// A failed dial moves to the next url, so every reconnect cycle starts where the last one left off
+// All urls are opened with the same client id, the one of the first url or a generated one
+func NewFailoverWebSocketConnection(rawURLs []string, maxRetry int, handler Handler, bearerToken string) (*WebSocketConnection, error) {
+	if len(rawURLs) == 0 {
+		return nil, errors.New("no websocket url is given")
+	}
+	w := NewWebSocketConnection(rawURLs[0], maxRetry, handler, bearerToken)
+	w.urls = append(w.urls, w.URL)
+	for _, rawURL := range rawURLs[1:] {
+		w.urls = append(w.urls, withClientID(rawURL, w.clientID))
+	}
+	return w, nil
+}
+
+// withClientID sets the clientId query of the url
+func withClientID(rawURL, clientID string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	query.Set("clientId", clientID)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// CurrentURL returns the url which is connected, or dialed next when there is no connection
+func (w *WebSocketConnection) CurrentURL() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.urls) == 0 {
+		return w.URL
+	}
+	return w.urls[w.urlIndex]
+}
+
+// failover moves to the next url after rawURL failed, unless another dial moved already
+func (w *WebSocketConnection) failover(rawURL string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.urls) > 1 && w.urls[w.urlIndex] == rawURL {
+		w.urlIndex = (w.urlIndex + 1) % len(w.urls)
+	}
+}
+
+// ClientID returns the client id the connection is opened with
+func (w *WebSocketConnection) ClientID() string {
+	return w.clientID
+}
+
+func clientIDOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("clientId")
 }
 
 // ConnectAndListen connects to the websocket and listens for messages
 func (w *WebSocketConnection) ConnectAndListen() {
-	defer w.Close()
+	w.ConnectAndListenContext(context.Background())
+}
+
+// ConnectAndListenContext connects to the websocket and listens for messages until ctx is done or Shutdown is called
+// It also stops when the handshake is rejected as unauthorized and there is no TokenProvider
+// The connection is shut down when it returns, which cancels Context
+func (w *WebSocketConnection) ConnectAndListenContext(ctx context.Context) {
+	lifecycle := w.Context()
+	defer w.Shutdown()
+	connected := false
 	for {
 		if !w.GetIsConnected() {
-			var err error
-			for i := 0; i < w.MaxRetry; i++ {
-				if err = w.Connect(); err != nil {
-					fmt.Printf("[%s] websocket connection error %v\n", w.URL, err)
-					continue
+			if err := w.connect(ctx); err != nil {
+				fmt.Printf("[%s] websocket connection error %v\n", w.CurrentURL(), err)
+				if errors.Is(err, ErrUnauthorized) && w.TokenProvider == nil {
+					// retrying forever with rejected credentials only hammers the server
+					return
+				}
+				w.backingOff.Store(true)
+			} else {
+				if !w.startListen(ctx, lifecycle) {
+					return
+				}
+				if connected {
+					w.reconnects.Add(1)
 				}
-				break
+				if reconnectHandler, ok := w.handler.(ReconnectHandler); ok && connected {
+					go reconnectHandler.HandleReconnect()
+				}
+				connected = true
 			}
+		}
 
-			if err == nil {
-				w.SetIsConnected(true)
-				go w.listen()
-			}
+		select {
+		case <-ctx.Done():
+			return
+		case <-lifecycle.Done():
+			return
+		case <-time.After(w.reconnectInterval()):
 		}
-		time.Sleep(5 * time.Second)
+		w.backingOff.Store(false)
 	}
 }
 
+// startListen starts the listen loop once Limiter has a free slot, it reports false when ctx or the connection
+// is done first
+func (w *WebSocketConnection) startListen(ctx, lifecycle context.Context) bool {
+	if w.Limiter == nil {
+		go w.listen()
+		return true
+	}
+	if !w.Limiter.acquire(ctx, lifecycle.Done()) {
+		return false
+	}
+	go func() {
+		defer w.Limiter.release()
+		w.listen()
+	}()
+	return true
+}
+
+func (w *WebSocketConnection) reconnectInterval() time.Duration {
+	if w.ReconnectInterval > 0 {
+		return w.ReconnectInterval
+	}
+	return defaultReconnectInterval
+}
+
+// Context returns the context of the connection lifecycle
+// It is cancelled once the connection shuts down, helpers bound to the connection should stop with it
+func (w *WebSocketConnection) Context() context.Context {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx == nil {
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+	}
+	return w.ctx
+}
+
+// Shutdown cancels the connection context and closes the connection, it is not reconnected afterwards
+func (w *WebSocketConnection) Shutdown() error {
+	w.Context()
+	w.cancel()
+	return w.Close()
+}
+
+// Connect dials the websocket, retrying up to MaxRetry attempts with exponential backoff
+// The backoff starts at DialBackoff and doubles up to MaxDialBackoff, use ConnectOnce for a single attempt
 func (w *WebSocketConnection) Connect() error {
+	return w.connect(context.Background())
+}
+
+func (w *WebSocketConnection) connect(ctx context.Context) error {
+	lifecycle := w.Context()
+	backoff := w.DialBackoff
+	if backoff <= 0 {
+		backoff = defaultDialBackoff
+	}
+	maxBackoff := w.MaxDialBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxDialBackoff
+	}
+
 	var err error
-	var headers map[string][]string
+	for i := 0; i == 0 || i < w.MaxRetry; i++ {
+		if i > 0 {
+			timer := time.NewTimer(backoff)
+			w.backingOff.Store(true)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				w.backingOff.Store(false)
+				return ctx.Err()
+			case <-lifecycle.Done():
+				timer.Stop()
+				w.backingOff.Store(false)
+				return ErrConnectionClosed
+			case <-timer.C:
+			}
+			w.backingOff.Store(false)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		if err = w.ConnectOnce(); err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrUnauthorized) {
+			// the same credentials will be rejected again, only a fresh token can help
+			if w.TokenProvider == nil {
+				return err
+			}
+			token, tokenErr := w.TokenProvider(ctx)
+			if tokenErr != nil {
+				return fmt.Errorf("TokenProvider: error: %v: %w", tokenErr, err)
+			}
+			w.SetBearerToken(token)
+		}
+	}
+	return err
+}
+
+func isUnauthorized(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
 
-	if w.BearerToken != "" {
-		headers = map[string][]string{
-			"Authorization": {"Bearer " + w.BearerToken},
+// SetBearerToken sets the bearer token the next handshake sends
+func (w *WebSocketConnection) SetBearerToken(token string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.BearerToken = token
+}
+
+// ConnectOnce dials the websocket once without retrying
+func (w *WebSocketConnection) ConnectOnce() error {
+	headers := w.Header.Clone()
+
+	w.mu.Lock()
+	token := w.BearerToken
+	w.mu.Unlock()
+	if token != "" {
+		if headers == nil {
+			headers = make(http.Header)
 		}
+		headers.Set("Authorization", "Bearer "+token)
 	}
 
-	w.Conn, _, err = websocket.DefaultDialer.Dial(w.URL, headers)
+	dialer := w.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	rawURL := w.CurrentURL()
+	conn, resp, err := dialer.Dial(rawURL, headers)
 	if err != nil {
-		return fmt.Errorf("[%s] websocket.DefaultDialer.Dial: error: %w", w.URL, err)
+		if resp != nil && isUnauthorized(resp.StatusCode) {
+			// the front-ends share the credentials, another url would reject them too
+			return fmt.Errorf("[%s] websocket handshake status code %d: %w", rawURL, resp.StatusCode, ErrUnauthorized)
+		}
+		w.failover(rawURL)
+		return fmt.Errorf("[%s] dialer.Dial: error: %w", rawURL, err)
 	}
+
+	w.mu.Lock()
+	w.Conn = conn
+	w.flushing.Store(false)
 	w.SetIsConnected(true)
+	w.mu.Unlock()
+	return nil
+}
+
+// currentConn returns the current connection, or ErrNotConnected when there is none
+func (w *WebSocketConnection) currentConn() (*websocket.Conn, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.GetIsConnected() || w.Conn == nil {
+		return nil, ErrNotConnected
+	}
+	return w.Conn, nil
+}
+
+// disconnect marks the connection as disconnected if conn is still the current connection
+func (w *WebSocketConnection) disconnect(conn *websocket.Conn) {
+	w.mu.Lock()
+	if w.Conn == conn {
+		w.Conn = nil
+		w.SetIsConnected(false)
+	}
+	w.mu.Unlock()
+	conn.Close()
+}
+
+// ReadMessage reads and parses one message without the listen loop, for callers which schedule the reads themselves
+// Connect with Connect or ConnectOnce instead of ConnectAndListen, the handler and MessageFilter are not used
+// Binary frames are returned as BinaryPreview messages
+// Once ctx is done the read is aborted, which leaves the connection unreadable, so it is disconnected
+func (w *WebSocketConnection) ReadMessage(ctx context.Context) (WSMessage, error) {
+	conn, err := w.currentConn()
+	if err != nil {
+		return WSMessage{}, err
+	}
+	w.mu.Lock()
+	listening := w.listenDone != nil
+	w.mu.Unlock()
+	if listening {
+		return WSMessage{}, ErrListening
+	}
+
+	if err := w.setReadDeadline(conn); err != nil {
+		return WSMessage{}, fmt.Errorf("setReadDeadline: error: %w", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		w.disconnect(conn)
+		if ctx.Err() != nil {
+			return WSMessage{}, ctx.Err()
+		}
+		return WSMessage{}, fmt.Errorf("conn.ReadMessage: error: %w", err)
+	}
+	w.trace("<-", messageType, data)
+
+	if messageType == websocket.BinaryMessage {
+		preview, err := DecodeBinaryPreview(data)
+		if err != nil {
+			return WSMessage{}, fmt.Errorf("DecodeBinaryPreview: error: %w", err)
+		}
+		return WSMessage{Type: BinaryPreview, Data: preview}, nil
+	}
+	var message WSMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return WSMessage{}, fmt.Errorf("json.Unmarshal: error: %w", err)
+	}
+	return message, nil
+}
+
+// trace writes a line about the frame to WireTrace: time, direction, kind, size and the start of the payload
+// Binary payloads are shown as hex
+func (w *WebSocketConnection) trace(direction string, messageType int, payload []byte) {
+	if w.WireTrace == nil {
+		return
+	}
+
+	kind, shown := "text", payload
+	if len(shown) > wireTracePayload {
+		shown = shown[:wireTracePayload]
+	}
+	text := string(shown)
+	if messageType == websocket.BinaryMessage {
+		kind, text = "binary", hex.EncodeToString(shown)
+	}
+	if len(payload) > wireTracePayload {
+		text += "..."
+	}
+
+	w.traceMu.Lock()
+	defer w.traceMu.Unlock()
+	fmt.Fprintf(w.WireTrace, "%s %s %s %d %s\n", time.Now().Format(time.RFC3339Nano), direction, kind, len(payload), text)
+}
+
+// Send writes v as a JSON text frame
+func (w *WebSocketConnection) Send(v interface{}) error {
+	conn, err := w.currentConn()
+	if err != nil {
+		return err
+	}
+
+	if w.WireTrace != nil {
+		if b, err := json.Marshal(v); err == nil {
+			w.trace("->", websocket.TextMessage, b)
+		}
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if err := conn.WriteJSON(v); err != nil {
+		if !w.GetIsConnected() {
+			return ErrNotConnected
+		}
+		return fmt.Errorf("conn.WriteJSON: error: %w", err)
+	}
 	return nil
 }
 
 func (w *WebSocketConnection) listen() {
-	defer w.Close()
+	conn, err := w.currentConn()
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	w.mu.Lock()
+	w.listenDone = done
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		if w.listenDone == done {
+			w.listenDone = nil
+		}
+		w.mu.Unlock()
+		close(done)
+	}()
+	if w.HeartbeatInterval > 0 {
+		go w.heartbeat(done)
+	}
+
 	for {
-		_, message, err := w.Conn.ReadMessage()
+		if err = w.setReadDeadline(conn); err != nil {
+			break
+		}
+		var messageType int
+		var message []byte
+		messageType, message, err = conn.ReadMessage()
 		if err != nil {
-			w.SetIsConnected(false)
 			break
 		}
+		w.trace("<-", messageType, message)
+		w.lastMessage.Store(time.Now().UnixNano())
+
+		w.dispatch(messageType, message)
+	}
+
+	// Close, Shutdown and Flush mark the connection as going away before the read fails
+	unexpected := w.GetIsConnected() && w.Context().Err() == nil && !w.flushing.Load()
+	w.disconnect(conn)
+	if disconnectHandler, ok := w.handler.(DisconnectHandler); ok && unexpected {
+		disconnectHandler.HandleDisconnect(err)
+	}
+}
+
+// heartbeat sends HeartbeatPayload every HeartbeatInterval until the listen loop is done
+// A failed send is only logged, the listen loop notices a dropped connection itself
+func (w *WebSocketConnection) heartbeat(done <-chan struct{}) {
+	ticker := time.NewTicker(w.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := w.Send(w.HeartbeatPayload); err != nil {
+				fmt.Printf("[%s] websocket heartbeat error %v\n", w.CurrentURL(), err)
+			}
+		}
+	}
+}
+
+// setReadDeadline sets the deadline of the next read
+// While flushing the read fails once no frame arrives within flushIdle, otherwise ReadTimeout applies
+func (w *WebSocketConnection) setReadDeadline(conn *websocket.Conn) error {
+	if !w.flushing.Load() && w.ReadTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(w.ReadTimeout)); err != nil {
+			return err
+		}
+	}
+	// Flush may have started meanwhile, its deadline must not be overridden
+	if w.flushing.Load() {
+		return conn.SetReadDeadline(time.Now().Add(flushIdle))
+	}
+	return nil
+}
+
+// Flush dispatches the frames which are already on their way, then shuts the connection down
+// It reads until no frame arrives for a short while, so a terminal message such as execution_success
+// is not lost when the connection is closed right after it was sent
+// Flush is terminal like Shutdown, without a running listen loop it shuts down right away
+func (w *WebSocketConnection) Flush(ctx context.Context) error {
+	conn, err := w.currentConn()
+	if err != nil {
+		return w.Shutdown()
+	}
+	w.mu.Lock()
+	done := w.listenDone
+	w.mu.Unlock()
+	if done == nil {
+		return w.Shutdown()
+	}
+
+	w.flushing.Store(true)
+	if err := conn.SetReadDeadline(time.Now().Add(flushIdle)); err != nil {
+		return w.Shutdown()
+	}
+
+	select {
+	case <-done:
+		return w.Shutdown()
+	case <-ctx.Done():
+		w.Shutdown()
+		return ctx.Err()
+	}
+}
+
+// dispatch calls the handler with the message, bounded by HandlerTimeout
+func (w *WebSocketConnection) dispatch(messageType int, message []byte) {
+	if !w.accept(messageType, message) {
+		return
+	}
+	if w.HandlerTimeout <= 0 {
+		w.handle(messageType, message)
+		return
+	}
+	// without a free slot the listen loop handles the message itself, waiting for one could starve it
+	if w.Limiter != nil && !w.Limiter.tryAcquire() {
+		w.handle(messageType, message)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if w.Limiter != nil {
+			defer w.Limiter.release()
+		}
+		w.handle(messageType, message)
+	}()
+
+	timer := time.NewTimer(w.HandlerTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		fmt.Printf("[%s] websocket handler timed out after %v, message dropped\n", w.URL, w.HandlerTimeout)
+	}
+}
+
+// accept reports whether MessageFilter lets the frame through
+func (w *WebSocketConnection) accept(messageType int, message []byte) bool {
+	if w.MessageFilter == nil {
+		return true
+	}
+
+	var parsed WSMessage
+	if messageType == websocket.BinaryMessage {
+		preview, err := DecodeBinaryPreview(message)
+		if err != nil {
+			return true
+		}
+		parsed = WSMessage{Type: BinaryPreview, Data: preview}
+	} else if err := json.Unmarshal(message, &parsed); err != nil {
+		return true
+	}
+	return w.MessageFilter(parsed)
+}
 
-		w.handler.Handle(string(message))
+// Use wraps the handler of text frames in middleware, for logging, metrics, filtering or tracing
+// The middleware added first runs first, the handler itself runs last; binary frames and the other handler
+// interfaces such as ReconnectHandler bypass the middlewares
+func (w *WebSocketConnection) Use(middleware Middleware) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.middlewares = append(w.middlewares, middleware)
+	chain := w.handler
+	for i := len(w.middlewares) - 1; i >= 0; i-- {
+		chain = w.middlewares[i](chain)
 	}
+	w.chain = chain
+}
 
+func (w *WebSocketConnection) handle(messageType int, message []byte) {
+	var err error
+	if messageType == websocket.BinaryMessage {
+		binaryHandler, ok := w.handler.(BinaryHandler)
+		if !ok {
+			// a binary frame is no text message, passing it to Handle would only produce a parse error
+			w.droppedBinary.Add(1)
+			return
+		}
+		err = binaryHandler.HandleBinary(message)
+	} else {
+		w.mu.Lock()
+		handler := w.chain
+		w.mu.Unlock()
+		if handler == nil {
+			handler = w.handler
+		}
+		err = handler.Handle(string(message))
+	}
+	if errorHandler, ok := w.handler.(ErrorHandler); ok && err != nil {
+		errorHandler.HandleError(err)
+	}
+}
+
+// DroppedBinaryFrames returns the number of binary frames dropped because the handler is no BinaryHandler
+func (w *WebSocketConnection) DroppedBinaryFrames() uint64 {
+	return w.droppedBinary.Load()
 }
 
 func (w *WebSocketConnection) Close() error {
-	if err := w.Conn.Close(); err != nil {
+	w.mu.Lock()
+	conn := w.Conn
+	w.SetIsConnected(false)
+	w.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	if err := conn.Close(); err != nil {
 		return fmt.Errorf(" w.Conn.Close() error: %w", err)
 	}
 	return nil
@@ -112,82 +773,223 @@ type WSMessage struct {
 }
 
 var (
-	messageTypeMap map[WsMessageType]func() interface{}
-	once           sync.Once
+	// messageTypeMu guards messageTypeMap, which RegisterMessageType extends
+	messageTypeMu  sync.RWMutex
+	messageTypeMap = map[WsMessageType]func() interface{}{
+		Status:               func() interface{} { return &WSMessageDataStatus{} },
+		ExecutionStart:       func() interface{} { return &WSMessageDataExecutionStart{} },
+		ExecutionCached:      func() interface{} { return &WSMessageDataExecutionCached{} },
+		Executing:            func() interface{} { return &WSMessageDataExecuting{} },
+		Progress:             func() interface{} { return &WSMessageDataProgress{} },
+		Executed:             func() interface{} { return &WSMessageDataExecuted{} },
+		ExecutionInterrupted: func() interface{} { return &WSMessageExecutionInterrupted{} },
+		ExecutionError:       func() interface{} { return &WSMessageExecutionError{} },
+		ExecutionSuccess:     func() interface{} { return &WSMessageExecuteSuccess{} },
+		QueueUpdated:         func() interface{} { return &WSMessageDataQueueUpdated{} },
+		QueueEvent:           func() interface{} { return &WSMessageDataQueueUpdated{} },
+	}
 )
 
-func getWSMessageData(messageType WsMessageType) interface{} {
-	once.Do(func() {
-		messageTypeMap = map[WsMessageType]func() interface{}{
-			Status:               func() interface{} { return &WSMessageDataStatus{} },
-			ExecutionStart:       func() interface{} { return &WSMessageDataExecutionStart{} },
-			ExecutionCached:      func() interface{} { return &WSMessageDataExecutionCached{} },
-			Executing:            func() interface{} { return &WSMessageDataExecuting{} },
-			Progress:             func() interface{} { return &WSMessageDataProgress{} },
-			Executed:             func() interface{} { return &WSMessageDataExecuted{} },
-			ExecutionInterrupted: func() interface{} { return &WSMessageExecutionInterrupted{} },
-			ExecutionError:       func() interface{} { return &WSMessageExecutionError{} },
-			ExecutionSuccess:     func() interface{} { return &WSMessageExecuteSuccess{} },
-		}
-	})
+// RegisterMessageType makes messages of the type decode their data into the value newData returns, e.g. the
+// events of a custom node
+// Messages of a registered type are sent to the task status channel, a built-in type can not be replaced
+func RegisterMessageType(messageType WsMessageType, newData func() interface{}) error {
+	if messageType.IsKnown() {
+		return fmt.Errorf("message type %s is already registered", messageType)
+	}
+	messageTypeMu.Lock()
+	defer messageTypeMu.Unlock()
+	messageTypeMap[messageType] = newData
+	return nil
+}
+
+// RegisteredMessageTypes returns the message types the client understands sorted by name, the built-in ones
+// including BinaryPreview and the ones added with RegisterMessageType
+func RegisteredMessageTypes() []WsMessageType {
+	messageTypeMu.RLock()
+	types := make([]WsMessageType, 0, len(messageTypeMap)+1)
+	for messageType := range messageTypeMap {
+		types = append(types, messageType)
+	}
+	messageTypeMu.RUnlock()
+	types = append(types, BinaryPreview)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
 
+// isRegisteredMessageType reports whether the message type is one added with RegisterMessageType
+func isRegisteredMessageType(messageType WsMessageType) bool {
+	if isBuiltinMessageType(messageType) {
+		return false
+	}
+	messageTypeMu.RLock()
+	defer messageTypeMu.RUnlock()
+	_, exist := messageTypeMap[messageType]
+	return exist
+}
+
+func getWSMessageData(messageType WsMessageType) interface{} {
+	messageTypeMu.RLock()
 	fn, exist := messageTypeMap[messageType]
+	messageTypeMu.RUnlock()
 	if !exist {
 		return &WSEmptyMessage{}
 	}
 	return fn()
 }
 
+// UnmarshalJSON decodes the data by the type of the message, a failure is returned as a ParseError
 func (m *WSMessage) UnmarshalJSON(b []byte) error {
 	var temp struct {
 		Type WsMessageType   `json:"type"`
 		Data json.RawMessage `json:"data"`
 	}
 	if err := json.Unmarshal(b, &temp); err != nil {
-		return err
+		return newParseError("", b, err)
 	}
 
 	m.Type = temp.Type
 	messageData := getWSMessageData(m.Type)
 	if messageData != nil {
 		if err := json.Unmarshal(temp.Data, messageData); err != nil {
-			return err
+			return newParseError(m.Type, b, err)
 		}
 		m.Data = messageData
 	}
 	return nil
 }
 
+// ParseError is returned when a frame can not be decoded, e.g. it is malformed or the data of its type changed
+// Raw is the frame as it was received, Type is empty when the frame is not even a message
+type ParseError struct {
+	Type WsMessageType
+	Raw  []byte
+	Err  error
+}
+
+func newParseError(messageType WsMessageType, raw []byte, err error) *ParseError {
+	return &ParseError{Type: messageType, Raw: append([]byte(nil), raw...), Err: err}
+}
+
+func (e *ParseError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("parse message: %v", e.Err)
+	}
+	return fmt.Sprintf("parse %s message: %v", e.Type, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON encodes the message the way the server sends it, {"type": ..., "data": ...}
+// The data of a message type the client does not know is not kept, it is encoded empty
+func (m WSMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type WsMessageType `json:"type"`
+		Data interface{}   `json:"data"`
+	}{Type: m.Type, Data: m.Data})
+}
+
 //	WSMessageDataStatus
 //
 // Json {"type": "status", "data": {"status": {"exec_info": {"queue_remaining": 1}}}}
 type WSMessageDataStatus struct {
 	Status struct {
-		ExecInfo struct {
-			QueueRemaining int `json:"queue_remaining"`
-		} `json:"exec_info"`
+		// ExecInfo is nil when the server sends no exec_info, e.g. a status which only carries the sid
+		ExecInfo *StatusExecInfo `json:"exec_info"`
 	} `json:"status"`
 	SID string `json:"sid"`
 }
 
+// StatusExecInfo is the queue state of a status message
+type StatusExecInfo struct {
+	QueueRemaining int `json:"queue_remaining"`
+}
+
 // WSMessageDataExecutionStart
 // Json {"type": "execution_start", "data": {"prompt_id": "ed986d60-2a27-4d28-8871-2fdb36582902"}}
 type WSMessageDataExecutionStart struct {
-	PromptID string `json:"prompt_id"`
+	PromptID  string      `json:"prompt_id"`
+	Timestamp MessageTime `json:"timestamp"`
 }
 
 // WSMessageDataExecutionCached
 // json {"type": "execution_cached", "data": {"nodes": [], "prompt_id": "ed986d60-2a27-4d28-8871-2fdb36582902"}}
 type WSMessageDataExecutionCached struct {
-	Nodes    []string `json:"nodes"`
-	PromptID string   `json:"prompt_id"`
+	Nodes     []string    `json:"nodes"`
+	PromptID  string      `json:"prompt_id"`
+	Timestamp MessageTime `json:"timestamp"`
+}
+
+func (d *WSMessageDataExecutionCached) UnmarshalJSON(b []byte) error {
+	type plain WSMessageDataExecutionCached
+	aux := struct {
+		*plain
+		Nodes []NodeID `json:"nodes"`
+	}{plain: (*plain)(d)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	d.Nodes = nodeIDStrings(aux.Nodes)
+	return nil
 }
 
 // WSMessageDataExecuting
 // json {"type": "executing", "data": {"node": "12", "prompt_id": "ed986d60-2a27-4d28-8871-2fdb36582902"}}
 type WSMessageDataExecuting struct {
-	Node     string `json:"node"`
-	PromptID string `json:"prompt_id"`
+	Node string `json:"node"`
+	// DisplayNode is the node of the submitted workflow, which differs from Node for the nodes a subgraph
+	// expands to, it is Node when the server does not send it
+	DisplayNode string `json:"display_node"`
+	PromptID    string `json:"prompt_id"`
+}
+
+func (d *WSMessageDataExecuting) UnmarshalJSON(b []byte) error {
+	type plain WSMessageDataExecuting
+	aux := struct {
+		*plain
+		Node        NodeID `json:"node"`
+		DisplayNode NodeID `json:"display_node"`
+	}{plain: (*plain)(d)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	d.Node, d.DisplayNode = string(aux.Node), string(aux.DisplayNode)
+	if d.DisplayNode == "" {
+		d.DisplayNode = d.Node
+	}
+	return nil
+}
+
+// IsFinished reports whether the message ends its prompt, ComfyUI sends it without node once every node ran
+// Servers send the node as null or, in some versions, as an empty string, both decode to an empty Node
+func (d *WSMessageDataExecuting) IsFinished() bool {
+	return d.Node == ""
+}
+
+// MarshalJSON encodes the end of a prompt as node null and leaves out a display node equal to the node,
+// like the server does
+func (d WSMessageDataExecuting) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Node        *string `json:"node"`
+		DisplayNode string  `json:"display_node,omitempty"`
+		PromptID    string  `json:"prompt_id"`
+	}{Node: optionalNode(d.Node), DisplayNode: distinctDisplayNode(d.Node, d.DisplayNode), PromptID: d.PromptID})
+}
+
+func optionalNode(node string) *string {
+	if node == "" {
+		return nil
+	}
+	return &node
+}
+
+func distinctDisplayNode(node, displayNode string) string {
+	if displayNode == node {
+		return ""
+	}
+	return displayNode
 }
 
 // WSMessageDataProgress
@@ -196,13 +998,46 @@ type WSMessageDataExecuting struct {
   "type": "progress",
   "data": {
     "value": 18,
-    "max": 20
+    "max": 20,
+    "prompt_id": "ed986d60-2a27-4d28-8871-2fdb36582902",
+    "node": "3"
   }
 }
 */
 type WSMessageDataProgress struct {
 	Value int `json:"value"`
 	Max   int `json:"max"`
+	// PromptID and Node are sent by newer servers only, progress without them belongs to the running prompt
+	PromptID string `json:"prompt_id,omitempty"`
+	Node     string `json:"node,omitempty"`
+	// DisplayNode is the node of the submitted workflow, it is Node when the server does not send it
+	DisplayNode string `json:"display_node,omitempty"`
+}
+
+func (d *WSMessageDataProgress) UnmarshalJSON(b []byte) error {
+	type plain WSMessageDataProgress
+	aux := struct {
+		*plain
+		Node        NodeID `json:"node"`
+		DisplayNode NodeID `json:"display_node"`
+	}{plain: (*plain)(d)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	d.Node, d.DisplayNode = string(aux.Node), string(aux.DisplayNode)
+	if d.DisplayNode == "" {
+		d.DisplayNode = d.Node
+	}
+	return nil
+}
+
+// MarshalJSON leaves out a display node equal to the node, like the server does
+func (d WSMessageDataProgress) MarshalJSON() ([]byte, error) {
+	type plain WSMessageDataProgress
+	return json.Marshal(struct {
+		plain
+		DisplayNode string `json:"display_node,omitempty"`
+	}{plain: plain(d), DisplayNode: distinctDisplayNode(d.Node, d.DisplayNode)})
 }
 
 //
@@ -215,9 +1050,102 @@ type WSMessageDataProgress struct {
 */
 
 type WSMessageDataExecuted struct {
-	Node     string `json:"node"`
-	PromptID string `json:"prompt_id"`
-	Output   map[string][]*DataOutputFile
+	Node string `json:"node"`
+	// DisplayNode is the node of the submitted workflow, it is Node when the server does not send it
+	DisplayNode string                       `json:"display_node"`
+	PromptID    string                       `json:"prompt_id"`
+	Output      map[string][]*DataOutputFile `json:"output"`
+	// scalars are the outputs which are no files, such as the seed a sampler used, see Scalar
+	scalars map[string]json.RawMessage
+}
+
+func (d *WSMessageDataExecuted) UnmarshalJSON(b []byte) error {
+	type plain WSMessageDataExecuted
+	aux := struct {
+		*plain
+		Node        NodeID                     `json:"node"`
+		DisplayNode NodeID                     `json:"display_node"`
+		Output      map[string]json.RawMessage `json:"output"`
+	}{plain: (*plain)(d)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	d.Node, d.DisplayNode = string(aux.Node), string(aux.DisplayNode)
+	if d.DisplayNode == "" {
+		d.DisplayNode = d.Node
+	}
+
+	d.Output, d.scalars = nil, nil
+	if aux.Output != nil {
+		d.Output = make(map[string][]*DataOutputFile, len(aux.Output))
+	}
+	for key, raw := range aux.Output {
+		if files, ok := outputFiles(raw); ok {
+			d.Output[key] = files
+			continue
+		}
+		if d.scalars == nil {
+			d.scalars = make(map[string]json.RawMessage)
+		}
+		d.scalars[key] = raw
+	}
+	return nil
+}
+
+// outputFiles decodes an output which is a list of files, an element without a filename or inline data is
+// no file
+func outputFiles(raw json.RawMessage) ([]*DataOutputFile, bool) {
+	var elements []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &elements); err != nil {
+		return nil, false
+	}
+	for _, element := range elements {
+		_, hasFilename := element["filename"]
+		_, hasData := element["data"]
+		if !hasFilename && !hasData {
+			return nil, false
+		}
+	}
+	var files []*DataOutputFile
+	if err := json.Unmarshal(raw, &files); err != nil {
+		return nil, false
+	}
+	return files, true
+}
+
+// Scalar returns the output of the key which is no file, such as the seed a sampler used
+// ComfyUI sends every output as a list, a list of one value is returned as the value itself
+func (d *WSMessageDataExecuted) Scalar(key string) (json.RawMessage, bool) {
+	raw, ok := d.scalars[key]
+	if !ok {
+		return nil, false
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(raw, &values); err == nil && len(values) == 1 {
+		return values[0], true
+	}
+	return raw, true
+}
+
+// MarshalJSON leaves out a display node equal to the node, like the server does
+func (d WSMessageDataExecuted) MarshalJSON() ([]byte, error) {
+	type plain WSMessageDataExecuted
+	var output interface{} = d.Output
+	if len(d.scalars) > 0 {
+		merged := make(map[string]interface{}, len(d.Output)+len(d.scalars))
+		for key, raw := range d.scalars {
+			merged[key] = raw
+		}
+		for key, files := range d.Output {
+			merged[key] = files
+		}
+		output = merged
+	}
+	return json.Marshal(struct {
+		plain
+		DisplayNode string      `json:"display_node,omitempty"`
+		Output      interface{} `json:"output"`
+	}{plain: plain(d), DisplayNode: distinctDisplayNode(d.Node, d.DisplayNode), Output: output})
 }
 
 // WSMessageExecutionInterrupted
@@ -225,19 +1153,76 @@ type WSMessageDataExecuted struct {
 {"type": "execution_interrupted", "data": {"prompt_id": "dc7093d7-980a-4fe6-bf0c-f6fef932c74b", "node_id": "19", "node_type": "SaveImage", "executed": ["5", "17", "10", "11"]}}
 */
 type WSMessageExecutionInterrupted struct {
-	PromptID string   `json:"prompt_id"`
-	NodeID   string   `json:"node_id"`
-	NodeType string   `json:"node_type"`
-	Executed []string `json:"executed"`
+	PromptID  string      `json:"prompt_id"`
+	NodeID    string      `json:"node_id"`
+	NodeType  string      `json:"node_type"`
+	Executed  []string    `json:"executed"`
+	Timestamp MessageTime `json:"timestamp"`
+}
+
+func (d *WSMessageExecutionInterrupted) UnmarshalJSON(b []byte) error {
+	type plain WSMessageExecutionInterrupted
+	aux := struct {
+		*plain
+		NodeID   NodeID   `json:"node_id"`
+		Executed []NodeID `json:"executed"`
+	}{plain: (*plain)(d)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	d.NodeID, d.Executed = string(aux.NodeID), nodeIDStrings(aux.Executed)
+	return nil
+}
+
+// WSMessageDataQueueUpdated is the queue a queue_updated or queue message carries, like /queue returns it
+// Json {"type": "queue_updated", "data": {"queue_running": [[0, "p1", {...}, {...}, ["9"]]], "queue_pending": []}}
+type WSMessageDataQueueUpdated struct {
+	QueueInfo
 }
 
 type WSMessageExecuteSuccess struct {
-	PromptID string `json:"prompt_id"`
+	PromptID  string      `json:"prompt_id"`
+	Timestamp MessageTime `json:"timestamp"`
 }
 
 type WSEmptyMessage struct {
 }
 
+// WSBinaryPreview is decoded from a binary frame
+// The frame starts with a big endian uint32 event type, PreviewImageEventType is followed by
+// a big endian uint32 image format (1 jpeg, 2 png) and the image bytes
+// For other event types Data holds the raw payload after the event type
+type WSBinaryPreview struct {
+	EventType   BinaryEventType
+	ImageFormat uint32
+	Data        []byte
+}
+
+// IsImagePreview reports whether the frame is a preview image, whose Data is a jpeg or png
+func (p *WSBinaryPreview) IsImagePreview() bool {
+	return p.EventType == PreviewImageEventType
+}
+
+// DecodeBinaryPreview decodes a binary frame, unknown event types keep their raw payload
+func DecodeBinaryPreview(b []byte) (*WSBinaryPreview, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("binary frame is too short: %d bytes", len(b))
+	}
+
+	p := &WSBinaryPreview{
+		EventType: BinaryEventType(binary.BigEndian.Uint32(b[:4])),
+		Data:      b[4:],
+	}
+	if p.IsImagePreview() {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("preview image frame is too short: %d bytes", len(b))
+		}
+		p.ImageFormat = binary.BigEndian.Uint32(b[4:8])
+		p.Data = b[8:]
+	}
+	return p, nil
+}
+
 type WSMessageExecutionError struct {
 	PromptID         string                 `json:"prompt_id"`
 	Node             string                 `json:"node_id"`
@@ -248,4 +1233,158 @@ type WSMessageExecutionError struct {
 	Traceback        []string               `json:"traceback"`
 	CurrentInputs    map[string]interface{} `json:"current_inputs"`
 	CurrentOutputs   map[int]interface{}    `json:"current_outputs"`
+	Timestamp        MessageTime            `json:"timestamp"`
+}
+
+func (e *WSMessageExecutionError) UnmarshalJSON(b []byte) error {
+	type plain WSMessageExecutionError
+	aux := struct {
+		*plain
+		Node     NodeID   `json:"node_id"`
+		Executed []NodeID `json:"executed"`
+	}{plain: (*plain)(e)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	e.Node, e.Executed = string(aux.Node), nodeIDStrings(aux.Executed)
+	return nil
+}
+
+// IsOutOfMemory reports whether the node failed because the device ran out of memory, e.g. CUDA OOM
+func (e *WSMessageExecutionError) IsOutOfMemory() bool {
+	return strings.Contains(e.ExceptionType, "OutOfMemoryError") ||
+		strings.Contains(strings.ToLower(e.ExceptionMessage), "out of memory")
+}
+
+// TracebackString returns the traceback as one text, a line per line of the Python traceback
+// The server sends the frames of the traceback, each may span several lines and ends with a newline
+func (e *WSMessageExecutionError) TracebackString() string {
+	lines := make([]string, 0, len(e.Traceback))
+	for _, line := range e.Traceback {
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ShortError returns the line of the exception, e.g. "RuntimeError: mat1 and mat2 shapes cannot be multiplied"
+// Without an exception message it is the last line of the traceback
+func (e *WSMessageExecutionError) ShortError() string {
+	message := strings.TrimSpace(e.ExceptionMessage)
+	if message == "" {
+		lines := strings.Split(strings.TrimSpace(e.TracebackString()), "\n")
+		return strings.TrimSpace(lines[len(lines)-1])
+	}
+	// the message may span lines, the first one says what went wrong
+	message, _, _ = strings.Cut(message, "\n")
+	if e.ExceptionType == "" {
+		return message
+	}
+	return e.ExceptionType + ": " + strings.TrimSpace(message)
+}
+
+// PartialOutputs returns the output files found in CurrentOutputs, the results the nodes executed before the error
+// produced, so a failed run can still return them
+// CurrentOutputs holds the raw outputs of the nodes, a file is any object with a filename at any depth of them,
+// they are returned ordered by output index
+func (e *WSMessageExecutionError) PartialOutputs() []*DataOutputFile {
+	indexes := make([]int, 0, len(e.CurrentOutputs))
+	for i := range e.CurrentOutputs {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	var files []*DataOutputFile
+	for _, i := range indexes {
+		files = appendNewFiles(files, findOutputFiles(e.CurrentOutputs[i]))
+	}
+	return files
+}
+
+// findOutputFiles walks a decoded JSON value and returns the objects which look like output files
+func findOutputFiles(v interface{}) []*DataOutputFile {
+	switch v := v.(type) {
+	case []interface{}:
+		var files []*DataOutputFile
+		for _, item := range v {
+			files = append(files, findOutputFiles(item)...)
+		}
+		return files
+	case map[string]interface{}:
+		if name, ok := v["filename"].(string); ok && name != "" {
+			file := &DataOutputFile{Filename: name}
+			file.SubFolder, _ = v["subfolder"].(string)
+			file.Type, _ = v["type"].(string)
+			file.Data, _ = v["data"].(string)
+			return []*DataOutputFile{file}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var files []*DataOutputFile
+		for _, key := range keys {
+			files = append(files, findOutputFiles(v[key])...)
+		}
+		return files
+	}
+	return nil
+}
+
+// NodeID is a node id as the server sends it, some forks send a JSON number instead of a string
+// The message structs keep node ids as strings, they decode them through NodeID
+type NodeID string
+
+func (id *NodeID) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*id = ""
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*id = NodeID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("node id %s is neither a string nor a number", b)
+	}
+	*id = NodeID(n.String())
+	return nil
+}
+
+// nodeIDStrings converts the node ids, nil stays nil
+func nodeIDStrings(ids []NodeID) []string {
+	if ids == nil {
+		return nil
+	}
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = string(id)
+	}
+	return s
+}
+
+// MessageTime is the unix milliseconds timestamp newer ComfyUI adds to execution messages
+// It is zero when the message has no timestamp or a malformed one, which never fails the message
+type MessageTime struct {
+	time.Time
+}
+
+func (t *MessageTime) UnmarshalJSON(b []byte) error {
+	var millis float64
+	if string(b) == "null" || json.Unmarshal(b, &millis) != nil {
+		t.Time = time.Time{}
+		return nil
+	}
+	t.Time = time.UnixMilli(int64(millis))
+	return nil
+}
+
+// MarshalJSON writes the timestamp back as unix milliseconds, or null when it is zero
+func (t MessageTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return []byte(strconv.FormatInt(t.UnixMilli(), 10)), nil
 }
@@ -0,0 +1,1066 @@
+package comfyUIclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlushDeliversInFlightMessage(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithTaskStatusBufferSize(4))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.send(t, `{"type":"execution_success","data":{"prompt_id":"p1"}}`)
+	}()
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if c.Context().Err() == nil {
+		t.Error("connection context is not cancelled after Flush")
+	}
+	select {
+	case message := <-c.GetTaskStatus():
+		if message.Type != ExecutionSuccess {
+			t.Errorf("message type = %s, want %s", message.Type, ExecutionSuccess)
+		}
+	default:
+		t.Fatal("execution_success is lost")
+	}
+}
+
+func TestFlushWithoutListenLoop(t *testing.T) {
+	m := newMockServer(t)
+	ws := NewDefaultWebSocketConnection(mockWebSocketURL(m), NewTeeHandler(nil, nil), "")
+	if err := ws.ConnectOnce(); err != nil {
+		t.Fatalf("ConnectOnce: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ws.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if ws.GetIsConnected() {
+		t.Error("connection is still connected after Flush")
+	}
+}
+
+func TestNewWebSocketConnectionGeneratesClientID(t *testing.T) {
+	tests := []struct {
+		name   string
+		rawURL string
+		wantID string
+	}{
+		{name: "no query", rawURL: "ws://127.0.0.1:8188/ws"},
+		{name: "other query", rawURL: "ws://127.0.0.1:8188/ws?foo=bar"},
+		{name: "client id", rawURL: "ws://127.0.0.1:8188/ws?clientId=given", wantID: "given"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := NewDefaultWebSocketConnection(tt.rawURL, NewTeeHandler(nil, nil), "")
+			if tt.wantID != "" && ws.ClientID() != tt.wantID {
+				t.Errorf("ClientID() = %s, want %s", ws.ClientID(), tt.wantID)
+			}
+			if ws.ClientID() == "" {
+				t.Fatal("no client id is generated")
+			}
+			if got := clientIDOf(ws.URL); got != ws.ClientID() {
+				t.Errorf("url %s carries client id %s, want %s", ws.URL, got, ws.ClientID())
+			}
+		})
+	}
+}
+
+func binaryFrame(eventType BinaryEventType, payload ...byte) []byte {
+	b := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(eventType))
+	return append(b, payload...)
+}
+
+func TestDecodeBinaryPreview(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		want    *WSBinaryPreview
+		wantErr bool
+	}{
+		{
+			name:  "preview image",
+			frame: binaryFrame(PreviewImageEventType, 0, 0, 0, 2, 0x89, 'P', 'N', 'G'),
+			want:  &WSBinaryPreview{EventType: PreviewImageEventType, ImageFormat: 2, Data: []byte{0x89, 'P', 'N', 'G'}},
+		},
+		{
+			name:  "unknown event type",
+			frame: binaryFrame(7, 'r', 'a', 'w'),
+			want:  &WSBinaryPreview{EventType: 7, Data: []byte("raw")},
+		},
+		{name: "too short", frame: []byte{0, 1}, wantErr: true},
+		{
+			name:  "text",
+			frame: binaryFrame(TextEventType, 'h', 'i'),
+			want:  &WSBinaryPreview{EventType: TextEventType, Data: []byte("hi")},
+		},
+		{name: "truncated preview image", frame: binaryFrame(PreviewImageEventType, 0, 0), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeBinaryPreview(tt.frame)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DecodeBinaryPreview = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeBinaryPreview: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeBinaryPreview = %+v, want %+v", got, tt.want)
+			}
+			if got.IsImagePreview() != (tt.want.EventType == PreviewImageEventType) {
+				t.Errorf("IsImagePreview() = %t for event type %d", got.IsImagePreview(), got.EventType)
+			}
+		})
+	}
+}
+
+func TestUnknownBinaryFrameIsDelivered(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithBinaryPreviews(), WithTaskStatusBufferSize(1))
+
+	m.sendBinary(t, binaryFrame(7, 'r', 'a', 'w'))
+	message := receive(t, c)
+	preview, ok := message.Data.(*WSBinaryPreview)
+	if message.Type != BinaryPreview || !ok {
+		t.Fatalf("message = %s %T, want a binary preview", message.Type, message.Data)
+	}
+	if preview.EventType != 7 || string(preview.Data) != "raw" {
+		t.Errorf("preview = %+v, want event type 7 with the raw payload", preview)
+	}
+}
+
+func TestBinaryFrameWithoutBinaryHandler(t *testing.T) {
+	m := newMockServer(t)
+	handled := make(chan string, 4)
+	ws := NewDefaultWebSocketConnection(mockWebSocketURL(m), handlerFunc(func(msg string) error {
+		handled <- msg
+		return nil
+	}), "")
+	go ws.ConnectAndListen()
+	defer ws.Shutdown()
+
+	// the status message the mock sends on connect
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("status message is not handled")
+	}
+
+	m.sendBinary(t, binaryFrame(1, 'p', 'n', 'g'))
+	m.send(t, `{"type":"after"}`)
+	select {
+	case msg := <-handled:
+		if msg != `{"type":"after"}` {
+			t.Fatalf("Handle called with %q, want only the text frame", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("text frame is not handled")
+	}
+	if got := ws.DroppedBinaryFrames(); got != 1 {
+		t.Errorf("DroppedBinaryFrames = %d, want 1", got)
+	}
+}
+
+func TestBinaryFrameWithoutBinaryPreviews(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithTaskStatusBufferSize(4))
+
+	m.sendBinary(t, binaryFrame(1, 'p', 'n', 'g'))
+	waitFor(t, "dropped binary frame", func() bool { return c.DroppedBinaryFrames() == 1 })
+	select {
+	case message := <-c.GetTaskStatus():
+		t.Errorf("task status got %s, want nothing", message.Type)
+	default:
+	}
+}
+
+func TestReadDeadlineReconnects(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithReadDeadline(100*time.Millisecond), WithReconnectInterval(20*time.Millisecond))
+
+	// the server never sends another frame after the status, the read deadline must catch it
+	waitFor(t, "reconnect", func() bool { return m.connCount() >= 2 })
+	waitFor(t, "connection", c.IsInitialized)
+}
+
+// handlerFunc adapts a function to Handler
+type handlerFunc func(string) error
+
+func (f handlerFunc) Handle(msg string) error {
+	return f(msg)
+}
+
+func mockWebSocketURL(m *mockServer) string {
+	return "ws" + strings.TrimPrefix(m.URL, "http") + "/ws"
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	m := newMockServer(t)
+	handled := make(chan string, 4)
+	release := make(chan struct{})
+	defer close(release)
+	ws := NewDefaultWebSocketConnection(mockWebSocketURL(m), handlerFunc(func(msg string) error {
+		if strings.Contains(msg, "slow") {
+			<-release
+		}
+		handled <- msg
+		return nil
+	}), "")
+	ws.HandlerTimeout = 50 * time.Millisecond
+	go ws.ConnectAndListen()
+	defer ws.Shutdown()
+
+	// the status message the mock sends on connect
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("status message is not handled")
+	}
+
+	m.send(t, `{"type":"slow"}`)
+	m.send(t, `{"type":"fast"}`)
+	select {
+	case msg := <-handled:
+		if !strings.Contains(msg, "fast") {
+			t.Errorf("handled %s, want the message after the slow one", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the slow handler stalled the listen loop")
+	}
+}
+
+func TestExecutionSuccessTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want time.Time
+	}{
+		{name: "with timestamp", msg: `{"type":"execution_success","data":{"prompt_id":"p1","timestamp":1700000000123}}`, want: time.UnixMilli(1700000000123)},
+		{name: "without timestamp", msg: `{"type":"execution_success","data":{"prompt_id":"p1"}}`},
+		{name: "null timestamp", msg: `{"type":"execution_success","data":{"prompt_id":"p1","timestamp":null}}`},
+		{name: "malformed timestamp", msg: `{"type":"execution_success","data":{"prompt_id":"p1","timestamp":"soon"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message WSMessage
+			if err := json.Unmarshal([]byte(tt.msg), &message); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			d := message.Data.(*WSMessageExecuteSuccess)
+			if d.PromptID != "p1" {
+				t.Errorf("prompt id = %s, want p1", d.PromptID)
+			}
+			if !d.Timestamp.Equal(tt.want) {
+				t.Errorf("timestamp = %v, want %v", d.Timestamp.Time, tt.want)
+			}
+
+			// the timestamp survives a round trip
+			b, err := json.Marshal(d)
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			var again WSMessageExecuteSuccess
+			if err := json.Unmarshal(b, &again); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			if !again.Timestamp.Equal(tt.want) {
+				t.Errorf("timestamp after a round trip = %v, want %v", again.Timestamp.Time, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisplayNode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want [2]string
+	}{
+		{name: "executing", msg: `{"type":"executing","data":{"node":"5","prompt_id":"p1"}}`, want: [2]string{"5", "5"}},
+		{name: "executing in subgraph", msg: `{"type":"executing","data":{"node":"5.0.3","display_node":"5","prompt_id":"p1"}}`, want: [2]string{"5.0.3", "5"}},
+		{name: "executing null", msg: `{"type":"executing","data":{"node":null,"prompt_id":"p1"}}`},
+		{name: "executed", msg: `{"type":"executed","data":{"node":"9","output":{},"prompt_id":"p1"}}`, want: [2]string{"9", "9"}},
+		{name: "executed in subgraph", msg: `{"type":"executed","data":{"node":"9.1","display_node":"9","output":{},"prompt_id":"p1"}}`, want: [2]string{"9.1", "9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message WSMessage
+			if err := json.Unmarshal([]byte(tt.msg), &message); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			var got [2]string
+			switch d := message.Data.(type) {
+			case *WSMessageDataExecuting:
+				got = [2]string{d.Node, d.DisplayNode}
+			case *WSMessageDataExecuted:
+				got = [2]string{d.Node, d.DisplayNode}
+			}
+			if got != tt.want {
+				t.Errorf("node, display node = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumericNodeIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{name: "executing string", msg: `{"type":"executing","data":{"node":"5","prompt_id":"p1"}}`, want: "5 5"},
+		{name: "executing number", msg: `{"type":"executing","data":{"node":5,"display_node":4,"prompt_id":"p1"}}`, want: "5 4"},
+		{name: "executing null", msg: `{"type":"executing","data":{"node":null,"prompt_id":"p1"}}`, want: " "},
+		{name: "executed number", msg: `{"type":"executed","data":{"node":9,"output":{},"prompt_id":"p1"}}`, want: "9 9"},
+		{name: "cached numbers", msg: `{"type":"execution_cached","data":{"nodes":[3,"4"],"prompt_id":"p1"}}`, want: "[3 4]"},
+		{name: "interrupted numbers", msg: `{"type":"execution_interrupted","data":{"prompt_id":"p1","node_id":19,"node_type":"SaveImage","executed":[5,"17"]}}`, want: "19 [5 17]"},
+		{name: "error numbers", msg: `{"type":"execution_error","data":{"prompt_id":"p1","node_id":12,"node_type":"SaveImage","executed":[3],"exception_message":"disk full"}}`, want: "12 [3]"},
+		{name: "error string", msg: `{"type":"execution_error","data":{"prompt_id":"p1","node_id":"12","node_type":"SaveImage","executed":["3"],"exception_message":"disk full"}}`, want: "12 [3]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message WSMessage
+			if err := json.Unmarshal([]byte(tt.msg), &message); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			var got string
+			switch d := message.Data.(type) {
+			case *WSMessageDataExecuting:
+				got = fmt.Sprint(d.Node, " ", d.DisplayNode)
+			case *WSMessageDataExecuted:
+				got = fmt.Sprint(d.Node, " ", d.DisplayNode)
+			case *WSMessageDataExecutionCached:
+				got = fmt.Sprint(d.Nodes)
+			case *WSMessageExecutionInterrupted:
+				got = fmt.Sprint(d.NodeID, " ", d.Executed)
+			case *WSMessageExecutionError:
+				got = fmt.Sprint(d.Node, " ", d.Executed)
+				if d.PromptID != "p1" || d.ExceptionMessage != "disk full" {
+					t.Errorf("execution error = %+v, the other fields are lost", d)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("node ids = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var id NodeID
+	if err := json.Unmarshal([]byte(`true`), &id); err == nil {
+		t.Errorf("NodeID from a bool = %q, want an error", id)
+	}
+}
+
+func TestExecutedScalar(t *testing.T) {
+	raw := `{"type":"executed","data":{"node":"3","prompt_id":"p1","output":{
+		"images":[{"filename":"a.png","subfolder":"","type":"output"}],
+		"seed":[123456789012],
+		"text":["a","b"]}}}`
+	var message WSMessage
+	if err := json.Unmarshal([]byte(raw), &message); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	executed := message.Data.(*WSMessageDataExecuted)
+	if len(executed.Output) != 1 || len(executed.Output["images"]) != 1 {
+		t.Fatalf("Output = %v, want only the images", executed.Output)
+	}
+
+	seed, ok := executed.Scalar("seed")
+	if !ok {
+		t.Fatal("Scalar(seed) not found")
+	}
+	var value int64
+	if err := json.Unmarshal(seed, &value); err != nil || value != 123456789012 {
+		t.Errorf("Scalar(seed) = %s, want 123456789012", seed)
+	}
+	if text, ok := executed.Scalar("text"); !ok || string(text) != `["a","b"]` {
+		t.Errorf("Scalar(text) = %s, %v, want the list", text, ok)
+	}
+	if _, ok := executed.Scalar("images"); ok {
+		t.Error("Scalar(images) found, want files only in Output")
+	}
+
+	// the scalars survive a round trip, e.g. through a Recorder
+	b, err := json.Marshal(executed)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	var decoded WSMessageDataExecuted
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if seed, ok := decoded.Scalar("seed"); !ok || string(seed) != "123456789012" {
+		t.Errorf("Scalar(seed) after round trip = %s, %v", seed, ok)
+	}
+	if len(decoded.Output["images"]) != 1 {
+		t.Errorf("Output after round trip = %v", decoded.Output)
+	}
+}
+
+func TestExecutionErrorTraceback(t *testing.T) {
+	raw := `{"prompt_id":"p1","node_id":"3","node_type":"KSampler","exception_type":"torch.OutOfMemoryError",
+		"exception_message":"Allocation on device \nThis error means you ran out of memory on your GPU.\n",
+		"traceback":[
+			"  File \"/app/execution.py\", line 323, in execute\n    output_data = get_output_data(obj, input_data_all)\n",
+			"  File \"/app/nodes.py\", line 1519, in sample\n    return common_ksampler(model, seed)\n"]}`
+	var e WSMessageExecutionError
+	if err := json.Unmarshal([]byte(raw), &e); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	wantTraceback := `  File "/app/execution.py", line 323, in execute
+    output_data = get_output_data(obj, input_data_all)
+  File "/app/nodes.py", line 1519, in sample
+    return common_ksampler(model, seed)`
+	if got := e.TracebackString(); got != wantTraceback {
+		t.Errorf("TracebackString = %q, want %q", got, wantTraceback)
+	}
+	if got, want := e.ShortError(), "torch.OutOfMemoryError: Allocation on device"; got != want {
+		t.Errorf("ShortError = %q, want %q", got, want)
+	}
+
+	// a server which sends no exception message has the exception as the last traceback line
+	e.ExceptionType, e.ExceptionMessage = "", ""
+	e.Traceback = append(e.Traceback, "ValueError: bad seed\n")
+	if got, want := e.ShortError(), "ValueError: bad seed"; got != want {
+		t.Errorf("ShortError = %q, want %q", got, want)
+	}
+}
+
+func TestExecutionErrorPartialOutputs(t *testing.T) {
+	msg := `{"type":"execution_error","data":{"prompt_id":"p1","node_id":"12","node_type":"Upscale","executed":["9","10"],
+		"exception_message":"boom","exception_type":"RuntimeError","traceback":[],"current_inputs":{},
+		"current_outputs":{
+			"1":[{"images":[{"filename":"b.png","subfolder":"","type":"temp"}]}],
+			"0":{"ui":{"images":[{"filename":"a.png","subfolder":"out","type":"output"},{"filename":"a.png","subfolder":"out","type":"output"}]}},
+			"2":[[0.5,"latent"],null,{"samples":"tensor"}]
+		}}}`
+	var message WSMessage
+	if err := json.Unmarshal([]byte(msg), &message); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	d, ok := message.Data.(*WSMessageExecutionError)
+	if !ok {
+		t.Fatalf("data = %T, want *WSMessageExecutionError", message.Data)
+	}
+
+	want := []*DataOutputFile{
+		{Filename: "a.png", SubFolder: "out", Type: "output"},
+		{Filename: "b.png", Type: "temp"},
+	}
+	if got := d.PartialOutputs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PartialOutputs = %v, want a.png once and b.png", got)
+	}
+
+	// the failed prompt hands them out through its error too
+	err := error(&PromptExecutionError{WSMessageExecutionError: d})
+	var execErr *PromptExecutionError
+	if !errors.As(err, &execErr) || len(execErr.PartialOutputs()) != 2 {
+		t.Errorf("PromptExecutionError does not carry the partial outputs")
+	}
+
+	if got := (&WSMessageExecutionError{}).PartialOutputs(); got != nil {
+		t.Errorf("PartialOutputs without current outputs = %v, want nil", got)
+	}
+}
+
+func TestProgressPromptAndNode(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want WSMessageDataProgress
+	}{
+		{name: "minimal", msg: `{"type":"progress","data":{"value":3,"max":20}}`, want: WSMessageDataProgress{Value: 3, Max: 20}},
+		{
+			name: "extended",
+			msg:  `{"type":"progress","data":{"value":3,"max":20,"prompt_id":"p2","node":"5"}}`,
+			want: WSMessageDataProgress{Value: 3, Max: 20, PromptID: "p2", Node: "5", DisplayNode: "5"},
+		},
+		{
+			name: "numeric node",
+			msg:  `{"type":"progress","data":{"value":3,"max":20,"prompt_id":"p2","node":5}}`,
+			want: WSMessageDataProgress{Value: 3, Max: 20, PromptID: "p2", Node: "5", DisplayNode: "5"},
+		},
+		{
+			name: "display node",
+			msg:  `{"type":"progress","data":{"value":3,"max":20,"prompt_id":"p2","node":"12:5","display_node":"12"}}`,
+			want: WSMessageDataProgress{Value: 3, Max: 20, PromptID: "p2", Node: "12:5", DisplayNode: "12"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message WSMessage
+			if err := json.Unmarshal([]byte(tt.msg), &message); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			d, ok := message.Data.(*WSMessageDataProgress)
+			if !ok || *d != tt.want {
+				t.Errorf("data = %+v, want %+v", message.Data, tt.want)
+			}
+
+			// the display node is only written back when it differs from the node
+			b, err := json.Marshal(message)
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			var decoded struct {
+				Data map[string]interface{} `json:"data"`
+			}
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			_, hasDisplayNode := decoded.Data["display_node"]
+			if want := tt.want.DisplayNode != tt.want.Node; hasDisplayNode != want {
+				t.Errorf("marshaled %s, display_node written = %v, want %v", b, hasDisplayNode, want)
+			}
+		})
+	}
+}
+
+func TestProgressIsRoutedByPromptID(t *testing.T) {
+	c, err := NewDefaultClientStr("http://127.0.0.1:8188")
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	running := c.subscribe("p1")
+	defer c.unsubscribe(running)
+	other := c.subscribe("p2")
+	defer c.unsubscribe(other)
+
+	for _, msg := range []string{
+		`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+		`{"type":"progress","data":{"value":1,"max":20}}`,
+		`{"type":"progress","data":{"value":2,"max":20,"prompt_id":"p2","node":"5"}}`,
+	} {
+		if err := c.Handle(msg); err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+	}
+
+	// progress without a prompt id goes to the running prompt, the other to the prompt it names
+	var got []string
+	for len(running.ch) > 0 {
+		got = append(got, string((<-running.ch).Type))
+	}
+	if fmt.Sprint(got) != "[execution_start progress]" {
+		t.Errorf("running prompt got %v, want execution_start and its progress", got)
+	}
+	if len(other.ch) != 1 {
+		t.Fatalf("other prompt got %d messages, want its progress", len(other.ch))
+	}
+	if d := (<-other.ch).Data.(*WSMessageDataProgress); d.Value != 2 || d.Node != "5" {
+		t.Errorf("other prompt progress = %+v, want value 2 of node 5", d)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    string
+		wantType WsMessageType
+	}{
+		{name: "data does not match its type", frame: `{"type":"progress","data":{"value":"three","max":20}}`, wantType: Progress},
+		{name: "malformed", frame: `{"type":"progress",`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewDefaultClientStr("http://127.0.0.1:8188")
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+			err = c.Handle(tt.frame)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Handle = %v, want a ParseError", err)
+			}
+			if parseErr.Type != tt.wantType || string(parseErr.Raw) != tt.frame || parseErr.Err == nil {
+				t.Errorf("ParseError = %+v, want type %q with the raw frame", parseErr, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestParseErrorIsSentToErrors(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithTaskStatusBufferSize(4))
+
+	frame := `{"type":"progress","data":{"value":"three","max":20}}`
+	m.send(t, frame)
+	select {
+	case err := <-c.Errors():
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || parseErr.Type != Progress || string(parseErr.Raw) != frame {
+			t.Errorf("error = %v, want a ParseError of the progress frame", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error is sent for the broken frame")
+	}
+
+	// the listen loop goes on with the next frame
+	m.send(t, `{"type":"progress","data":{"value":3,"max":20}}`)
+	select {
+	case message := <-c.GetTaskStatus():
+		if d, ok := message.Data.(*WSMessageDataProgress); !ok || d.Value != 3 {
+			t.Errorf("message = %+v, want the progress after the broken frame", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the frame after the broken one is not delivered")
+	}
+}
+
+func TestWSMessageMarshalJSON(t *testing.T) {
+	tests := []string{
+		`{"type":"status","data":{"status":{"exec_info":{"queue_remaining":1}},"sid":"abc"}}`,
+		`{"type":"execution_start","data":{"prompt_id":"p1","timestamp":1700000000123}}`,
+		`{"type":"execution_cached","data":{"nodes":["4"],"prompt_id":"p1","timestamp":1700000000123}}`,
+		`{"type":"executing","data":{"node":"3","prompt_id":"p1"}}`,
+		`{"type":"executing","data":{"node":"5.0.3","display_node":"5","prompt_id":"p1"}}`,
+		`{"type":"executing","data":{"node":null,"prompt_id":"p1"}}`,
+		`{"type":"progress","data":{"value":3,"max":20}}`,
+		`{"type":"executed","data":{"node":"9","output":{"images":[{"filename":"a.png","subfolder":"","type":"output"}]},"prompt_id":"p1"}}`,
+		`{"type":"executed","data":{"node":"9.1","display_node":"9","output":{"images":[]},"prompt_id":"p1"}}`,
+		`{"type":"execution_interrupted","data":{"prompt_id":"p1","node_id":"3","node_type":"KSampler","executed":["4"],"timestamp":1700000000123}}`,
+		`{"type":"execution_error","data":{"prompt_id":"p1","node_id":"3","node_type":"KSampler","executed":["4"],"exception_message":"oom","exception_type":"torch.cuda.OutOfMemoryError","traceback":["line 1"],"current_inputs":{"seed":[1]},"current_outputs":{"0":[]},"timestamp":1700000000123}}`,
+		`{"type":"execution_success","data":{"prompt_id":"p1","timestamp":1700000000123}}`,
+	}
+	for _, msg := range tests {
+		var message WSMessage
+		if err := json.Unmarshal([]byte(msg), &message); err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+		// both the value and a pointer encode with the type wrapper
+		for _, v := range []interface{}{message, &message} {
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			var got, want interface{}
+			json.Unmarshal(b, &got)
+			json.Unmarshal([]byte(msg), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("json.Marshal = %s, want %s", b, msg)
+			}
+		}
+	}
+}
+
+func TestSendDuringDisconnects(t *testing.T) {
+	m := newMockServer(t)
+	ws := NewDefaultWebSocketConnection(mockWebSocketURL(m), NewTeeHandler(nil, nil), "")
+	ws.ReconnectInterval = 5 * time.Millisecond
+	ws.DialBackoff = time.Millisecond
+	go ws.ConnectAndListen()
+	defer ws.Shutdown()
+	waitFor(t, "connection", ws.GetIsConnected)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := ws.Send(map[string]string{"type": "ping"})
+				if err != nil && !errors.Is(err, ErrNotConnected) && !strings.HasPrefix(err.Error(), "conn.WriteJSON") {
+					t.Errorf("Send: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		want := m.connCount() + 1
+		m.closeConns()
+		waitFor(t, "reconnect", func() bool { return m.connCount() >= want })
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestWithHeartbeat(t *testing.T) {
+	m := newMockServer(t)
+	newConnectedClient(t, m, WithReconnectInterval(10*time.Millisecond),
+		WithHeartbeat(20*time.Millisecond, map[string]string{"type": "heartbeat"}))
+
+	waitFor(t, "heartbeats", func() bool { return len(m.receivedFrames()) >= 3 })
+	for _, frame := range m.receivedFrames() {
+		if strings.TrimSpace(frame) != `{"type":"heartbeat"}` {
+			t.Errorf("frame = %s, want the heartbeat payload", frame)
+		}
+	}
+
+	// the heartbeat goes on over the new connection after a reconnect
+	m.closeConns()
+	waitFor(t, "reconnect", func() bool { return m.connCount() >= 2 })
+	sent := len(m.receivedFrames())
+	waitFor(t, "heartbeats after reconnect", func() bool { return len(m.receivedFrames()) >= sent+2 })
+}
+
+// flakyWebSocketURL serves a websocket which rejects the first failures handshakes, attempts counts them all
+func flakyWebSocketURL(m *mockServer, failures int32, attempts *atomic.Int32) string {
+	m.mux.HandleFunc("/flaky/ws", func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		m.serveWS(w, r)
+	})
+	return "ws" + strings.TrimPrefix(m.URL, "http") + "/flaky/ws"
+}
+
+func TestFailoverWebSocketConnection(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := "ws" + strings.TrimPrefix(down.URL, "http") + "/ws"
+	down.Close()
+	m := newMockServer(t)
+
+	ws, err := NewFailoverWebSocketConnection([]string{downURL, mockWebSocketURL(m)}, 3, NewTeeHandler(nil, nil), "")
+	if err != nil {
+		t.Fatalf("NewFailoverWebSocketConnection: %v", err)
+	}
+	ws.DialBackoff = time.Millisecond
+	defer ws.Shutdown()
+	if got := ws.CurrentURL(); !strings.HasPrefix(got, downURL) {
+		t.Errorf("CurrentURL before connecting = %s, want the first url", got)
+	}
+
+	if err := ws.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if got := ws.CurrentURL(); !strings.HasPrefix(got, mockWebSocketURL(m)) {
+		t.Errorf("CurrentURL = %s, want the second url", got)
+	}
+	if got := clientIDOf(m.wsRequestURL(0)); got != ws.ClientID() {
+		t.Errorf("clientId of the second url = %s, want %s", got, ws.ClientID())
+	}
+
+	// the second url going down rotates back to the first
+	ws.Close()
+	m.Server.Close()
+	if err := ws.ConnectOnce(); err == nil {
+		t.Fatal("ConnectOnce to a closed server succeeded")
+	}
+	if got := ws.CurrentURL(); !strings.HasPrefix(got, downURL) {
+		t.Errorf("CurrentURL after the second url failed = %s, want the first url", got)
+	}
+
+	if _, err := NewFailoverWebSocketConnection(nil, 3, NewTeeHandler(nil, nil), ""); err == nil {
+		t.Error("NewFailoverWebSocketConnection without urls succeeded")
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	m := newMockServer(t)
+	var attempts atomic.Int32
+	ws := NewDefaultWebSocketConnection(flakyWebSocketURL(m, 2, &attempts), NewTeeHandler(nil, nil), "")
+	ws.MaxRetry = 5
+	ws.DialBackoff = time.Millisecond
+	defer ws.Shutdown()
+
+	if err := ws.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("handshake attempts = %d, want 3", got)
+	}
+	if !ws.GetIsConnected() {
+		t.Error("connection is not connected after Connect")
+	}
+}
+
+func TestConnectGivesUpAfterMaxRetry(t *testing.T) {
+	m := newMockServer(t)
+	var attempts atomic.Int32
+	ws := NewDefaultWebSocketConnection(flakyWebSocketURL(m, 10, &attempts), NewTeeHandler(nil, nil), "")
+	ws.MaxRetry = 3
+	ws.DialBackoff = time.Millisecond
+	defer ws.Shutdown()
+
+	if err := ws.Connect(); err == nil {
+		t.Fatal("Connect succeeded against a failing server")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("handshake attempts = %d, want 3", got)
+	}
+}
+
+func TestConnectOnceDialsOnce(t *testing.T) {
+	m := newMockServer(t)
+	var attempts atomic.Int32
+	ws := NewDefaultWebSocketConnection(flakyWebSocketURL(m, 1, &attempts), NewTeeHandler(nil, nil), "")
+	ws.MaxRetry = 5
+	defer ws.Shutdown()
+
+	if err := ws.ConnectOnce(); err == nil {
+		t.Fatal("ConnectOnce succeeded against a failing server")
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("handshake attempts = %d, want 1", got)
+	}
+	if err := ws.ConnectOnce(); err != nil {
+		t.Fatalf("second ConnectOnce: %v", err)
+	}
+}
+
+func TestMessageFilter(t *testing.T) {
+	m := newMockServer(t)
+	handled := make(chan string, 8)
+	ws := NewDefaultWebSocketConnection(mockWebSocketURL(m), handlerFunc(func(msg string) error {
+		handled <- msg
+		return nil
+	}), "")
+	ws.MessageFilter = func(message WSMessage) bool {
+		return message.Type != Progress
+	}
+	go ws.ConnectAndListen()
+	defer ws.Shutdown()
+	waitFor(t, "connection", ws.GetIsConnected)
+
+	m.send(t, `{"type":"progress","data":{"value":1,"max":20,"prompt_id":"p1","node":"3"}}`)
+	m.send(t, `{"type":"progress","data":{"value":2,"max":20,"prompt_id":"p1","node":"3"}}`)
+	m.send(t, `not json`)
+	m.send(t, executingMessage("p1", ""))
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case msg := <-handled:
+			got = append(got, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handled %v, want the status, the malformed frame and executing", got)
+		}
+	}
+	for _, msg := range got {
+		if strings.Contains(msg, `"progress"`) {
+			t.Errorf("filtered message %s reached the handler", msg)
+		}
+	}
+	if got[1] != "not json" || !strings.Contains(got[2], `"executing"`) {
+		t.Errorf("handled %v, want the malformed frame and executing after the status", got)
+	}
+}
+
+func TestWithMessageFilter(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithTaskStatusBufferSize(4), WithMessageFilter(func(message WSMessage) bool {
+		return message.Type != Progress
+	}))
+
+	m.send(t, `{"type":"progress","data":{"value":1,"max":20,"prompt_id":"p1","node":"3"}}`)
+	m.send(t, executingMessage("p1", "3"))
+	if message := receive(t, c); message.Type != Executing {
+		t.Errorf("message type = %s, want %s", message.Type, Executing)
+	}
+}
+
+// authWebSocket wraps the websocket handler of the server with a bearer token check, attempts counts the handshakes
+func authWebSocket(m *mockServer, token string, attempts *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		m.serveWS(w, r)
+	}
+}
+
+func TestUnauthorizedHandshakeStops(t *testing.T) {
+	m := newMockServer(t)
+	var attempts atomic.Int32
+	m.mux.HandleFunc("/auth/ws", authWebSocket(m, "valid", &attempts))
+	ws := NewDefaultWebSocketConnection("ws"+strings.TrimPrefix(m.URL, "http")+"/auth/ws", NewTeeHandler(nil, nil), "expired")
+	ws.MaxRetry = 5
+	ws.DialBackoff = time.Millisecond
+	ws.ReconnectInterval = time.Millisecond
+
+	if err := ws.ConnectOnce(); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("ConnectOnce = %v, want %v", err, ErrUnauthorized)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ws.ConnectAndListen()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		ws.Shutdown()
+		t.Fatal("ConnectAndListen keeps retrying a rejected token")
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("handshake attempts = %d, want 2, one for ConnectOnce and one for ConnectAndListen", got)
+	}
+}
+
+func TestTokenProviderRefreshesToken(t *testing.T) {
+	m := newMockServer(t)
+	var attempts atomic.Int32
+	m.mux.HandleFunc("/api/ws", authWebSocket(m, "fresh", &attempts))
+	m.mux.HandleFunc("/api/prompt", m.servePrompt)
+	c, err := NewDefaultClientStr(m.URL, WithAPIPrefix(true), WithDialBackoff(time.Millisecond, time.Millisecond),
+		WithTokenProvider(func(ctx context.Context) (string, error) {
+			return "fresh", nil
+		}))
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	c.SetBearerToken("expired")
+	c.ConnectAndListen()
+	t.Cleanup(func() { c.webSocket.Shutdown() })
+	waitFor(t, "websocket connection", c.IsInitialized)
+
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("handshake attempts = %d, want 2", got)
+	}
+	if _, err := c.QueuePrompt(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); err != nil {
+		t.Fatalf("QueuePrompt: %v", err)
+	}
+	if got := m.promptHeaders()[0].Get("Authorization"); got != "Bearer fresh" {
+		t.Errorf("Authorization of the HTTP call = %q, want the refreshed token", got)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	m := newMockServer(t)
+	ws := NewDefaultWebSocketConnection(mockWebSocketURL(m), handlerFunc(func(msg string) error {
+		t.Errorf("the handler is called with %s", msg)
+		return nil
+	}), "")
+	if err := ws.ConnectOnce(); err != nil {
+		t.Fatalf("ConnectOnce: %v", err)
+	}
+	defer ws.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	message, err := ws.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if message.Type != Status {
+		t.Errorf("first message type = %s, want %s", message.Type, Status)
+	}
+
+	m.send(t, executingMessage("p1", "3"))
+	m.sendBinary(t, binaryFrame(PreviewImageEventType, 0, 0, 0, 1, 0xff, 0xd8))
+	message, err = ws.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if d, ok := message.Data.(*WSMessageDataExecuting); !ok || d.Node != "3" {
+		t.Errorf("second message = %s %+v, want executing node 3", message.Type, message.Data)
+	}
+	message, err = ws.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if preview, ok := message.Data.(*WSBinaryPreview); message.Type != BinaryPreview || !ok || !preview.IsImagePreview() {
+		t.Errorf("third message = %s %+v, want a preview image", message.Type, message.Data)
+	}
+
+	// nothing more is sent, the read ends with the context
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if _, err := ws.ReadMessage(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ReadMessage = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := ws.ReadMessage(ctx); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("ReadMessage after a cancelled read = %v, want %v", err, ErrNotConnected)
+	}
+}
+
+func TestReadMessageWhileListening(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+	waitFor(t, "listen loop", func() bool {
+		c.webSocket.mu.Lock()
+		defer c.webSocket.mu.Unlock()
+		return c.webSocket.listenDone != nil
+	})
+
+	if _, err := c.ReadMessage(context.Background()); !errors.Is(err, ErrListening) {
+		t.Errorf("ReadMessage = %v, want %v", err, ErrListening)
+	}
+}
+
+// syncBuffer is a bytes.Buffer which may be written and read concurrently
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWireTrace(t *testing.T) {
+	m := newMockServer(t)
+	trace := &syncBuffer{}
+	c := newConnectedClient(t, m, WithWireTrace(trace))
+
+	if err := c.webSocket.Send(map[string]string{"type": "ping"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	m.sendBinary(t, binaryFrame(PreviewImageEventType, bytes.Repeat([]byte{0xab}, 300)...))
+	m.send(t, `{"type":"custom","data":{"text":"`+strings.Repeat("x", 300)+`"}}`)
+	waitFor(t, "traced frames", func() bool { return strings.Count(trace.String(), "\n") >= 4 })
+
+	lines := strings.Split(strings.TrimSpace(trace.String()), "\n")
+	want := []string{
+		` <- text `,
+		` -> text 15 {"type":"ping"}`,
+		` <- binary 304 00000001abab`,
+		` <- text 336 {"type":"custom"`,
+	}
+	for i, w := range want {
+		if !strings.Contains(lines[i], w) {
+			t.Errorf("line %d = %q, want it to contain %q", i, lines[i], w)
+		}
+	}
+	if !strings.HasSuffix(lines[2], "...") || !strings.HasSuffix(lines[3], "...") {
+		t.Errorf("long payloads are not truncated: %q", lines[2:])
+	}
+	if len(lines[3]) > 400 {
+		t.Errorf("traced line has %d bytes, want the payload truncated", len(lines[3]))
+	}
+}
@@ -0,0 +1,547 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPromptInterrupted matches the error of a prompt which is interrupted, e.g. by the user
+	ErrPromptInterrupted = errors.New("prompt interrupted")
+	// ErrPromptFailed matches the error of a prompt whose node raised an exception
+	ErrPromptFailed = errors.New("prompt failed")
+	// ErrPromptCompleted is the cause of a PromptContext cancelled because its prompt succeeded
+	ErrPromptCompleted = errors.New("prompt completed")
+)
+
+// PromptInterruptedError is returned when a prompt is interrupted, errors.Is matches it with ErrPromptInterrupted
+type PromptInterruptedError struct {
+	PromptID string
+	NodeID   string
+	NodeType string
+	// Executed lists the nodes executed before the interruption
+	Executed []string
+}
+
+func (e *PromptInterruptedError) Error() string {
+	return fmt.Sprintf("prompt %s is interrupted at node %s (%s)", e.PromptID, e.NodeID, e.NodeType)
+}
+
+func (e *PromptInterruptedError) Is(target error) bool {
+	return target == ErrPromptInterrupted
+}
+
+// PromptExecutionError is returned when a node of a prompt fails, errors.Is matches it with ErrPromptFailed
+type PromptExecutionError struct {
+	*WSMessageExecutionError
+}
+
+func (e *PromptExecutionError) Error() string {
+	return fmt.Sprintf("prompt %s failed at node %s (%s): %s: %s",
+		e.PromptID, e.Node, e.NodeType, e.ExceptionType, e.ExceptionMessage)
+}
+
+func (e *PromptExecutionError) Is(target error) bool {
+	return target == ErrPromptFailed
+}
+
+// RunResult describes a run of RunWorkflow
+type RunResult struct {
+	PromptID string
+	// Outputs holds the output files keyed by node id, including the ones of a run which did not succeed
+	Outputs map[string][]*DataOutputFile
+	// Duration is the time from the submission to the end of the run
+	Duration time.Duration
+	// Interrupted reports whether the run was interrupted
+	Interrupted bool
+	// Retries is how often the prompt was resubmitted after running out of memory, see WithOOMRetry
+	Retries int
+}
+
+// RunWorkflow queues the workflow and waits until it is executed
+// The websocket is connected on first use and shared by later calls, it stays open until Close
+// The result is returned with the error too once the prompt is queued, e.g. with the outputs produced before
+// an interruption
+// With WithOOMRetry a prompt which runs out of memory is resubmitted, the result is the one of the last run
+// Messages of the prompt are consumed by RunWorkflow, they are not sent to the task status channel
+func (c *Client) RunWorkflow(ctx context.Context, workflow map[string]interface{}) (*RunResult, error) {
+	if err := c.acquireConnection(ctx); err != nil {
+		return nil, fmt.Errorf("c.acquireConnection: error: %w", err)
+	}
+	defer c.releaseConnection()
+
+	start := time.Now()
+	for retries := 0; ; retries++ {
+		result, err := c.runWorkflowOnce(ctx, workflow)
+		if result == nil {
+			return nil, err
+		}
+		result.Duration, result.Retries = time.Since(start), retries
+
+		var execErr *PromptExecutionError
+		if retries >= c.oomRetries || !errors.As(err, &execErr) || !execErr.IsOutOfMemory() {
+			return result, err
+		}
+		if freeErr := c.FreeMemory(ctx, true); freeErr != nil {
+			return result, fmt.Errorf("c.FreeMemory: error: %v, after: %w", freeErr, err)
+		}
+	}
+}
+
+// runWorkflowOnce queues the workflow and waits for it, the result is nil when it could not be queued
+func (c *Client) runWorkflowOnce(ctx context.Context, workflow map[string]interface{}) (*RunResult, error) {
+	resp, sub, err := c.submitAndSubscribe(ctx, workflow)
+	if err != nil {
+		return nil, fmt.Errorf("c.submitAndSubscribe: error: %w", err)
+	}
+	defer c.unsubscribe(sub)
+
+	outputs, err := c.waitForSubscription(ctx, sub)
+	return &RunResult{
+		PromptID:    resp.PromptID,
+		Outputs:     outputs,
+		Interrupted: errors.Is(err, ErrPromptInterrupted),
+	}, err
+}
+
+// RunWorkflowOutputs runs the workflow like RunWorkflow and returns only its output files keyed by node id
+func (c *Client) RunWorkflowOutputs(ctx context.Context, workflow map[string]interface{}) (map[string][]*DataOutputFile, error) {
+	result, err := c.RunWorkflow(ctx, workflow)
+	if result == nil {
+		return nil, err
+	}
+	return result.Outputs, err
+}
+
+// WaitForPrompt waits until the prompt is executed and returns the output files keyed by node id
+// An interrupted prompt returns a PromptInterruptedError and a failed one a PromptExecutionError
+// The prompt must be queued by this client, messages which arrive before WaitForPrompt is called are missed,
+// use RunWorkflow to queue and wait without that gap
+func (c *Client) WaitForPrompt(ctx context.Context, promptID string) (map[string][]*DataOutputFile, error) {
+	if err := c.acquireConnection(ctx); err != nil {
+		return nil, fmt.Errorf("c.acquireConnection: error: %w", err)
+	}
+	defer c.releaseConnection()
+	sub := c.subscribe(promptID)
+	defer c.unsubscribe(sub)
+	return c.waitForSubscription(ctx, sub)
+}
+
+// PromptErrors are the errors of the prompts WaitForPrompts waited for, keyed by prompt id
+// errors.Is and errors.As match each of them
+type PromptErrors map[string]error
+
+func (e PromptErrors) Error() string {
+	promptIDs := make([]string, 0, len(e))
+	for promptID := range e {
+		promptIDs = append(promptIDs, promptID)
+	}
+	sort.Strings(promptIDs)
+	messages := make([]string, len(promptIDs))
+	for i, promptID := range promptIDs {
+		messages[i] = fmt.Sprintf("prompt %s: %v", promptID, e[promptID])
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e PromptErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// WaitForPrompts waits for the prompts concurrently over the shared websocket and returns their results keyed
+// by prompt id, Duration is the time since WaitForPrompts was called
+// A prompt which fails or is interrupted does not stop the others, its result is kept and its error is returned
+// in PromptErrors once all prompts ended; when ctx is done its error is returned with the results of the prompts
+// which ended before
+// Like WaitForPrompt, the prompts must be queued by this client and messages which arrive before it are missed
+func (c *Client) WaitForPrompts(ctx context.Context, promptIDs []string) (map[string]*RunResult, error) {
+	if err := c.acquireConnection(ctx); err != nil {
+		return nil, fmt.Errorf("c.acquireConnection: error: %w", err)
+	}
+	defer c.releaseConnection()
+
+	// every prompt is subscribed before waiting, so no message arrives between two subscriptions unseen
+	subs := make(map[string]*subscription, len(promptIDs))
+	for _, promptID := range promptIDs {
+		if _, exist := subs[promptID]; !exist {
+			subs[promptID] = c.subscribe(promptID)
+		}
+	}
+
+	start := time.Now()
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]*RunResult, len(subs))
+		errs    = make(PromptErrors)
+	)
+	for promptID, sub := range subs {
+		wg.Add(1)
+		go func(promptID string, sub *subscription) {
+			defer wg.Done()
+			// a prompt which ended stops receiving messages while the others are waited for
+			defer c.unsubscribe(sub)
+			outputs, err := c.waitForSubscription(ctx, sub)
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[promptID] = &RunResult{
+				PromptID:    promptID,
+				Outputs:     outputs,
+				Duration:    time.Since(start),
+				Interrupted: errors.Is(err, ErrPromptInterrupted),
+			}
+			if err != nil {
+				errs[promptID] = err
+			}
+		}(promptID, sub)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// WaitForFirstProgress waits until the prompt reports its first progress, i.e. the models are loaded and
+// generation started
+// It returns early with the error of a prompt which fails or is interrupted before, and with nil for a prompt
+// which ends without any progress, e.g. when every node is cached
+// Like WaitForPrompt, it must be called before the progress is sent
+func (c *Client) WaitForFirstProgress(ctx context.Context, promptID string) error {
+	if err := c.acquireConnection(ctx); err != nil {
+		return fmt.Errorf("c.acquireConnection: error: %w", err)
+	}
+	defer c.releaseConnection()
+	sub := c.subscribe(promptID)
+	defer c.unsubscribe(sub)
+
+	connCtx := c.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-connCtx.Done():
+			return ErrConnectionClosed
+		case message := <-sub.ch:
+			switch d := message.Data.(type) {
+			case *WSMessageDataProgress:
+				return nil
+			case *WSMessageDataExecuting:
+				if d.IsFinished() {
+					return nil
+				}
+			case *WSMessageExecuteSuccess:
+				return nil
+			case *WSMessageExecutionInterrupted:
+				return &PromptInterruptedError{
+					PromptID: d.PromptID,
+					NodeID:   d.NodeID,
+					NodeType: d.NodeType,
+					Executed: d.Executed,
+				}
+			case *WSMessageExecutionError:
+				return &PromptExecutionError{WSMessageExecutionError: d}
+			}
+		}
+	}
+}
+
+// PromptContext returns a child of parent which is cancelled once the prompt ends
+// Its cause is the PromptExecutionError or PromptInterruptedError of the prompt, or ErrPromptCompleted when
+// it succeeds, read it with context.Cause
+// Call the cancel func to stop watching the prompt, like with context.WithCancelCause
+func (c *Client) PromptContext(parent context.Context, promptID string) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	// the subscription is made before returning, so no message of the prompt is missed
+	sub := c.subscribe(promptID)
+	go func() {
+		defer c.unsubscribe(sub)
+		if err := c.acquireConnection(ctx); err != nil {
+			cancel(err)
+			return
+		}
+		defer c.releaseConnection()
+
+		_, err := waitForPrompt(ctx, c.Context(), sub)
+		if err == nil {
+			err = ErrPromptCompleted
+		}
+		cancel(err)
+	}()
+	return ctx, cancel
+}
+
+// CollectTempOutputs waits for the prompt like WaitForPrompt and returns its temp outputs apart from the others,
+// both keyed by node id
+// Temp files such as the ones of PreviewImage are intermediates the server cleans up, a UI can show them
+// until it swaps to the final outputs
+func (c *Client) CollectTempOutputs(ctx context.Context, promptID string) (temp, outputs map[string][]*DataOutputFile, err error) {
+	all, err := c.WaitForPrompt(ctx, promptID)
+	temp, outputs = splitTempOutputs(all)
+	return temp, outputs, err
+}
+
+// splitTempOutputs separates the temp files from the others, a node without files of a kind is left out of it
+func splitTempOutputs(all map[string][]*DataOutputFile) (temp, outputs map[string][]*DataOutputFile) {
+	temp = make(map[string][]*DataOutputFile)
+	outputs = make(map[string][]*DataOutputFile)
+	for node, files := range all {
+		for _, file := range files {
+			if file.Type == string(TempImageType) {
+				temp[node] = append(temp[node], file)
+			} else {
+				outputs[node] = append(outputs[node], file)
+			}
+		}
+	}
+	return temp, outputs
+}
+
+// RunWorkflows runs the workflows concurrently over the shared websocket and returns their outputs in order
+// The number of workflows running at once is bounded by WithRunConcurrency
+// If any workflow fails, the returned error is a WorkflowErrors indexed like workflows
+func (c *Client) RunWorkflows(ctx context.Context, workflows []map[string]interface{}) ([]map[string][]*DataOutputFile, error) {
+	results := make([]map[string][]*DataOutputFile, len(workflows))
+	errs := make(WorkflowErrors, len(workflows))
+
+	var sem chan struct{}
+	if c.runConcurrency > 0 {
+		sem = make(chan struct{}, c.runConcurrency)
+	}
+
+	var wg sync.WaitGroup
+	for i, workflow := range workflows {
+		wg.Add(1)
+		go func(i int, workflow map[string]interface{}) {
+			defer wg.Done()
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					errs[i] = ctx.Err()
+					return
+				}
+			}
+			results[i], errs[i] = c.RunWorkflowOutputs(ctx, workflow)
+		}(i, workflow)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return results, errs
+		}
+	}
+	return results, nil
+}
+
+// RunWorkflowBatch runs a copy of the workflow for every seed and returns the outputs keyed by seed
+// seedNodePath is "node_id.input", e.g. "3.seed", the input defaults to seed when only the node id is given
+// The copies run like RunWorkflows, a failure is reported by a WorkflowErrors indexed like seeds
+// Seeds must be unique, the outputs of duplicates could not be told apart
+func (c *Client) RunWorkflowBatch(ctx context.Context, workflow map[string]interface{}, seeds []int64, seedNodePath string) (map[int64]map[string][]*DataOutputFile, error) {
+	nodeID, input := seedNodePath, "seed"
+	if i := strings.LastIndex(seedNodePath, "."); i >= 0 {
+		nodeID, input = seedNodePath[:i], seedNodePath[i+1:]
+	}
+
+	seen := make(map[int64]bool, len(seeds))
+	for _, seed := range seeds {
+		if seen[seed] {
+			return nil, fmt.Errorf("seed %d is given more than once", seed)
+		}
+		seen[seed] = true
+	}
+
+	workflows := make([]map[string]interface{}, len(seeds))
+	for i, seed := range seeds {
+		clone, err := cloneWorkflow(workflow)
+		if err != nil {
+			return nil, fmt.Errorf("cloneWorkflow: error: %w", err)
+		}
+		node, ok := clone[nodeID].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("seed node %s is not found in workflow", nodeID)
+		}
+		inputs, ok := node["inputs"].(map[string]interface{})
+		if !ok {
+			inputs = make(map[string]interface{})
+			node["inputs"] = inputs
+		}
+		inputs[input] = seed
+		workflows[i] = clone
+	}
+
+	results, err := c.RunWorkflows(ctx, workflows)
+	outputs := make(map[int64]map[string][]*DataOutputFile, len(seeds))
+	for i, seed := range seeds {
+		if results[i] != nil {
+			outputs[seed] = results[i]
+		}
+	}
+	return outputs, err
+}
+
+// cloneWorkflow deep copies the workflow through JSON
+func cloneWorkflow(workflow map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(workflow)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: error: %w", err)
+	}
+	var clone map[string]interface{}
+	if err := json.Unmarshal(b, &clone); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: error: %w", err)
+	}
+	return clone, nil
+}
+
+// WorkflowErrors contains the errors of RunWorkflows, the error of a succeeded workflow is nil
+type WorkflowErrors []error
+
+func (e WorkflowErrors) Error() string {
+	var msgs []string
+	for i, err := range e {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("workflow %d: %v", i, err))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the non-nil errors
+func (e WorkflowErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// historyLagRetries is how often waitForSubscription asks history for a prompt which just ended,
+// the server adds it to history shortly after it sends the end
+const (
+	historyLagRetries  = 3
+	historyLagInterval = 100 * time.Millisecond
+)
+
+// waitForSubscription waits like waitForPrompt and survives reconnects of the websocket
+// When the websocket reconnected during the wait, the outputs sent while it was down are filled in from history
+func (c *Client) waitForSubscription(ctx context.Context, sub *subscription) (map[string][]*DataOutputFile, error) {
+	outputs, err := waitForPrompt(ctx, c.Context(), sub)
+	if err != nil || !sub.reconnected.Load() {
+		return outputs, err
+	}
+
+	for i := 0; i < historyLagRetries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return outputs, nil
+			case <-time.After(historyLagInterval):
+			}
+		}
+		history, err := c.getHistoryByPromptID(ctx, sub.promptID)
+		if err != nil {
+			fmt.Printf("[%s] recover outputs of prompt %s from history error %v\n", c.baseURL, sub.promptID, err)
+			return outputs, nil
+		}
+		if history == nil {
+			continue
+		}
+		for _, message := range historyMessages(history) {
+			if d, ok := message.Data.(*WSMessageDataExecuted); ok {
+				outputs[d.DisplayNode] = appendNewFiles(outputs[d.DisplayNode], flattenOutput(d.Output))
+			}
+		}
+		break
+	}
+	return outputs, nil
+}
+
+// waitForPrompt collects the outputs from the subscription until the prompt is executed
+// It gives up with ErrConnectionClosed once the connection context is done
+func waitForPrompt(ctx, connCtx context.Context, sub *subscription) (map[string][]*DataOutputFile, error) {
+	outputs := make(map[string][]*DataOutputFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return outputs, ctx.Err()
+		case <-connCtx.Done():
+			return outputs, ErrConnectionClosed
+		case message := <-sub.ch:
+			switch d := message.Data.(type) {
+			case *WSMessageDataExecuted:
+				// outputs are keyed by the node of the submitted workflow, not the one a subgraph expands to
+				outputs[d.DisplayNode] = appendNewFiles(outputs[d.DisplayNode], flattenOutput(d.Output))
+			case *WSMessageDataExecuting:
+				if d.IsFinished() {
+					return outputs, nil
+				}
+			case *WSMessageExecuteSuccess:
+				return outputs, nil
+			case *WSMessageExecutionInterrupted:
+				return outputs, &PromptInterruptedError{
+					PromptID: d.PromptID,
+					NodeID:   d.NodeID,
+					NodeType: d.NodeType,
+					Executed: d.Executed,
+				}
+			case *WSMessageExecutionError:
+				return outputs, &PromptExecutionError{WSMessageExecutionError: d}
+			}
+		}
+	}
+}
+
+// appendNewFiles appends the files which are not in files yet, the outputs recovered from history after
+// a reconnect repeat the ones which arrived before it
+func appendNewFiles(files, add []*DataOutputFile) []*DataOutputFile {
+	for _, file := range add {
+		exist := false
+		for _, f := range files {
+			if *f == *file {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// flattenOutput returns the files of an executed output, ordered by output name
+func flattenOutput(output map[string][]*DataOutputFile) []*DataOutputFile {
+	names := make([]string, 0, len(output))
+	for name := range output {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []*DataOutputFile
+	for _, name := range names {
+		files = append(files, output[name]...)
+	}
+	return files
+}
@@ -0,0 +1,1021 @@
+package comfyUIclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func executingMessage(promptID, node string) string {
+	if node == "" {
+		return fmt.Sprintf(`{"type":"executing","data":{"node":null,"prompt_id":%q}}`, promptID)
+	}
+	return fmt.Sprintf(`{"type":"executing","data":{"node":%q,"prompt_id":%q}}`, node, promptID)
+}
+
+func executedMessage(promptID, node, filename string) string {
+	return fmt.Sprintf(`{"type":"executed","data":{"node":%q,"output":{"images":[{"filename":%q,"subfolder":"","type":"output"}]},"prompt_id":%q}}`,
+		node, filename, promptID)
+}
+
+func TestRunWorkflowsInterleaved(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithTaskStatusBufferSize(16))
+
+	queued := make(chan string, 3)
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		// the first messages arrive before /prompt returns the id
+		m.send(t, fmt.Sprintf(`{"type":"execution_start","data":{"prompt_id":%q}}`, promptID))
+		queued <- promptID
+	}
+	go func() {
+		var promptIDs []string
+		for len(promptIDs) < 3 {
+			promptIDs = append(promptIDs, <-queued)
+		}
+		for _, node := range []string{"9", "10"} {
+			for _, promptID := range promptIDs {
+				m.send(t, executingMessage(promptID, node))
+				m.send(t, executedMessage(promptID, node, promptID+"-"+node+".png"))
+			}
+		}
+		for _, promptID := range promptIDs {
+			m.send(t, executingMessage(promptID, ""))
+		}
+	}()
+
+	workflows := []map[string]interface{}{
+		{"9": map[string]interface{}{"class_type": "SaveImage"}},
+		{"9": map[string]interface{}{"class_type": "SaveImage"}},
+		{"9": map[string]interface{}{"class_type": "SaveImage"}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results, err := c.RunWorkflows(ctx, workflows)
+	if err != nil {
+		t.Fatalf("RunWorkflows: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for i, outputs := range results {
+		if len(outputs["9"]) != 1 || len(outputs["10"]) != 1 {
+			t.Fatalf("workflow %d outputs = %v, want one file for nodes 9 and 10", i, outputs)
+		}
+		promptID := outputs["9"][0].Filename[:len(outputs["9"][0].Filename)-len("-9.png")]
+		if got, want := outputs["10"][0].Filename, promptID+"-10.png"; got != want {
+			t.Errorf("workflow %d got output %s of another prompt, want %s", i, got, want)
+		}
+		if seen[promptID] {
+			t.Errorf("prompt %s collected twice", promptID)
+		}
+		seen[promptID] = true
+	}
+
+	select {
+	case message := <-c.GetTaskStatus():
+		t.Errorf("message %s of a RunWorkflows prompt leaked to the task status channel", message.Type)
+	default:
+	}
+}
+
+func TestSubmitDoesNotBlockUnrelatedMessages(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithTaskStatusBufferSize(16))
+
+	release := make(chan struct{})
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		m.send(t, executingMessage("someone-else", "3"))
+		<-release
+		m.send(t, executingMessage(promptID, ""))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.RunWorkflow(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+		done <- err
+	}()
+
+	// the reader keeps going while the submission is in flight
+	waitFor(t, "held message", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.held) == 1
+	})
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("RunWorkflow: %v", err)
+	}
+
+	message := receive(t, c)
+	if d := message.Data.(*WSMessageDataExecuting); d.PromptID != "someone-else" {
+		t.Errorf("released message prompt = %s, want someone-else", d.PromptID)
+	}
+}
+
+func TestRunWorkflowTerminalErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		check   func(t *testing.T, err error)
+	}{
+		{
+			name:    "interrupted",
+			message: `{"type":"execution_interrupted","data":{"prompt_id":"prompt-1","node_id":"10","node_type":"KSampler","executed":["4","9"]}}`,
+			check: func(t *testing.T, err error) {
+				var interrupted *PromptInterruptedError
+				if !errors.Is(err, ErrPromptInterrupted) || !errors.As(err, &interrupted) {
+					t.Fatalf("err = %v, want a PromptInterruptedError", err)
+				}
+				if errors.Is(err, ErrPromptFailed) {
+					t.Error("an interruption matches ErrPromptFailed")
+				}
+				if interrupted.NodeID != "10" || strings.Join(interrupted.Executed, ",") != "4,9" {
+					t.Errorf("interrupted = %+v, want node 10 with 4 and 9 executed", interrupted)
+				}
+			},
+		},
+		{
+			name:    "failed",
+			message: `{"type":"execution_error","data":{"prompt_id":"prompt-1","node_id":"10","node_type":"KSampler","executed":["4","9"],"exception_message":"out of memory","exception_type":"torch.OutOfMemoryError","traceback":[],"current_inputs":{},"current_outputs":{}}}`,
+			check: func(t *testing.T, err error) {
+				var failed *PromptExecutionError
+				if !errors.Is(err, ErrPromptFailed) || !errors.As(err, &failed) {
+					t.Fatalf("err = %v, want a PromptExecutionError", err)
+				}
+				if errors.Is(err, ErrPromptInterrupted) {
+					t.Error("a failure matches ErrPromptInterrupted")
+				}
+				if failed.Node != "10" || failed.ExceptionType != "torch.OutOfMemoryError" {
+					t.Errorf("failed = %+v, want node 10 with torch.OutOfMemoryError", failed.WSMessageExecutionError)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			c := newConnectedClient(t, m)
+			m.onPrompt = func(promptID string, body map[string]interface{}) {
+				go func() {
+					m.send(t, fmt.Sprintf(`{"type":"execution_start","data":{"prompt_id":%q}}`, promptID))
+					m.send(t, executedMessage(promptID, "9", "a.png"))
+					m.send(t, tt.message)
+				}()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			outputs, err := c.RunWorkflowOutputs(ctx, map[string]interface{}{"1": map[string]interface{}{}})
+			tt.check(t, err)
+			if len(outputs["9"]) != 1 {
+				t.Errorf("outputs = %v, want the output of node 9 collected before the end", outputs)
+			}
+		})
+	}
+}
+
+func TestWaitForPromptStopsWithConnection(t *testing.T) {
+	tests := []struct {
+		name    string
+		connect func(c *Client) (stop func())
+	}{
+		{
+			name: "shutdown",
+			connect: func(c *Client) func() {
+				c.ConnectAndListen()
+				return func() { c.webSocket.Shutdown() }
+			},
+		},
+		{
+			name: "connection context",
+			connect: func(c *Client) func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				c.ConnectAndListenContext(ctx)
+				return cancel
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			c, err := NewDefaultClientStr(m.URL)
+			if err != nil {
+				t.Fatalf("NewDefaultClientStr: %v", err)
+			}
+			stop := tt.connect(c)
+			t.Cleanup(func() { c.webSocket.Shutdown() })
+			waitFor(t, "websocket connection", c.IsInitialized)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := c.WaitForPrompt(context.Background(), "p1")
+				done <- err
+			}()
+			waitFor(t, "subscription", func() bool {
+				c.subMu.Lock()
+				defer c.subMu.Unlock()
+				return len(c.subscriptions) == 1
+			})
+
+			stop()
+			select {
+			case err := <-done:
+				if !errors.Is(err, ErrConnectionClosed) {
+					t.Errorf("WaitForPrompt = %v, want %v", err, ErrConnectionClosed)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("WaitForPrompt is still blocked after the connection stopped")
+			}
+		})
+	}
+}
+
+func TestRunWorkflowBatch(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		seed := body["prompt"].(map[string]interface{})["3"].(map[string]interface{})["inputs"].(map[string]interface{})["noise_seed"]
+		go func() {
+			m.send(t, executedMessage(promptID, "9", fmt.Sprintf("seed-%v.png", seed)))
+			m.send(t, executingMessage(promptID, ""))
+		}()
+	}
+
+	workflow := map[string]interface{}{
+		"3": map[string]interface{}{"class_type": "KSamplerAdvanced", "inputs": map[string]interface{}{"noise_seed": 0, "steps": 20}},
+		"9": map[string]interface{}{"class_type": "SaveImage"},
+	}
+	seeds := []int64{7, 11, 13}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	outputs, err := c.RunWorkflowBatch(ctx, workflow, seeds, "3.noise_seed")
+	if err != nil {
+		t.Fatalf("RunWorkflowBatch: %v", err)
+	}
+
+	submitted := make(map[string]bool)
+	for _, body := range m.promptBodies() {
+		inputs := body["prompt"].(map[string]interface{})["3"].(map[string]interface{})["inputs"].(map[string]interface{})
+		submitted[fmt.Sprint(inputs["noise_seed"])] = true
+		if inputs["steps"] != float64(20) {
+			t.Errorf("steps = %v, want the other inputs kept", inputs["steps"])
+		}
+	}
+	for _, seed := range seeds {
+		if !submitted[fmt.Sprint(seed)] {
+			t.Errorf("no submitted body carries seed %d, got %v", seed, submitted)
+		}
+		if got := outputs[seed]["9"]; len(got) != 1 || got[0].Filename != fmt.Sprintf("seed-%d.png", seed) {
+			t.Errorf("outputs of seed %d = %v, want seed-%d.png", seed, got, seed)
+		}
+	}
+	if inputs := workflow["3"].(map[string]interface{})["inputs"].(map[string]interface{}); inputs["noise_seed"] != 0 {
+		t.Errorf("the given workflow is modified, noise_seed = %v", inputs["noise_seed"])
+	}
+
+	if _, err := c.RunWorkflowBatch(ctx, workflow, []int64{1, 2, 1}, "3.noise_seed"); err == nil {
+		t.Error("RunWorkflowBatch accepts duplicate seeds")
+	}
+	if n := len(m.promptBodies()); n != len(seeds) {
+		t.Errorf("%d prompts are submitted, want none for the duplicate seeds", n-len(seeds))
+	}
+}
+
+func TestCollectTempOutputs(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+
+	done := make(chan error, 1)
+	var temp, outputs map[string][]*DataOutputFile
+	go func() {
+		var err error
+		temp, outputs, err = c.CollectTempOutputs(context.Background(), "p1")
+		done <- err
+	}()
+	waitFor(t, "subscription", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions) == 1
+	})
+
+	file := func(filename, fileType string) string {
+		return fmt.Sprintf(`{"filename":%q,"subfolder":"","type":%q}`, filename, fileType)
+	}
+	m.send(t, `{"type":"executed","data":{"node":"5","prompt_id":"p1","output":{"images":[`+file("preview_1.png", "temp")+`]}}}`)
+	m.send(t, `{"type":"executed","data":{"node":"9","prompt_id":"p1","output":{"images":[`+file("final_1.png", "output")+`]}}}`)
+	m.send(t, `{"type":"executed","data":{"node":"5","prompt_id":"p1","output":{"images":[`+file("preview_2.png", "temp")+`]}}}`)
+	m.send(t, `{"type":"executed","data":{"node":"7","prompt_id":"p1","output":{"images":[`+file("mask.png", "temp")+`,`+file("final_2.png", "output")+`]}}}`)
+	m.send(t, executingMessage("p1", ""))
+	if err := <-done; err != nil {
+		t.Fatalf("CollectTempOutputs: %v", err)
+	}
+
+	names := func(files map[string][]*DataOutputFile) map[string]string {
+		result := make(map[string]string)
+		for node, nodeFiles := range files {
+			result[node] = strings.Join(filenames(nodeFiles), ",")
+		}
+		return result
+	}
+	if got, want := names(temp), map[string]string{"5": "preview_1.png,preview_2.png", "7": "mask.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("temp outputs = %v, want %v", got, want)
+	}
+	if got, want := names(outputs), map[string]string{"9": "final_1.png", "7": "final_2.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("outputs = %v, want %v", got, want)
+	}
+}
+
+func TestWaitForPromptRecoversFromHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		wantErr error
+	}{
+		{
+			name:   "success",
+			status: `{"status_str":"success","completed":true,"messages":[["execution_start",{"prompt_id":"p1"}],["execution_success",{"prompt_id":"p1"}]]}`,
+		},
+		{
+			name:    "error",
+			status:  `{"status_str":"error","completed":false,"messages":[["execution_start",{"prompt_id":"p1"}],["execution_error",{"prompt_id":"p1","node_id":"12","node_type":"SaveImage","exception_message":"disk full","exception_type":"OSError","traceback":[],"current_inputs":{},"current_outputs":{}}]]}`,
+			wantErr: ErrPromptFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			var finished atomic.Bool
+			m.mux.HandleFunc("/history/p1", func(w http.ResponseWriter, r *http.Request) {
+				if !finished.Load() {
+					fmt.Fprint(w, `{}`)
+					return
+				}
+				fmt.Fprintf(w, `{"p1":{"prompt":[1,"p1",{}],"outputs":{
+					"9":{"images":[{"filename":"a.png","subfolder":"","type":"output"}]},
+					"12":{"images":[{"filename":"b.png","subfolder":"","type":"output"}]}},"status":%s}}`, tt.status)
+			})
+			c := newConnectedClient(t, m, WithReconnectInterval(10*time.Millisecond))
+
+			done := make(chan error, 1)
+			var outputs map[string][]*DataOutputFile
+			go func() {
+				var err error
+				outputs, err = c.WaitForPrompt(context.Background(), "p1")
+				done <- err
+			}()
+			waitFor(t, "subscription", func() bool {
+				c.subMu.Lock()
+				defer c.subMu.Unlock()
+				return len(c.subscriptions) == 1
+			})
+			// the frame is read before the connection drops, so a.png arrives both live and from history
+			m.send(t, executedMessage("p1", "9", "a.png"))
+
+			// the prompt ends while the websocket is down, the waiter learns it from history
+			finished.Store(true)
+			m.closeConns()
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("WaitForPrompt = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("WaitForPrompt is not recovered after the reconnect")
+			}
+			if len(outputs["9"]) != 1 || len(outputs["12"]) != 1 {
+				t.Errorf("outputs = %v, want a.png once and b.png", outputs)
+			}
+		})
+	}
+}
+
+func TestWaitForPromptSurvivesReconnect(t *testing.T) {
+	m := newMockServer(t)
+	var finished, asked atomic.Bool
+	m.mux.HandleFunc("/history/p1", func(w http.ResponseWriter, r *http.Request) {
+		asked.Store(true)
+		if !finished.Load() {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		fmt.Fprint(w, `{"p1":{"prompt":[1,"p1",{}],"outputs":{
+			"9":{"images":[{"filename":"a.png","subfolder":"","type":"output"}]},
+			"10":{"images":[{"filename":"b.png","subfolder":"","type":"output"}]},
+			"12":{"images":[{"filename":"c.png","subfolder":"","type":"output"}]}},
+			"status":{"status_str":"success","completed":true,"messages":[]}}}`)
+	})
+	c := newConnectedClient(t, m, WithReconnectInterval(10*time.Millisecond))
+
+	done := make(chan error, 1)
+	var outputs map[string][]*DataOutputFile
+	go func() {
+		var err error
+		outputs, err = c.WaitForPrompt(context.Background(), "p1")
+		done <- err
+	}()
+	waitFor(t, "subscription", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1
+	})
+	m.send(t, executedMessage("p1", "9", "a.png"))
+
+	// the prompt is still running while the websocket is down, b.png is only known to history
+	m.closeConns()
+	waitFor(t, "reconnect", func() bool { return m.connCount() >= 2 && asked.Load() })
+	waitFor(t, "mark", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		for sub := range c.subscriptions["p1"] {
+			return sub.reconnected.Load()
+		}
+		return false
+	})
+	select {
+	case err := <-done:
+		t.Fatalf("WaitForPrompt ended by the reconnect: %v", err)
+	default:
+	}
+
+	finished.Store(true)
+	m.send(t, executedMessage("p1", "12", "c.png"))
+	m.send(t, `{"type":"execution_success","data":{"prompt_id":"p1"}}`)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitForPrompt = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForPrompt does not end after the reconnect")
+	}
+	for _, node := range []string{"9", "10", "12"} {
+		if len(outputs[node]) != 1 {
+			t.Errorf("outputs[%s] = %v, want one file", node, outputs[node])
+		}
+	}
+}
+
+func TestHistoryMessagesOrder(t *testing.T) {
+	history := &PromptHistoryItem{PromptID: "p1", PromptHistoryMember: PromptHistoryMember{Outputs: map[string]PromptHistoryMemberImages{
+		"10": {Images: []DataOutputFile{{Filename: "b.png"}}},
+		"2":  {Images: []DataOutputFile{{Filename: "a.png"}}},
+		"12": {Images: []DataOutputFile{{Filename: "c.png"}}},
+	}}}
+
+	var got []string
+	for _, message := range historyMessages(history) {
+		if executed, ok := message.Data.(*WSMessageDataExecuted); ok {
+			got = append(got, executed.Node)
+		}
+	}
+	want := []string{"2", "10", "12"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("historyMessages nodes = %v, want %v", got, want)
+	}
+}
+
+func TestWithOnReconnect(t *testing.T) {
+	m := newMockServer(t)
+	m.mux.HandleFunc("/history/p1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"p1":{"prompt":[1,"p1",{}],"outputs":{
+			"9":{"images":[{"filename":"a.png","subfolder":"","type":"output"}]}},
+			"status":{"status_str":"success","completed":true,"messages":[]}}}`)
+	})
+	m.mux.HandleFunc("/history/p2", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	})
+	events := make(chan ReconnectEvent, 1)
+	c := newConnectedClient(t, m, WithReconnectInterval(50*time.Millisecond),
+		WithOnReconnect(func(event ReconnectEvent) { events <- event }))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.WaitForPrompt(context.Background(), "p1")
+		done <- err
+	}()
+	go c.WaitForPrompt(c.Context(), "p2")
+	waitFor(t, "subscriptions", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1 && len(c.subscriptions["p2"]) == 1
+	})
+
+	// p1 ends while the websocket is down
+	m.closeConns()
+	select {
+	case event := <-events:
+		if event.Downtime <= 0 {
+			t.Errorf("Downtime = %v, want > 0", event.Downtime)
+		}
+		if event.Recovered != 1 || event.Pending != 1 {
+			t.Errorf("Recovered, Pending = %d, %d, want 1, 1", event.Recovered, event.Pending)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect callback was not called")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitForPrompt = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForPrompt does not end after the reconnect")
+	}
+}
+
+func TestWaitForPrompts(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+
+	type waited struct {
+		results map[string]*RunResult
+		err     error
+	}
+	done := make(chan waited, 1)
+	go func() {
+		results, err := c.WaitForPrompts(context.Background(), []string{"p1", "p2", "p3"})
+		done <- waited{results, err}
+	}()
+	waitFor(t, "subscriptions", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1 && len(c.subscriptions["p2"]) == 1 && len(c.subscriptions["p3"]) == 1
+	})
+
+	for _, msg := range []string{
+		`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+		executedMessage("p1", "9", "a.png"),
+		executedMessage("p3", "9", "c.png"),
+		`{"type":"execution_error","data":{"prompt_id":"p2","node_id":"4","node_type":"KSampler","exception_message":"boom"}}`,
+		executedMessage("p1", "10", "b.png"),
+		`{"type":"execution_interrupted","data":{"prompt_id":"p3","node_id":"10","node_type":"SaveImage","executed":["9"]}}`,
+		`{"type":"execution_success","data":{"prompt_id":"p1"}}`,
+	} {
+		m.send(t, msg)
+	}
+
+	var got waited
+	select {
+	case got = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForPrompts does not return")
+	}
+	var errs PromptErrors
+	if !errors.As(got.err, &errs) {
+		t.Fatalf("error = %v, want PromptErrors", got.err)
+	}
+	if len(errs) != 2 || !errors.Is(errs["p2"], ErrPromptFailed) || !errors.Is(errs["p3"], ErrPromptInterrupted) {
+		t.Errorf("errors = %v, want p2 failed and p3 interrupted", errs)
+	}
+	if !errors.Is(got.err, ErrPromptFailed) {
+		t.Errorf("errors.Is(%v, ErrPromptFailed) = false", got.err)
+	}
+	if len(got.results) != 3 {
+		t.Fatalf("results = %v, want 3", got.results)
+	}
+	if p1 := got.results["p1"]; len(p1.Outputs["9"]) != 1 || len(p1.Outputs["10"]) != 1 || p1.Interrupted {
+		t.Errorf("p1 = %+v, want two outputs", p1)
+	}
+	if p3 := got.results["p3"]; !p3.Interrupted || len(p3.Outputs["9"]) != 1 {
+		t.Errorf("p3 = %+v, want interrupted with one output", p3)
+	}
+}
+
+func TestWaitForPromptsContextDone(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type waited struct {
+		results map[string]*RunResult
+		err     error
+	}
+	done := make(chan waited, 1)
+	go func() {
+		results, err := c.WaitForPrompts(ctx, []string{"p1", "p2"})
+		done <- waited{results, err}
+	}()
+	waitFor(t, "subscriptions", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1 && len(c.subscriptions["p2"]) == 1
+	})
+	m.send(t, `{"type":"execution_success","data":{"prompt_id":"p1"}}`)
+	waitFor(t, "p1 ended", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 0
+	})
+	cancel()
+
+	got := <-done
+	if !errors.Is(got.err, context.Canceled) {
+		t.Fatalf("error = %v, want context.Canceled", got.err)
+	}
+	if _, exist := got.results["p1"]; !exist || len(got.results) != 1 {
+		t.Errorf("results = %v, want only p1", got.results)
+	}
+}
+
+func TestWaitForPromptEmptyNodeEndsPrompt(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m, WithTaskStatusBufferSize(4))
+
+	done := make(chan error, 1)
+	var outputs map[string][]*DataOutputFile
+	go func() {
+		var err error
+		outputs, err = c.WaitForPrompt(context.Background(), "p1")
+		done <- err
+	}()
+	waitFor(t, "subscription", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1
+	})
+	m.send(t, executingMessage("p1", "9"))
+	m.send(t, executedMessage("p1", "9", "a.png"))
+	// the end of another prompt does not end p1
+	m.send(t, `{"type":"executing","data":{"node":"","prompt_id":"p2"}}`)
+	select {
+	case err := <-done:
+		t.Fatalf("WaitForPrompt ended by the end of another prompt: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// no execution_success follows
+	m.send(t, `{"type":"executing","data":{"node":"","prompt_id":"p1"}}`)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitForPrompt = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForPrompt does not end on an executing message with an empty node")
+	}
+	if len(outputs["9"]) != 1 {
+		t.Errorf("outputs = %v, want a.png of node 9", outputs)
+	}
+
+	var message WSMessage
+	if err := json.Unmarshal([]byte(`{"type":"executing","data":{"node":"","prompt_id":"p1"}}`), &message); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if !message.Data.(*WSMessageDataExecuting).IsFinished() {
+		t.Error("IsFinished = false for an empty node")
+	}
+}
+
+func TestRunWorkflowResult(t *testing.T) {
+	tests := []struct {
+		name            string
+		end             string
+		wantInterrupted bool
+		wantErr         error
+	}{
+		{name: "success", end: `{"type":"execution_success","data":{"prompt_id":"prompt-1"}}`},
+		{
+			name:            "interrupted",
+			end:             `{"type":"execution_interrupted","data":{"prompt_id":"prompt-1","node_id":"9","node_type":"SaveImage","executed":["3"]}}`,
+			wantInterrupted: true,
+			wantErr:         ErrPromptInterrupted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			c := newConnectedClient(t, m)
+			m.onPrompt = func(promptID string, body map[string]interface{}) {
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					m.send(t, executedMessage(promptID, "3", "a.png"))
+					m.send(t, tt.end)
+				}()
+			}
+
+			result, err := c.RunWorkflow(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RunWorkflow = %v, want %v", err, tt.wantErr)
+			}
+			if result.PromptID != "prompt-1" {
+				t.Errorf("PromptID = %s, want prompt-1", result.PromptID)
+			}
+			if len(result.Outputs["3"]) != 1 || result.Outputs["3"][0].Filename != "a.png" {
+				t.Errorf("Outputs = %v, want a.png of node 3", result.Outputs)
+			}
+			if result.Duration < 20*time.Millisecond {
+				t.Errorf("Duration = %v, want at least the 20ms the run took", result.Duration)
+			}
+			if result.Interrupted != tt.wantInterrupted {
+				t.Errorf("Interrupted = %t, want %t", result.Interrupted, tt.wantInterrupted)
+			}
+		})
+	}
+}
+
+func TestRunWorkflowSharesConnection(t *testing.T) {
+	m := newMockServer(t)
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			m.send(t, executedMessage(promptID, "3", promptID+".png"))
+			m.send(t, fmt.Sprintf(`{"type":"execution_success","data":{"prompt_id":%q}}`, promptID))
+		}()
+	}
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	t.Cleanup(func() { c.webSocket.Shutdown() })
+
+	for i := 1; i <= 2; i++ {
+		result, err := c.RunWorkflow(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+		if err != nil {
+			t.Fatalf("RunWorkflow %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("prompt-%d.png", i); len(result.Outputs["3"]) != 1 || result.Outputs["3"][0].Filename != want {
+			t.Errorf("Outputs %d = %v, want %s", i, result.Outputs, want)
+		}
+	}
+	if got := m.connCount(); got != 1 {
+		t.Errorf("connections = %d, want the first one reused", got)
+	}
+	if !c.IsInitialized() {
+		t.Error("connection is closed after RunWorkflow, want it kept until Close")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := c.RunWorkflow(context.Background(), map[string]interface{}{"1": map[string]interface{}{}}); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("RunWorkflow after Close = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestCloseWaitsForWaiters(t *testing.T) {
+	m := newMockServer(t)
+	c, err := NewDefaultClientStr(m.URL)
+	if err != nil {
+		t.Fatalf("NewDefaultClientStr: %v", err)
+	}
+	t.Cleanup(func() { c.webSocket.Shutdown() })
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.WaitForPrompt(context.Background(), "p1")
+		done <- err
+	}()
+	waitFor(t, "subscription", func() bool {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		return len(c.subscriptions["p1"]) == 1
+	})
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !c.IsInitialized() {
+		t.Fatal("Close shut the connection down while WaitForPrompt waits on it")
+	}
+	m.send(t, `{"type":"execution_success","data":{"prompt_id":"p1"}}`)
+	if err := <-done; err != nil {
+		t.Fatalf("WaitForPrompt: %v", err)
+	}
+	waitFor(t, "shutdown after the last waiter", func() bool { return c.Context().Err() != nil })
+}
+
+func TestWaitForPromptUsesDisplayNode(t *testing.T) {
+	m := newMockServer(t)
+	c := newConnectedClient(t, m)
+	m.onPrompt = func(promptID string, body map[string]interface{}) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			m.send(t, executedMessage(promptID, "3", "a.png"))
+			m.send(t, fmt.Sprintf(`{"type":"executed","data":{"node":"7.0.2","display_node":"7","output":{"images":[{"filename":"b.png","subfolder":"","type":"output"}]},"prompt_id":%q}}`, promptID))
+			m.send(t, fmt.Sprintf(`{"type":"execution_success","data":{"prompt_id":%q}}`, promptID))
+		}()
+	}
+
+	outputs, err := c.RunWorkflowOutputs(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+	if err != nil {
+		t.Fatalf("RunWorkflowOutputs: %v", err)
+	}
+	if len(outputs) != 2 || len(outputs["3"]) != 1 || len(outputs["7"]) != 1 || outputs["7"][0].Filename != "b.png" {
+		t.Errorf("outputs = %v, want a.png of node 3 and b.png of the subgraph node 7", outputs)
+	}
+}
+
+func TestPromptContext(t *testing.T) {
+	tests := []struct {
+		name      string
+		end       string
+		wantCause error
+	}{
+		{
+			name:      "error",
+			end:       `{"type":"execution_error","data":{"prompt_id":"p1","node_id":"3","node_type":"KSampler","exception_message":"CUDA out of memory","exception_type":"torch.cuda.OutOfMemoryError"}}`,
+			wantCause: ErrPromptFailed,
+		},
+		{
+			name:      "interrupted",
+			end:       `{"type":"execution_interrupted","data":{"prompt_id":"p1","node_id":"3","node_type":"KSampler","executed":[]}}`,
+			wantCause: ErrPromptInterrupted,
+		},
+		{name: "success", end: `{"type":"execution_success","data":{"prompt_id":"p1"}}`, wantCause: ErrPromptCompleted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			c := newConnectedClient(t, m)
+
+			ctx, cancel := c.PromptContext(context.Background(), "p1")
+			defer cancel(nil)
+			m.send(t, tt.end)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("context is not cancelled when the prompt ends")
+			}
+			if cause := context.Cause(ctx); !errors.Is(cause, tt.wantCause) {
+				t.Errorf("cause = %v, want %v", cause, tt.wantCause)
+			}
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				t.Errorf("ctx.Err() = %v, want %v", ctx.Err(), context.Canceled)
+			}
+		})
+	}
+
+	t.Run("execution error cause", func(t *testing.T) {
+		m := newMockServer(t)
+		c := newConnectedClient(t, m)
+		ctx, cancel := c.PromptContext(context.Background(), "p1")
+		defer cancel(nil)
+		m.send(t, tests[0].end)
+		<-ctx.Done()
+
+		var execErr *PromptExecutionError
+		if !errors.As(context.Cause(ctx), &execErr) || execErr.ExceptionMessage != "CUDA out of memory" || execErr.Node != "3" {
+			t.Errorf("cause = %v, want the execution error of node 3", context.Cause(ctx))
+		}
+	})
+
+	t.Run("parent cancelled", func(t *testing.T) {
+		m := newMockServer(t)
+		c := newConnectedClient(t, m)
+		parent, cancelParent := context.WithCancel(context.Background())
+		ctx, cancel := c.PromptContext(parent, "p1")
+		defer cancel(nil)
+		cancelParent()
+		<-ctx.Done()
+		if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+			t.Errorf("cause = %v, want %v", cause, context.Canceled)
+		}
+	})
+}
+
+func TestWaitForFirstProgress(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		wantErr  error
+	}{
+		{
+			name: "progress",
+			messages: []string{
+				`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+				`{"type":"executing","data":{"node":"4","prompt_id":"p1"}}`,
+				`{"type":"progress","data":{"value":1,"max":20}}`,
+			},
+		},
+		{
+			name: "error before progress",
+			messages: []string{
+				`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+				`{"type":"execution_error","data":{"prompt_id":"p1","node_id":"4","node_type":"CheckpointLoaderSimple","exception_message":"file not found","exception_type":"FileNotFoundError"}}`,
+			},
+			wantErr: ErrPromptFailed,
+		},
+		{
+			name: "interrupted before progress",
+			messages: []string{
+				`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+				`{"type":"execution_interrupted","data":{"prompt_id":"p1","node_id":"4","node_type":"CheckpointLoaderSimple","executed":[]}}`,
+			},
+			wantErr: ErrPromptInterrupted,
+		},
+		{
+			name: "cached without progress",
+			messages: []string{
+				`{"type":"execution_start","data":{"prompt_id":"p1"}}`,
+				`{"type":"execution_cached","data":{"nodes":["4","9"],"prompt_id":"p1"}}`,
+				`{"type":"execution_success","data":{"prompt_id":"p1"}}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			c := newConnectedClient(t, m)
+
+			done := make(chan error, 1)
+			go func() { done <- c.WaitForFirstProgress(context.Background(), "p1") }()
+			waitFor(t, "subscription", func() bool {
+				c.subMu.Lock()
+				defer c.subMu.Unlock()
+				return len(c.subscriptions["p1"]) == 1
+			})
+			for _, msg := range tt.messages {
+				m.send(t, msg)
+			}
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("WaitForFirstProgress = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("WaitForFirstProgress did not return")
+			}
+		})
+	}
+
+	t.Run("progress of another prompt", func(t *testing.T) {
+		m := newMockServer(t)
+		c := newConnectedClient(t, m)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			m.send(t, `{"type":"execution_start","data":{"prompt_id":"p2"}}`)
+			m.send(t, `{"type":"progress","data":{"value":1,"max":20}}`)
+		}()
+		if err := c.WaitForFirstProgress(ctx, "p1"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("WaitForFirstProgress = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestOOMRetry(t *testing.T) {
+	oomError := `{"type":"execution_error","data":{"prompt_id":%q,"node_id":"3","node_type":"KSampler","exception_message":"CUDA out of memory. Tried to allocate 2.00 GiB","exception_type":"torch.cuda.OutOfMemoryError"}}`
+	valueError := `{"type":"execution_error","data":{"prompt_id":%q,"node_id":"3","node_type":"KSampler","exception_message":"bad seed","exception_type":"ValueError"}}`
+	success := `{"type":"execution_success","data":{"prompt_id":%q}}`
+	tests := []struct {
+		name        string
+		maxRetries  int
+		ends        []string
+		wantErr     error
+		wantPrompts int
+		wantFrees   int32
+	}{
+		{name: "retried after oom", maxRetries: 2, ends: []string{oomError, success}, wantPrompts: 2, wantFrees: 1},
+		{name: "gives up after the limit", maxRetries: 1, ends: []string{oomError, oomError, success}, wantErr: ErrPromptFailed, wantPrompts: 2, wantFrees: 1},
+		{name: "other errors are not retried", maxRetries: 2, ends: []string{valueError, success}, wantErr: ErrPromptFailed, wantPrompts: 1},
+		{name: "without the option", ends: []string{oomError, success}, wantErr: ErrPromptFailed, wantPrompts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(t)
+			var frees atomic.Int32
+			m.mux.HandleFunc("/free", func(w http.ResponseWriter, r *http.Request) {
+				var body map[string]bool
+				json.NewDecoder(r.Body).Decode(&body)
+				if !body["unload_models"] || !body["free_memory"] {
+					t.Errorf("/free body = %v, want models unloaded and memory freed", body)
+				}
+				frees.Add(1)
+			})
+			var n atomic.Int32
+			m.onPrompt = func(promptID string, body map[string]interface{}) {
+				end := tt.ends[n.Add(1)-1]
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					m.send(t, fmt.Sprintf(end, promptID))
+				}()
+			}
+			c := newConnectedClient(t, m, WithOOMRetry(tt.maxRetries))
+
+			result, err := c.RunWorkflow(context.Background(), map[string]interface{}{"1": map[string]interface{}{}})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RunWorkflow = %v, want %v", err, tt.wantErr)
+			}
+			if got := len(m.promptBodies()); got != tt.wantPrompts {
+				t.Errorf("prompts = %d, want %d", got, tt.wantPrompts)
+			}
+			if got := frees.Load(); got != tt.wantFrees {
+				t.Errorf("/free calls = %d, want %d", got, tt.wantFrees)
+			}
+			if want := fmt.Sprintf("prompt-%d", tt.wantPrompts); result.PromptID != want || result.Retries != tt.wantPrompts-1 {
+				t.Errorf("result = %+v, want %s after %d retries", result, want, tt.wantPrompts-1)
+			}
+		})
+	}
+}